@@ -1,5 +1,7 @@
 package archive
 
+import "github.com/kpetku/libsyndie/crypto"
+
 type Archive struct {
 	ChannelHashes []ChannelHash
 	Messages      []Message
@@ -17,7 +19,7 @@ type Header struct {
 }
 
 type ChannelHash struct {
-	ChannelHash    [32]byte
+	ChannelHash    crypto.ChannelID
 	ChannelEdition uint64
 	ChannelFlags   byte
 }
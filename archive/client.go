@@ -1,12 +1,15 @@
 package archive
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"net/http"
 	"strconv"
-
-	"github.com/go-i2p/go-i2p/lib/common/base64"
+	"strings"
 )
 
 const upperBoundLimit = 10000
@@ -14,6 +17,8 @@ const invalidArchiveServer = "invalid syndie archive server"
 
 type Client struct {
 	*Archive
+	// HTTPClient makes the requests of Fetch and FetchMessage, http.DefaultClient is used if nil
+	HTTPClient *http.Client
 }
 
 type reader struct {
@@ -28,13 +33,16 @@ func (r *reader) read(data interface{}) {
 }
 
 func NewClient() *Client {
-	return &Client{}
+	return &Client{Archive: &Archive{}}
 }
 
 func (c *Client) Parse(input io.Reader) error {
 	var url []string
 	r := reader{r: input}
 
+	// Forget any index parsed before so channel numbers refer to this one
+	c.ChannelHashes, c.Messages, c.Urls = nil, nil, nil
+
 	// Read ArchiveFlags (unimplemented)
 	r.read(&c.ArchiveFlags)
 
@@ -70,7 +78,7 @@ func (c *Client) Parse(input io.Reader) error {
 	for i := 0; i < int(c.NumChannels); i++ {
 		var hash ChannelHash
 		r.read(&hash)
-		url = append(url, base64.I2PEncoding.EncodeToString(hash.ChannelHash[:])+"/meta.syndie")
+		url = append(url, hash.ChannelHash.String()+"/meta.syndie")
 		c.ChannelHashes = append(c.ChannelHashes, hash)
 	}
 
@@ -83,7 +91,13 @@ func (c *Client) Parse(input io.Reader) error {
 	var message Message
 	for i := 0; i < int(c.NumMessages); i++ {
 		r.read(&message)
-		url = append(url, base64.I2PEncoding.EncodeToString(c.ChannelHashes[int(message.ScopeChannel)].ChannelHash[:])+"/"+strconv.Itoa(int(message.MessageID))+".syndie")
+		if r.err != nil {
+			return r.err
+		}
+		if int(message.ScopeChannel) >= len(c.ChannelHashes) {
+			return errors.New(invalidArchiveServer + ": message scope channel out of range")
+		}
+		url = append(url, c.ChannelHashes[int(message.ScopeChannel)].ChannelHash.String()+"/"+strconv.Itoa(int(message.MessageID))+".syndie")
 		c.Messages = append(c.Messages, message)
 	}
 	if r.err != nil {
@@ -92,3 +106,57 @@ func (c *Client) Parse(input io.Reader) error {
 	c.Urls = url
 	return nil
 }
+
+// Fetch downloads the shared-index.dat of the archive at url and parses it
+func (c *Client) Fetch(ctx context.Context, url string) error {
+	raw, err := fetch(ctx, c.HTTPClient, archiveURL(url)+sharedIndex, DefaultMaxIndexSize)
+	if err != nil {
+		return err
+	}
+	return c.Parse(bytes.NewReader(raw))
+}
+
+// FetchMessage downloads a message from the archive at url, where path is one of the Urls
+// listed in its shared index
+func (c *Client) FetchMessage(ctx context.Context, url string, path string) ([]byte, error) {
+	return fetch(ctx, c.HTTPClient, archiveURL(url)+path, DefaultMaxMessageSize)
+}
+
+// fetch downloads a file of at most limit bytes, reading file:// URLs from disk
+func fetch(ctx context.Context, hc *http.Client, url string, limit int64) ([]byte, error) {
+	if strings.HasPrefix(url, "file:") {
+		return readFile(url, limit)
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("fetching %s: larger than %d bytes", url, limit)
+	}
+	return data, nil
+}
+
+// archiveURL strips shared-index.dat from an archive URL and ensures it ends with a slash
+func archiveURL(url string) string {
+	url = strings.TrimSuffix(strings.TrimSpace(url), sharedIndex)
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return url
+}
@@ -0,0 +1,46 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+// testIndex returns the shared-index.dat of one message in each of the given channels
+func testIndex(t *testing.T, channels ...crypto.ChannelID) []byte {
+	t.Helper()
+	a := &Archive{}
+	for i, id := range channels {
+		a.ChannelHashes = append(a.ChannelHashes, ChannelHash{ChannelHash: id})
+		a.Messages = append(a.Messages, Message{MessageID: uint64(i + 1), ScopeChannel: uint32(i), TargetChannel: uint32(i)})
+	}
+	a.NumChannels = uint32(len(a.ChannelHashes))
+	a.NumMessages = uint32(len(a.Messages))
+	var buf bytes.Buffer
+	if err := (&Server{Archive: a}).Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestClientParseTwice(t *testing.T) {
+	first, second, third := crypto.ChannelID{1}, crypto.ChannelID{2}, crypto.ChannelID{3}
+	c := NewClient()
+	if err := c.Parse(bytes.NewReader(testIndex(t, first, second))); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Parse(bytes.NewReader(testIndex(t, third))); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ChannelHashes) != 1 || c.ChannelHashes[0].ChannelHash != third {
+		t.Fatalf("got channels %v after parsing a second index", c.ChannelHashes)
+	}
+	if len(c.Messages) != 1 || c.Messages[0].MessageID != 1 {
+		t.Fatalf("got messages %v after parsing a second index", c.Messages)
+	}
+	want := []string{third.String() + "/" + metaFile, third.String() + "/1" + messageExt}
+	if len(c.Urls) != len(want) || c.Urls[0] != want[0] || c.Urls[1] != want[1] {
+		t.Errorf("got urls %v, want %v", c.Urls, want)
+	}
+}
@@ -0,0 +1,147 @@
+package archive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/internal/atomicfile"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+const metaFile string = "meta.syndie"
+const messageExt string = ".syndie"
+
+// OpenStore creates a Store that keeps its messages in dir, laid out the same way an archive
+// publishes them: <channel>/meta.syndie for channel metadata and <channel>/<messageID>.syndie
+// for posts.  The messages already in dir are loaded, and files that no longer decode or are
+// refused by the posting policy are skipped.  Channel metadata in dir is trusted, since the store
+// only writes editions it has verified.  The keyring, which may be nil, is used to decode
+// posts to private channels.
+func OpenStore(dir string, keyring *crypto.Keyring) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := NewStore()
+	s.Keyring = keyring
+	channels, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var posts []string
+	for _, c := range channels {
+		if !c.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, c.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			name := filepath.Join(dir, c.Name(), f.Name())
+			switch {
+			case f.Name() == metaFile:
+				// Metadata is loaded first so posts are checked against their channel's policy
+				s.loadMeta(name)
+			case strings.HasSuffix(f.Name(), messageExt):
+				posts = append(posts, name)
+			}
+		}
+	}
+	for _, name := range posts {
+		s.importFile(name)
+	}
+	s.dir = dir
+	return s, nil
+}
+
+// Dir returns the directory the store is kept in, or "" if it is only held in memory
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// Import decodes a raw message and puts it into the store
+func (s *Store) Import(raw []byte) (*syndieutil.Header, error) {
+	m, err := s.decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	return m.Header(), s.Put(m, raw)
+}
+
+// decode decodes a raw message, trying the read keys in the store's Keyring
+func (s *Store) decode(raw []byte) (*syndieutil.DecodedMessage, error) {
+	var opts []func(*syndieutil.Decoder)
+	if s.Keyring != nil {
+		opts = append(opts, syndieutil.ReadKeyResolver(s.Keyring))
+	}
+	return syndieutil.NewDecoder(opts...).Decode(bytes.NewReader(raw))
+}
+
+// loadMeta loads channel metadata from the store's own directory.  Only the current edition is
+// kept on disk and it was checked against the editions before it when it was put, so it is
+// loaded even when a manager rather than the channel's identity signed it.
+func (s *Store) loadMeta(name string) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	m, err := s.decode(raw)
+	if err != nil {
+		return
+	}
+	h := m.Header()
+	if !h.IsMeta() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.putMeta(h, m.Signatures(), raw, true)
+}
+
+func (s *Store) importFile(name string) {
+	raw, err := os.ReadFile(name)
+	if err != nil {
+		return
+	}
+	s.Import(raw)
+}
+
+// path returns where an entry is kept on disk, or "" if the store is not backed by a directory
+func (s *Store) path(e *Entry) string {
+	if s.dir == "" {
+		return ""
+	}
+	// Channel hashes use the I2P base64 alphabet, which never contains a path separator
+	return filepath.Join(s.dir, e.channel.String(), fileName(e))
+}
+
+// fileName returns the name of an entry's file within its channel directory
+func fileName(e *Entry) string {
+	if e.Header.IsMeta() {
+		return metaFile
+	}
+	return strconv.Itoa(e.Header.PostURI.MessageID) + messageExt
+}
+
+// save writes an entry to disk
+func (s *Store) save(e *Entry) error {
+	name := s.path(e)
+	if name == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(name, e.Raw)
+}
+
+// remove deletes an entry from disk, if it is there
+func (s *Store) remove(e *Entry) {
+	if name := s.path(e); name != "" {
+		os.Remove(name)
+	}
+}
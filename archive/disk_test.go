@@ -0,0 +1,136 @@
+package archive
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+func TestOpenStorePersists(t *testing.T) {
+	dir := t.TempDir()
+	owner, meta, metaRaw := testChannel(t, "persisted")
+	hash := owner.Identity.ChannelID().String()
+
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Dir() != dir {
+		t.Fatalf("store is kept in %q, want %q", s.Dir(), dir)
+	}
+	mustPut(t, s, meta, metaRaw)
+	for id := 1; id <= 2; id++ {
+		post, raw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, id)))
+		mustPut(t, s, post, raw)
+	}
+	cancel, cancelRaw := testPost(t, owner.Identity,
+		syndieutil.PostURI(postURI(hash, 3)),
+		syndieutil.Cancel([]syndieutil.URI{postURI(hash, 2)}),
+	)
+	mustPut(t, s, cancel, cancelRaw)
+	for _, name := range []string{metaFile, "1" + messageExt, "2" + messageExt, "3" + messageExt} {
+		if _, err := os.Stat(filepath.Join(dir, hash, name)); err != nil {
+			t.Errorf("%s was not written: %s", name, err)
+		}
+	}
+
+	// Cancelled messages stay on disk so the cancel is applied again when reopening, and
+	// files that no longer decode or break the posting policy are skipped when reopening
+	stranger, _, _ := testChannel(t, "stranger")
+	_, forgedRaw := testPost(t, stranger.Identity,
+		syndieutil.PostURI(postURI(hash, 4)),
+		syndieutil.TargetChannel(hash),
+	)
+	if err := os.WriteFile(filepath.Join(dir, hash, "4"+messageExt), forgedRaw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, hash, "5"+messageExt), []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := reopened.Meta(hash); !ok || m.Header.Name != "persisted" {
+		t.Fatal("metadata was not loaded")
+	}
+	for id, want := range map[int]bool{1: true, 2: false, 3: true, 4: false, 5: false} {
+		if _, got := reopened.Get(postURI(hash, id)); got != want {
+			t.Errorf("message %d loaded: %t, want %t", id, got, want)
+		}
+	}
+	if e, ok := reopened.Get(postURI(hash, 1)); !ok || e.Authorization != syndieutil.Authorized {
+		t.Error("a post loaded before its metadata was not checked against the channel's policy")
+	}
+}
+
+func TestOpenStorePrivatePosts(t *testing.T) {
+	dir := t.TempDir()
+	owner, _, metaRaw := testChannel(t, "private")
+	hash := owner.Identity.ChannelID().String()
+	readKey := owner.CurrentReadKey()
+	body, err := syndieutil.NewPostBuilder(syndieutil.PostURI(postURI(hash, 1))).AddPage("text/plain", "", "secret").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, hash), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(filepath.Join(dir, hash, "1"+messageExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := syndieutil.New(syndieutil.MessageType("post"), syndieutil.TargetChannel(hash)).Marshal(f, body, readKey, owner.Identity); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.WriteFile(filepath.Join(dir, hash, metaFile), metaRaw, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := OpenStore(dir, nil); err != nil || s.Has(postURI(hash, 1)) {
+		t.Fatalf("private post loaded without its read key: %v", err)
+	}
+	keyring := crypto.NewKeyring()
+	keyring.AddReadKey(hash, readKey)
+	s, err := OpenStore(dir, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(postURI(hash, 1)) {
+		t.Error("private post was not loaded with its read key")
+	}
+}
+
+func TestOpenStoreManagerSignedMetadata(t *testing.T) {
+	dir := t.TempDir()
+	owner, _, _ := testChannel(t, "managed")
+	manager, _, _ := testChannel(t, "manager")
+	id := owner.Identity.ChannelID()
+
+	s, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, firstRaw := testEdition(t, owner, 1, owner.Identity, manager.Identity)
+	mustPut(t, s, first, firstRaw)
+	second, secondRaw := testEdition(t, owner, 2, manager.Identity, manager.Identity)
+	mustPut(t, s, second, secondRaw)
+	post, postRaw := testPost(t, manager.Identity, syndieutil.PostURI(postURI(id.String(), 1)))
+	mustPut(t, s, post, postRaw)
+
+	reopened, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := reopened.ChannelMeta(id); !ok || m.Header.Edition != 2 {
+		t.Fatal("metadata signed by a manager was not loaded")
+	}
+	if e, ok := reopened.Get(postURI(id.String(), 1)); !ok || e.Authorization != syndieutil.Authorized {
+		t.Error("a post by a manager was not loaded against the metadata")
+	}
+}
@@ -0,0 +1,190 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/internal/atomicfile"
+)
+
+// DefaultMaxBundleEntries limits the number of files ImportBundle reads from a bundle
+const DefaultMaxBundleEntries = 100000
+
+// A file:// archive is a directory laid out like a Store opened with OpenStore, with the
+// shared-index.dat of its messages next to the channel directories.  It can be copied around,
+// served by any web server or given as a peer to a Syndicator.
+
+// filePath returns the directory or file a file:// URL names
+func filePath(rawurl string) (string, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "file" || (u.Host != "" && u.Host != "localhost") || u.Path == "" {
+		return "", errors.New("invalid file archive URL " + rawurl)
+	}
+	return filepath.FromSlash(u.Path), nil
+}
+
+// readFile reads a file of at most limit bytes from a file:// URL
+func readFile(rawurl string, limit int64) ([]byte, error) {
+	name, err := filePath(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, fmt.Errorf("reading %s: larger than %d bytes", name, limit)
+	}
+	return data, nil
+}
+
+// WriteSharedIndex writes the shared-index.dat of the messages in a Store to dir
+func WriteSharedIndex(dir string, store *Store) error {
+	s := &Server{Archive: &Archive{}, Store: store}
+	if err := s.BuildSharedIndex(); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := s.Write(&buf); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, sharedIndex), buf.Bytes())
+}
+
+// PushDir imports messages into the file archive in dir, creating it if needed, and rewrites its
+// shared-index.dat.  It returns the number of messages accepted.
+func PushDir(dir string, keyring *crypto.Keyring, messages ...[]byte) (int, error) {
+	store, err := OpenStore(dir, keyring)
+	if err != nil {
+		return 0, err
+	}
+	var accepted int
+	for _, m := range messages {
+		if _, err := store.Import(m); err == nil {
+			accepted++
+		}
+	}
+	return accepted, WriteSharedIndex(dir, store)
+}
+
+// BundleReport describes the outcome of ImportBundle
+type BundleReport struct {
+	// Imported counts the messages that were put into the store, including ones already there
+	Imported int
+	// Rejected holds the reason each rejected file was refused, by its name in the bundle
+	Rejected map[string]error
+}
+
+// ExportBundle writes a bundle holding the messages in a Store for which include returns true,
+// or all of them if include is nil.  A bundle is a zip of a file archive: shared-index.dat
+// along with <channel>/meta.syndie and <channel>/<messageID>.syndie files.  Messages are written
+// as the Store accepted them, without checking them against the posting policy again.
+func ExportBundle(w io.Writer, store *Store, include func(*Entry) bool) error {
+	var metas, posts []*Entry
+	for _, e := range store.Channels() {
+		if include == nil || include(e) {
+			metas = append(metas, e)
+		}
+	}
+	for _, e := range store.Messages() {
+		if include == nil || include(e) {
+			posts = append(posts, e)
+		}
+	}
+	zw := zip.NewWriter(w)
+	now := time.Now()
+	for _, e := range append(append([]*Entry(nil), metas...), posts...) {
+		name := e.channel.String() + "/" + fileName(e)
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: now})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(e.Raw); err != nil {
+			return err
+		}
+	}
+	s := &Server{Archive: indexEntries(Header{}, metas, posts, "")}
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: sharedIndex, Method: zip.Deflate, Modified: now})
+	if err != nil {
+		return err
+	}
+	if err := s.Write(f); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// ImportBundle imports every message in a bundle written by ExportBundle into a Store.  Channel
+// metadata is imported before posts, and files that are not messages are ignored.
+func ImportBundle(r io.ReaderAt, size int64, store *Store) (*BundleReport, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(zr.File) > DefaultMaxBundleEntries {
+		return nil, fmt.Errorf("bundle has more than %d files", DefaultMaxBundleEntries)
+	}
+	var files []*zip.File
+	for _, f := range zr.File {
+		split := strings.Split(f.Name, "/")
+		if len(split) != 2 || !strings.HasSuffix(split[1], messageExt) {
+			continue
+		}
+		files = append(files, f)
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return path.Base(files[i].Name) == metaFile && path.Base(files[j].Name) != metaFile
+	})
+	report := &BundleReport{Rejected: make(map[string]error)}
+	for _, f := range files {
+		raw, err := readBundleFile(f)
+		if err == nil {
+			_, err = store.Import(raw)
+		}
+		if err != nil {
+			report.Rejected[f.Name] = err
+			continue
+		}
+		report.Imported++
+	}
+	return report, nil
+}
+
+func readBundleFile(f *zip.File) ([]byte, error) {
+	if f.UncompressedSize64 > DefaultMaxMessageSize {
+		return nil, fmt.Errorf("larger than %d bytes", DefaultMaxMessageSize)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	raw, err := io.ReadAll(io.LimitReader(rc, DefaultMaxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) > DefaultMaxMessageSize {
+		return nil, fmt.Errorf("larger than %d bytes", DefaultMaxMessageSize)
+	}
+	return raw, nil
+}
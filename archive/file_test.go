@@ -0,0 +1,270 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// writeBundle writes a zip holding the given files in order
+func writeBundle(t *testing.T, files []bundleFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(f.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBundleRoundTrip(t *testing.T) {
+	exported, exportedMeta, exportedMetaRaw := testChannel(t, "exported")
+	other, otherMeta, otherMetaRaw := testChannel(t, "other")
+	hash := exported.Identity.ChannelID().String()
+	otherHash := other.Identity.ChannelID().String()
+
+	store := NewStore()
+	mustPut(t, store, exportedMeta, exportedMetaRaw)
+	mustPut(t, store, otherMeta, otherMetaRaw)
+	for id := 1; id <= 3; id++ {
+		h, raw := testPost(t, exported.Identity, syndieutil.PostURI(postURI(hash, id)))
+		mustPut(t, store, h, raw)
+	}
+	replacement, replacementRaw := testPost(t, exported.Identity,
+		syndieutil.PostURI(postURI(hash, 4)),
+		syndieutil.OverwriteURI(postURI(hash, 3)),
+	)
+	mustPut(t, store, replacement, replacementRaw)
+	h, raw := testPost(t, other.Identity, syndieutil.PostURI(postURI(otherHash, 1)))
+	mustPut(t, store, h, raw)
+
+	var bundle bytes.Buffer
+	if err := ExportBundle(&bundle, store, AuthoredBy(hash)); err != nil {
+		t.Fatal(err)
+	}
+	imported := NewStore()
+	report, err := ImportBundle(bytes.NewReader(bundle.Bytes()), int64(bundle.Len()), imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 4 || len(report.Rejected) != 0 {
+		t.Fatalf("imported %d messages and rejected %v, want the metadata and three posts", report.Imported, report.Rejected)
+	}
+	if _, ok := imported.Meta(hash); !ok {
+		t.Error("metadata was not exported")
+	}
+	if _, ok := imported.Meta(otherHash); ok || imported.Has(postURI(otherHash, 1)) {
+		t.Error("a channel left out by include was exported")
+	}
+	for id, want := range map[int]bool{1: true, 2: true, 3: false, 4: true} {
+		if got := imported.Has(postURI(hash, id)); got != want {
+			t.Errorf("message %d exported: %t, want %t", id, got, want)
+		}
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(bundle.Bytes()), int64(bundle.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := zr.Open(sharedIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	c := NewClient()
+	if err := c.Parse(index); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ChannelHashes) != 1 || len(c.Messages) != 3 {
+		t.Errorf("bundle index lists %d channels and %d messages", len(c.ChannelHashes), len(c.Messages))
+	}
+}
+
+func TestBundleManagerSignedMetadata(t *testing.T) {
+	owner, _, _ := testChannel(t, "managed")
+	manager, _, _ := testChannel(t, "manager")
+	hash := owner.Identity.ChannelID().String()
+	first, firstRaw := testEdition(t, owner, 1, owner.Identity, manager.Identity)
+	second, secondRaw := testEdition(t, owner, 2, manager.Identity, manager.Identity)
+	post, postRaw := testPost(t, manager.Identity, syndieutil.PostURI(postURI(hash, 1)))
+
+	store := NewStore()
+	mustPut(t, store, first, firstRaw)
+	mustPut(t, store, second, secondRaw)
+	mustPut(t, store, post, postRaw)
+	var bundle bytes.Buffer
+	if err := ExportBundle(&bundle, store, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader who already has the first edition takes the update signed by the manager
+	imported := NewStore()
+	mustPut(t, imported, first, firstRaw)
+	report, err := ImportBundle(bytes.NewReader(bundle.Bytes()), int64(bundle.Len()), imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 || len(report.Rejected) != 0 {
+		t.Fatalf("imported %d messages and rejected %v, want the metadata and the post", report.Imported, report.Rejected)
+	}
+	if m, ok := imported.Meta(hash); !ok || m.Header.Edition != 2 {
+		t.Error("metadata signed by a manager was not exported")
+	}
+	if e, ok := imported.Get(postURI(hash, 1)); !ok || e.Authorization != syndieutil.Authorized {
+		t.Error("post by a manager was not exported")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(bundle.Bytes()), int64(bundle.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := zr.Open(sharedIndex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	c := NewClient()
+	if err := c.Parse(index); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ChannelHashes) != 1 || c.ChannelHashes[0].ChannelEdition != 2 || len(c.Messages) != 1 {
+		t.Errorf("bundle index lists channels %v and %d messages", c.ChannelHashes, len(c.Messages))
+	}
+}
+
+func TestImportBundleMetadataFirst(t *testing.T) {
+	owner, _, metaRaw := testChannel(t, "ordered")
+	stranger, _, _ := testChannel(t, "stranger")
+	hash := owner.Identity.ChannelID().String()
+	strangerHash := stranger.Identity.ChannelID().String()
+	_, postRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 1)))
+	_, forgedRaw := testPost(t, stranger.Identity,
+		syndieutil.PostURI(postURI(strangerHash, 1)),
+		syndieutil.TargetChannel(hash),
+	)
+	// Posts come first in the zip, so the policy only applies if metadata is imported first
+	bundle := writeBundle(t, []bundleFile{
+		{strangerHash + "/1" + messageExt, forgedRaw},
+		{hash + "/1" + messageExt, postRaw},
+		{hash + "/" + metaFile, metaRaw},
+	})
+	store := NewStore()
+	report, err := ImportBundle(bytes.NewReader(bundle), int64(len(bundle)), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 2 {
+		t.Errorf("imported %d messages, want the metadata and the owner's post", report.Imported)
+	}
+	if _, ok := report.Rejected[strangerHash+"/1"+messageExt]; !ok {
+		t.Error("post refused by the channel's policy was not reported as rejected")
+	}
+	if e, ok := store.Get(postURI(hash, 1)); !ok || e.Authorization != syndieutil.Authorized {
+		t.Error("post was not checked against its channel's metadata")
+	}
+}
+
+func TestImportBundleSkipsOtherFiles(t *testing.T) {
+	owner, _, metaRaw := testChannel(t, "skipping")
+	hash := owner.Identity.ChannelID().String()
+	oversized := make([]byte, DefaultMaxMessageSize+1)
+	bundle := writeBundle(t, []bundleFile{
+		{hash + "/" + metaFile, metaRaw},
+		{"README.txt", []byte("not a message")},
+		{hash + "/notes.txt", []byte("not a message")},
+		{"a/" + hash + "/1" + messageExt, metaRaw},
+		{hash + "/2" + messageExt, []byte("garbage")},
+		{hash + "/3" + messageExt, oversized},
+	})
+	store := NewStore()
+	report, err := ImportBundle(bytes.NewReader(bundle), int64(len(bundle)), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Imported != 1 {
+		t.Errorf("imported %d messages, want only the metadata", report.Imported)
+	}
+	if len(report.Rejected) != 2 || report.Rejected[hash+"/2"+messageExt] == nil || report.Rejected[hash+"/3"+messageExt] == nil {
+		t.Errorf("got rejections %v, want the garbage and the oversized message", report.Rejected)
+	}
+
+	if _, err := ImportBundle(bytes.NewReader([]byte("not a zip")), 9, store); err == nil {
+		t.Error("imported a file that is not a zip")
+	}
+}
+
+func TestFileArchiveSync(t *testing.T) {
+	remote, _, remoteMetaRaw := testChannel(t, "remote")
+	local, localMeta, localMetaRaw := testChannel(t, "local")
+	remoteHash := remote.Identity.ChannelID().String()
+	localHash := local.Identity.ChannelID().String()
+
+	dir := filepath.Join(t.TempDir(), "archive")
+	_, remotePost := testPost(t, remote.Identity, syndieutil.PostURI(postURI(remoteHash, 1)))
+	accepted, err := PushDir(dir, nil, remotePost, remoteMetaRaw, []byte("garbage"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accepted != 2 {
+		t.Fatalf("PushDir accepted %d messages, want 2", accepted)
+	}
+	if _, err := os.Stat(filepath.Join(dir, sharedIndex)); err != nil {
+		t.Fatalf("PushDir did not write %s: %s", sharedIndex, err)
+	}
+
+	ours := NewStore()
+	mustPut(t, ours, localMeta, localMetaRaw)
+	h, raw := testPost(t, local.Identity, syndieutil.PostURI(postURI(localHash, 1)))
+	mustPut(t, ours, h, raw)
+	s := NewSyndicator(ours)
+	s.Local = AuthoredBy(localHash)
+	url := "file://" + filepath.ToSlash(dir)
+	if err := s.AddPeer(url, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncPeer(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	if !ours.Has(postURI(remoteHash, 1)) {
+		t.Error("post was not pulled from the file archive")
+	}
+	theirs, err := OpenStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := theirs.Meta(localHash); !ok || !theirs.Has(postURI(localHash, 1)) {
+		t.Error("local messages were not pushed to the file archive")
+	}
+
+	// Pushing to a file archive that does not exist yet creates it
+	fresh := filepath.Join(t.TempDir(), "fresh")
+	url = "file://" + filepath.ToSlash(fresh)
+	if err := s.AddPeer(url, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncPeer(context.Background(), url); err != nil {
+		t.Fatal(err)
+	}
+	if created, err := OpenStore(fresh, nil); err != nil || !created.Has(postURI(localHash, 1)) {
+		t.Errorf("push did not create the file archive: %v", err)
+	}
+}
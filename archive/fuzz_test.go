@@ -0,0 +1,15 @@
+package archive
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzClientParse(f *testing.F) {
+	f.Add([]byte{})
+	f.Add(make([]byte, 15))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := NewClient()
+		c.Parse(bytes.NewReader(data))
+	})
+}
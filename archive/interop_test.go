@@ -0,0 +1,50 @@
+package archive
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestInteropJavaSyndie imports the Java Syndie data directory named by SYNDIE_JAVA_DATA, so
+// libsyndie can be checked against a real installation of the reference client.  Every message
+// must import and every shared-index.dat must parse:
+//
+//	SYNDIE_JAVA_DATA=$HOME/.syndie go test -run TestInteropJavaSyndie ./archive
+func TestInteropJavaSyndie(t *testing.T) {
+	dir := os.Getenv("SYNDIE_JAVA_DATA")
+	if dir == "" {
+		t.Skip("SYNDIE_JAVA_DATA is not set")
+	}
+	report, err := ImportJavaSyndie(dir, NewStore(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Imported) == 0 {
+		t.Fatalf("no messages imported from %s", dir)
+	}
+	for name, err := range report.Rejected {
+		t.Errorf("%s: %s", name, err)
+	}
+	for name, reason := range report.Unverified {
+		t.Logf("%s: %s", name, reason)
+	}
+	indexes := 0
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || d.Name() != sharedIndex {
+			return err
+		}
+		indexes++
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := NewClient().Parse(bytes.NewReader(raw)); err != nil {
+			t.Errorf("%s: %s", path, err)
+		}
+		return nil
+	})
+	t.Logf("imported %d messages and parsed %d shared indexes", len(report.Imported), indexes)
+}
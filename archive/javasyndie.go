@@ -0,0 +1,161 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+// Key files are tiny, so anything larger is not read while looking for them
+const maxKeyFileSize = 16 * 1024
+
+// JavaImportReport describes the outcome of ImportJavaSyndie.  Files are named relative to the
+// imported directory.
+type JavaImportReport struct {
+	// Imported lists the messages put into the store
+	Imported []string
+	// Keys counts the keys read from key files.  Read keys published in channel metadata are added
+	// to the keyring as well but not counted.
+	Keys int
+	// Undecryptable lists the messages no known key decrypts, such as posts to private channels,
+	// private replies and passphrase protected posts
+	Undecryptable []string
+	// Unverified holds why the signatures of a message could not be verified.  Metadata that is
+	// not signed by its own identity is left out of the store, while posts are still imported.
+	Unverified map[string]string
+	// Rejected holds why the remaining messages could not be imported
+	Rejected map[string]error
+}
+
+// ImportJavaSyndie imports the data directory of a Java Syndie installation, or any directory
+// holding .syndie files such as its archive/ directory.  Keys found in exported key files and
+// read keys in decrypted channel metadata are added to the keyring, which may be nil, and every message
+// that decodes is put into the store, channel metadata first.
+func ImportJavaSyndie(dir string, store *Store, keyring *crypto.Keyring) (*JavaImportReport, error) {
+	if keyring == nil {
+		keyring = crypto.NewKeyring()
+	}
+	report := &JavaImportReport{
+		Unverified: make(map[string]string),
+		Rejected:   make(map[string]error),
+	}
+	var messages []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasSuffix(d.Name(), messageExt) {
+			messages = append(messages, path)
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Size() <= maxKeyFileSize {
+			report.Keys += importKeyFile(path, keyring)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	type decoded struct {
+		name string
+		m    *syndieutil.DecodedMessage
+		raw  []byte
+	}
+	decoder := syndieutil.NewDecoder(syndieutil.ReadKeyResolver(keyring))
+	var metas, posts []decoded
+	for _, path := range messages {
+		name, _ := filepath.Rel(dir, path)
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			report.Rejected[name] = err
+			continue
+		}
+		m, err := decoder.Decode(bytes.NewReader(raw))
+		if err != nil {
+			// Posts may become readable once the read keys in the channel metadata are known
+			if errors.Is(err, syndieutil.ErrNoKey) {
+				posts = append(posts, decoded{name: name, raw: raw})
+				continue
+			}
+			report.Rejected[name] = err
+			continue
+		}
+		if m.Header().IsMeta() {
+			metas = append(metas, decoded{name: name, m: m, raw: raw})
+		} else {
+			posts = append(posts, decoded{name: name, m: m, raw: raw})
+		}
+	}
+
+	putMeta := func(m decoded) {
+		if err := store.Put(m.m, m.raw); err != nil {
+			if errors.Is(err, ErrUnverifiedMetadata) {
+				report.Unverified[m.name] = ErrUnverifiedMetadata.Error()
+			} else {
+				report.Rejected[m.name] = err
+			}
+			return
+		}
+		report.Imported = append(report.Imported, m.name)
+	}
+	for _, m := range metas {
+		putMeta(m)
+	}
+	for _, p := range posts {
+		if p.m == nil {
+			var err error
+			if p.m, err = decoder.Decode(bytes.NewReader(p.raw)); err != nil {
+				if errors.Is(err, syndieutil.ErrNoKey) || errors.Is(err, syndieutil.ErrBadHMAC) {
+					report.Undecryptable = append(report.Undecryptable, p.name)
+				} else {
+					report.Rejected[p.name] = err
+				}
+				continue
+			}
+			if p.m.Header().IsMeta() {
+				putMeta(p)
+				continue
+			}
+		}
+		if err := store.Put(p.m, p.raw); err != nil {
+			report.Rejected[p.name] = err
+			continue
+		}
+		report.Imported = append(report.Imported, p.name)
+		if e, ok := store.Get(p.m.Header().PostURI); ok && e.Authorization != syndieutil.Authorized {
+			report.Unverified[p.name] = "post is " + e.Authorization.String()
+		}
+	}
+	sort.Strings(report.Imported)
+	sort.Strings(report.Undecryptable)
+	return report, nil
+}
+
+// importKeyFile adds the key in a key file exported by Java Syndie to the keyring and returns the
+// number of keys added
+func importKeyFile(path string, keyring *crypto.Keyring) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	var key crypto.KeyFile
+	if err := key.Unmarshal(f); err != nil {
+		return 0
+	}
+	if err := keyring.Add(&key); err != nil {
+		return 0
+	}
+	return 1
+}
@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+// writeFixture writes files, named by their slash separated path, to dir
+func writeFixture(t *testing.T, dir string, files map[string][]byte) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func keyFile(t *testing.T, k *crypto.KeyFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := k.Marshal(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestImportJavaSyndie(t *testing.T) {
+	public, _, publicMetaRaw := testChannel(t, "public")
+	publicHash := public.Identity.ChannelID().String()
+	_, publicPost := testPost(t, public.Identity, syndieutil.PostURI(postURI(publicHash, 1)))
+	stranger, _, _ := testChannel(t, "stranger")
+	_, forgedPost := testPost(t, stranger.Identity,
+		syndieutil.PostURI(postURI(stranger.Identity.ChannelID().String(), 1)),
+		syndieutil.TargetChannel(publicHash),
+	)
+
+	// The private channel's metadata is readable with an exported read key and hands out the
+	// read key its posts are encrypted with
+	private := syndieutil.NewMetadata()
+	if err := private.New("private"); err != nil {
+		t.Fatal(err)
+	}
+	privateHash := private.Identity.ChannelID().String()
+	readerKey := crypto.NewSessionKey()
+	var privateMeta bytes.Buffer
+	if err := private.Marshal(&privateMeta, readerKey); err != nil {
+		t.Fatal(err)
+	}
+	body, err := syndieutil.NewPostBuilder(syndieutil.PostURI(postURI(privateHash, 1))).AddPage("text/plain", "", "private").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var privatePost bytes.Buffer
+	if err := syndieutil.New(syndieutil.MessageType("post"), syndieutil.TargetChannel(privateHash)).Marshal(&privatePost, body, private.CurrentReadKey(), private.Identity); err != nil {
+		t.Fatal(err)
+	}
+	var sealedPost bytes.Buffer
+	if err := syndieutil.New(syndieutil.MessageType("post"), syndieutil.TargetChannel(privateHash)).Marshal(&sealedPost, body, crypto.NewSessionKey(), private.Identity); err != nil {
+		t.Fatal(err)
+	}
+
+	unsigned, _, _ := testChannel(t, "unsigned")
+	unsignedHash := unsigned.Identity.ChannelID().String()
+	_, unsignedMeta := testPost(t, nil, syndieutil.MessageType("meta"), syndieutil.Identity(unsigned.Identity.String()))
+
+	manage, err := crypto.NewSigningKeyFile(crypto.ManageKey, publicHash, public.Identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	// Posts sort before meta.syndie, so the private post is only readable once its metadata is
+	writeFixture(t, dir, map[string][]byte{
+		"archive/" + publicHash + "/meta.syndie":   publicMetaRaw,
+		"archive/" + publicHash + "/1.syndie":      publicPost,
+		"archive/" + publicHash + "/2.syndie":      forgedPost,
+		"archive/" + privateHash + "/meta.syndie":  privateMeta.Bytes(),
+		"archive/" + privateHash + "/1.syndie":     privatePost.Bytes(),
+		"archive/" + privateHash + "/2.syndie":     sealedPost.Bytes(),
+		"archive/" + unsignedHash + "/meta.syndie": unsignedMeta,
+		"archive/garbage.syndie":                   []byte("not a message"),
+		"keys/public-manage.key":                   keyFile(t, manage),
+		"keys/private-read.key":                    keyFile(t, crypto.NewReadKeyFile(privateHash, readerKey)),
+		"keys/notes.txt":                           []byte("not a key"),
+		"syndie.config":                            []byte("db.url=jdbc:hsqldb:file:db/syndie\n"),
+	})
+
+	store := NewStore()
+	keyring := crypto.NewKeyring()
+	report, err := ImportJavaSyndie(dir, store, keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := func(channel, file string) string {
+		return filepath.Join("archive", channel, file)
+	}
+	want := &JavaImportReport{
+		Imported: []string{
+			name(privateHash, "1.syndie"),
+			name(privateHash, "meta.syndie"),
+			name(publicHash, "1.syndie"),
+			name(publicHash, "meta.syndie"),
+		},
+		Keys:          2,
+		Undecryptable: []string{name(privateHash, "2.syndie")},
+		Unverified:    map[string]string{name(unsignedHash, "meta.syndie"): ErrUnverifiedMetadata.Error()},
+	}
+	sort.Strings(want.Imported)
+	if !reflect.DeepEqual(report.Imported, want.Imported) {
+		t.Errorf("imported %v, want %v", report.Imported, want.Imported)
+	}
+	if report.Keys != want.Keys {
+		t.Errorf("read %d keys, want %d", report.Keys, want.Keys)
+	}
+	if !reflect.DeepEqual(report.Undecryptable, want.Undecryptable) {
+		t.Errorf("undecryptable %v, want %v", report.Undecryptable, want.Undecryptable)
+	}
+	if !reflect.DeepEqual(report.Unverified, want.Unverified) {
+		t.Errorf("unverified %v, want %v", report.Unverified, want.Unverified)
+	}
+	if len(report.Rejected) != 2 {
+		t.Errorf("rejected %v, want the forged post and the garbage", report.Rejected)
+	}
+	if err := report.Rejected[name(publicHash, "2.syndie")]; err == nil || !strings.Contains(err.Error(), "unauthorized") {
+		t.Errorf("forged post: got %v, want it rejected by the posting policy", err)
+	}
+	if report.Rejected[filepath.Join("archive", "garbage.syndie")] == nil {
+		t.Error("garbage was not rejected")
+	}
+
+	if _, ok := store.Meta(unsignedHash); ok {
+		t.Error("unsigned metadata was stored")
+	}
+	if e, ok := store.Get(postURI(privateHash, 1)); !ok || e.Authorization != syndieutil.Authorized {
+		t.Error("private post was not imported once its channel's read key was known")
+	}
+	if keys := keyring.ReadKeys(privateHash); len(keys) != 2 {
+		t.Errorf("keyring holds %d read keys for the private channel, want the exported and the published one", len(keys))
+	}
+}
@@ -0,0 +1,369 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	b32 "encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-i2p/go-i2p/lib/common/base32"
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+)
+
+// DefaultSAMAddr is where I2P routers listen for SAM clients by default
+const DefaultSAMAddr = "127.0.0.1:7656"
+
+const samVersion = "HELLO VERSION MIN=3.0 MAX=3.1"
+
+// Destinations are 387 bytes followed by the certificate, whose length is in the last two of them
+const destinationSize = 387
+
+// SAMSession is a SAM v3 streaming session with an I2P router.  It dials I2P destinations for
+// HTTP clients and accepts connections for servers listening on its own destination.
+type SAMSession struct {
+	samAddr string
+	id      string
+	keys    string
+	dest    string
+	control *samConn
+}
+
+// I2PAddr is the base64 destination of an I2P peer
+type I2PAddr string
+
+// Network returns "i2p"
+func (a I2PAddr) Network() string {
+	return "i2p"
+}
+
+func (a I2PAddr) String() string {
+	return string(a)
+}
+
+// Base32 returns the .b32.i2p hostname of the destination
+func (a I2PAddr) Base32() string {
+	dest, err := base64.I2PEncoding.DecodeString(string(a))
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(dest)
+	return base32.I2PEncoding.WithPadding(b32.NoPadding).EncodeToString(hash[:]) + ".b32.i2p"
+}
+
+// NewSAMSession opens a streaming session through the SAM bridge at samAddr.  keys are the
+// private keys of the destination to use, as returned by PrivateKeys, or "" for a new
+// transient destination.
+func NewSAMSession(ctx context.Context, samAddr string, keys string) (*SAMSession, error) {
+	if keys == "" {
+		keys = "TRANSIENT"
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	s := &SAMSession{samAddr: samAddr, id: "libsyndie-" + hex.EncodeToString(id)}
+	c, err := s.hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.command(ctx, "SESSION CREATE STYLE=STREAM ID="+s.id+" DESTINATION="+keys+" SIGNATURE_TYPE=7", "SESSION STATUS")
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	s.keys = reply["DESTINATION"]
+	s.dest, err = publicDestination(s.keys)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	s.control = c
+	return s, nil
+}
+
+// Addr returns the destination of the session
+func (s *SAMSession) Addr() I2PAddr {
+	return I2PAddr(s.dest)
+}
+
+// PrivateKeys returns the private keys of the session's destination so the same destination
+// can be used again later
+func (s *SAMSession) PrivateKeys() string {
+	return s.keys
+}
+
+// Close ends the session, which closes every connection made through it
+func (s *SAMSession) Close() error {
+	return s.control.Close()
+}
+
+// Lookup resolves a .i2p or .b32.i2p hostname to a destination
+func (s *SAMSession) Lookup(ctx context.Context, name string) (I2PAddr, error) {
+	c, err := s.hello(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	return c.lookup(ctx, name)
+}
+
+// Dial connects to an I2P destination, given either as a hostname or a base64 destination.
+// The port is ignored since SAM v3.1 streams have none.
+func (s *SAMSession) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	c, err := s.hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dest := host
+	if strings.HasSuffix(host, ".i2p") {
+		d, err := c.lookup(ctx, host)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		dest = string(d)
+	}
+	if _, err := c.command(ctx, "STREAM CONNECT ID="+s.id+" DESTINATION="+dest+" SILENT=false", "STREAM STATUS"); err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.remote = I2PAddr(dest)
+	c.local = I2PAddr(s.dest)
+	return c, nil
+}
+
+// HTTPClient returns an http.Client that makes every connection through the session
+func (s *SAMSession) HTTPClient() *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{DialContext: s.Dial},
+		Timeout:   5 * time.Minute,
+	}
+}
+
+// Listen returns a listener accepting the connections made to the session's destination, for
+// use with Server.Serve
+func (s *SAMSession) Listen() (net.Listener, error) {
+	return &samListener{session: s, closed: make(chan struct{})}, nil
+}
+
+func (s *SAMSession) hello(ctx context.Context) (*samConn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", s.samAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &samConn{Conn: conn, r: bufio.NewReader(conn)}
+	if _, err := c.command(ctx, samVersion, "HELLO REPLY"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+type samListener struct {
+	session *SAMSession
+	mu      sync.Mutex
+	pending *samConn
+	closed  chan struct{}
+}
+
+// Accept waits for the next connection to the session's destination
+func (l *samListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	ctx := context.Background()
+	c, err := l.session.hello(ctx)
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	l.pending = c
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.pending = nil
+		l.mu.Unlock()
+	}()
+	if _, err := c.command(ctx, "STREAM ACCEPT ID="+l.session.id+" SILENT=false", "STREAM STATUS"); err != nil {
+		c.Close()
+		return nil, l.closedErr(err)
+	}
+	// The bridge announces each connection with the destination it came from
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.Close()
+		return nil, l.closedErr(err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		c.Close()
+		return nil, errors.New("sam: empty peer destination")
+	}
+	c.remote = I2PAddr(fields[0])
+	c.local = I2PAddr(l.session.dest)
+	return c, nil
+}
+
+// Close stops accepting connections without closing the session
+func (l *samListener) Close() error {
+	select {
+	case <-l.closed:
+		return nil
+	default:
+		close(l.closed)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending != nil {
+		l.pending.Close()
+	}
+	return nil
+}
+
+func (l *samListener) Addr() net.Addr {
+	return I2PAddr(l.session.dest)
+}
+
+func (l *samListener) closedErr(err error) error {
+	select {
+	case <-l.closed:
+		return net.ErrClosed
+	default:
+		return err
+	}
+}
+
+// samConn is a connection to the SAM bridge.  Once a stream is set up, anything the bridge sent
+// after its reply is still buffered in r, so reads go through it.
+type samConn struct {
+	net.Conn
+	r      *bufio.Reader
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *samConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *samConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+func (c *samConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *samConn) lookup(ctx context.Context, name string) (I2PAddr, error) {
+	reply, err := c.command(ctx, "NAMING LOOKUP NAME="+name, "NAMING REPLY")
+	if err != nil {
+		return "", err
+	}
+	return I2PAddr(reply["VALUE"]), nil
+}
+
+// command sends a line to the bridge and reads its reply, which must start with want and have
+// RESULT=OK
+func (c *samConn) command(ctx context.Context, cmd string, want string) (map[string]string, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		c.SetDeadline(deadline)
+		defer c.SetDeadline(time.Time{})
+	}
+	if _, err := c.Conn.Write([]byte(cmd + "\n")); err != nil {
+		return nil, err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, want) {
+		return nil, fmt.Errorf("sam: unexpected reply %q to %s", line, strings.Fields(cmd)[0])
+	}
+	reply := parseSAMReply(line[len(want):])
+	if reply["RESULT"] != "OK" {
+		if msg := reply["MESSAGE"]; msg != "" {
+			return nil, fmt.Errorf("sam: %s: %s: %s", want, reply["RESULT"], msg)
+		}
+		return nil, fmt.Errorf("sam: %s: %s", want, reply["RESULT"])
+	}
+	return reply, nil
+}
+
+// parseSAMReply reads the KEY=value pairs of a reply, where values may be double quoted
+func parseSAMReply(s string) map[string]string {
+	reply := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return reply
+		}
+		eq := strings.IndexByte(s, '=')
+		sp := strings.IndexByte(s, ' ')
+		if eq < 0 || (sp >= 0 && sp < eq) {
+			// A key without a value
+			if sp < 0 {
+				reply[s] = ""
+				return reply
+			}
+			reply[s[:sp]] = ""
+			s = s[sp:]
+			continue
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:1+end], s[2+end:]
+			}
+		} else if sp := strings.IndexByte(s, ' '); sp >= 0 {
+			value, s = s[:sp], s[sp:]
+		} else {
+			value, s = s, ""
+		}
+		reply[key] = value
+	}
+}
+
+// publicDestination cuts the public destination from the front of a destination's private keys
+func publicDestination(keys string) (string, error) {
+	data, err := base64.I2PEncoding.DecodeString(keys)
+	if err != nil {
+		return "", errors.New("sam: invalid destination keys: " + err.Error())
+	}
+	if len(data) < destinationSize {
+		return "", errors.New("sam: destination keys too short")
+	}
+	size := destinationSize + int(binary.BigEndian.Uint16(data[destinationSize-2:destinationSize]))
+	if len(data) < size {
+		return "", errors.New("sam: destination keys too short")
+	}
+	return base64.I2PEncoding.EncodeToString(data[:size]), nil
+}
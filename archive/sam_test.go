@@ -0,0 +1,302 @@
+package archive
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+)
+
+// fakeSAM is a SAM v3 bridge that connects sessions to each other over loopback TCP, standing in
+// for an I2P router
+type fakeSAM struct {
+	l        net.Listener
+	mu       sync.Mutex
+	names    map[string]string
+	sessions map[string]string
+	accepts  map[string]chan *fakeStream
+}
+
+type fakeStream struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newFakeSAM(t *testing.T) *fakeSAM {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeSAM{
+		l:        l,
+		names:    make(map[string]string),
+		sessions: make(map[string]string),
+		accepts:  make(map[string]chan *fakeStream),
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return f
+}
+
+func (f *fakeSAM) addName(name, dest string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.names[name] = dest
+}
+
+func (f *fakeSAM) addr() string {
+	return f.l.Addr().String()
+}
+
+func (f *fakeSAM) serve(conn net.Conn) {
+	s := &fakeStream{conn: conn, r: bufio.NewReader(conn)}
+	for {
+		line, err := s.r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return
+		}
+		fields := strings.Fields(line)
+		args := parseSAMReply(strings.Join(fields[2:], " "))
+		switch strings.Join(fields[:2], " ") {
+		case "HELLO VERSION":
+			io.WriteString(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+		case "SESSION CREATE":
+			keys := args["DESTINATION"]
+			if keys == "TRANSIENT" {
+				keys = fakeKeys()
+			}
+			dest, _ := publicDestination(keys)
+			f.mu.Lock()
+			f.sessions[args["ID"]] = dest
+			f.accepts[args["ID"]] = make(chan *fakeStream, 16)
+			f.mu.Unlock()
+			io.WriteString(conn, "SESSION STATUS RESULT=OK DESTINATION="+keys+"\n")
+		case "NAMING LOOKUP":
+			f.mu.Lock()
+			dest, ok := f.names[args["NAME"]]
+			f.mu.Unlock()
+			if !ok {
+				io.WriteString(conn, "NAMING REPLY RESULT=KEY_NOT_FOUND NAME="+args["NAME"]+"\n")
+				continue
+			}
+			io.WriteString(conn, "NAMING REPLY RESULT=OK NAME="+args["NAME"]+" VALUE="+dest+"\n")
+		case "STREAM ACCEPT":
+			f.mu.Lock()
+			ch, ok := f.accepts[args["ID"]]
+			f.mu.Unlock()
+			if !ok {
+				io.WriteString(conn, "STREAM STATUS RESULT=INVALID_ID\n")
+				continue
+			}
+			io.WriteString(conn, "STREAM STATUS RESULT=OK\n")
+			ch <- s
+			return
+		case "STREAM CONNECT":
+			f.connect(s, args["ID"], args["DESTINATION"])
+			return
+		default:
+			io.WriteString(conn, fields[0]+" STATUS RESULT=I2P_ERROR MESSAGE=\"unknown command\"\n")
+		}
+	}
+}
+
+// connect hands a connecting stream to a pending STREAM ACCEPT of the destination's session
+func (f *fakeSAM) connect(s *fakeStream, id, dest string) {
+	f.mu.Lock()
+	from := f.sessions[id]
+	var ch chan *fakeStream
+	for sid, d := range f.sessions {
+		if d == dest {
+			ch = f.accepts[sid]
+		}
+	}
+	f.mu.Unlock()
+	if ch == nil {
+		io.WriteString(s.conn, "STREAM STATUS RESULT=CANT_REACH_PEER MESSAGE=\"no such destination\"\n")
+		s.conn.Close()
+		return
+	}
+	var peer *fakeStream
+	select {
+	case peer = <-ch:
+	case <-time.After(5 * time.Second):
+		io.WriteString(s.conn, "STREAM STATUS RESULT=TIMEOUT\n")
+		s.conn.Close()
+		return
+	}
+	io.WriteString(s.conn, "STREAM STATUS RESULT=OK\n")
+	io.WriteString(peer.conn, from+"\n")
+	go func() {
+		io.Copy(peer.conn, s.r)
+		peer.conn.Close()
+	}()
+	io.Copy(s.conn, peer.r)
+	s.conn.Close()
+}
+
+// fakeKeys makes destination keys with a 4 byte key certificate followed by some private key bytes
+func fakeKeys() string {
+	data := make([]byte, destinationSize+4+256+32)
+	rand.Read(data)
+	data[destinationSize-3] = 5
+	binary.BigEndian.PutUint16(data[destinationSize-2:destinationSize], 4)
+	return base64.I2PEncoding.EncodeToString(data)
+}
+
+func newTestSession(t *testing.T, f *fakeSAM, keys string) *SAMSession {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := NewSAMSession(ctx, f.addr(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSAMDialAndListen(t *testing.T) {
+	f := newFakeSAM(t)
+	server := newTestSession(t, f, "")
+	client := newTestSession(t, f, "")
+	f.addName("echo.i2p", string(server.Addr()))
+
+	l, err := server.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remote := make(chan net.Addr, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		remote <- conn.RemoteAddr()
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := client.Dial(ctx, "tcp", "echo.i2p:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "hello\n" {
+		t.Errorf("echo = %q, want %q", line, "hello\n")
+	}
+	if got := <-remote; got.String() != string(client.Addr()) {
+		t.Errorf("server saw %s, want the client destination", got)
+	}
+	if conn.RemoteAddr().String() != string(server.Addr()) {
+		t.Errorf("client RemoteAddr = %s, want the server destination", conn.RemoteAddr())
+	}
+}
+
+func TestSAMDialUnknownHost(t *testing.T) {
+	f := newFakeSAM(t)
+	client := newTestSession(t, f, "")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Dial(ctx, "tcp", "missing.i2p:80"); err == nil || !strings.Contains(err.Error(), "KEY_NOT_FOUND") {
+		t.Errorf("Dial of an unknown host = %v, want KEY_NOT_FOUND", err)
+	}
+}
+
+func TestSAMSessionKeys(t *testing.T) {
+	f := newFakeSAM(t)
+	keys := fakeKeys()
+	s := newTestSession(t, f, keys)
+	if s.PrivateKeys() != keys {
+		t.Errorf("PrivateKeys did not return the keys the session was created with")
+	}
+	dest, _ := base64.I2PEncoding.DecodeString(string(s.Addr()))
+	if len(dest) != destinationSize+4 {
+		t.Errorf("destination is %d bytes, want %d", len(dest), destinationSize+4)
+	}
+	b32 := s.Addr().Base32()
+	if len(b32) != 52+len(".b32.i2p") || !strings.HasSuffix(b32, ".b32.i2p") {
+		t.Errorf("Base32 = %q", b32)
+	}
+}
+
+func TestSAMListenerClose(t *testing.T) {
+	f := newFakeSAM(t)
+	s := newTestSession(t, f, "")
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	l.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Accept after Close = %v, want net.ErrClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Accept did not return after Close")
+	}
+}
+
+func TestSAMArchiveServer(t *testing.T) {
+	f := newFakeSAM(t)
+	serverSession := newTestSession(t, f, "")
+	clientSession := newTestSession(t, f, "")
+	f.addName("archive.i2p", string(serverSession.Addr()))
+
+	s := NewServer()
+	s.AltURIs = []string{"http://archive.i2p/"}
+	s.NumAltURIs = 1
+	l, err := serverSession.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := NewClient()
+	c.HTTPClient = clientSession.HTTPClient()
+	if err := c.Fetch(ctx, "http://archive.i2p/"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.AltURIs) != 1 || c.AltURIs[0] != "http://archive.i2p/" {
+		t.Errorf("AltURIs = %q", c.AltURIs)
+	}
+	if _, err := c.FetchMessage(ctx, "http://archive.i2p/", "missing/1.syndie"); err == nil {
+		t.Errorf("FetchMessage of a missing message succeeded")
+	}
+}
@@ -1,18 +1,91 @@
 package archive
 
 import (
+	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/internal/atomicfile"
+	"github.com/kpetku/libsyndie/syndieutil"
 )
 
 const sharedIndex string = "shared-index.dat"
 const importCgi string = "import.cgi"
 
+// Defaults used by NewServer
+const (
+	DefaultAddr           = ":6667"
+	DefaultMaxMessageSize = syndieutil.DefaultMaxZipTotalSize + 64*1024
+	DefaultMaxPushSize    = 8 * DefaultMaxMessageSize
+)
+
+// PushPolicy decides which messages pushed to import.cgi an archive server accepts
+type PushPolicy int
+
+const (
+	// PushNone refuses every push
+	PushNone PushPolicy = iota
+	// PushKnownChannels accepts metadata and posts only for channels already in the store
+	PushKnownChannels
+	// PushAll accepts every message that decodes and passes the posting policy of its channel
+	PushAll
+)
+
+func (p PushPolicy) String() string {
+	switch p {
+	case PushNone:
+		return "none"
+	case PushKnownChannels:
+		return "known"
+	case PushAll:
+		return "all"
+	}
+	return "unknown"
+}
+
+// ParsePushPolicy reads a PushPolicy from its String form
+func ParsePushPolicy(s string) (PushPolicy, error) {
+	for _, p := range []PushPolicy{PushNone, PushKnownChannels, PushAll} {
+		if s == p.String() {
+			return p, nil
+		}
+	}
+	return PushNone, errors.New("unknown push policy " + s)
+}
+
+// Server serves the messages in a Store over HTTP the way Syndie archives do: shared-index.dat,
+// <channel>/meta.syndie and <channel>/<messageID>.syndie, and accepts pushes to import.cgi
 type Server struct {
 	*Archive
-	srv *http.Server
+	Store *Store
+
+	// Addr is the TCP address ListenAndServe listens on
+	Addr string
+	// Push decides which pushed messages are accepted
+	Push PushPolicy
+	// MaxMessageSize limits the size of a single pushed message
+	MaxMessageSize int
+	// MaxPushSize limits the size of a whole push request
+	MaxPushSize int64
+	// AdminChannelHash is the channel advertised as the archive's admin channel, if any
+	AdminChannelHash string
+	// Logger receives a line for every request, it may be nil
+	Logger *log.Logger
+
+	srv   *http.Server
+	mu    sync.RWMutex
+	index []byte
 }
 
 type writer struct {
@@ -26,35 +99,360 @@ func (w *writer) write(data interface{}) {
 	}
 }
 
-func NewServer() *Server {
-	s := &Server{}
-	srv := &http.Server{
-		Addr:           ":6667",
-		Handler:        http.HandlerFunc(s.incomingHandler),
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+// NewServer creates a new Server and accepts a list of option functions.  Without options it
+// serves an empty in-memory Store on DefaultAddr and refuses pushes.
+func NewServer(opts ...func(*Server)) *Server {
+	s := &Server{
+		Archive:        &Archive{},
+		Store:          NewStore(),
+		Addr:           DefaultAddr,
+		MaxMessageSize: DefaultMaxMessageSize,
+		MaxPushSize:    DefaultMaxPushSize,
+	}
+
+	// call option functions on instance to set options on it
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.srv = &http.Server{
+		Addr:           s.Addr,
+		Handler:        s,
+		ReadTimeout:    2 * time.Minute,
+		WriteTimeout:   2 * time.Minute,
 		MaxHeaderBytes: 1 << 20,
 	}
-	s.srv = srv
-	s.srv.ListenAndServe()
-	return &Server{}
+	return s
+}
+
+// Addr is an optional function of Server
+func Addr(addr string) func(*Server) {
+	return func(s *Server) {
+		s.Addr = addr
+	}
+}
+
+// UseStore is an optional function of Server
+func UseStore(store *Store) func(*Server) {
+	return func(s *Server) {
+		s.Store = store
+	}
+}
+
+// Push is an optional function of Server
+func Push(push PushPolicy) func(*Server) {
+	return func(s *Server) {
+		s.Push = push
+	}
+}
+
+// MaxMessageSize is an optional function of Server
+func MaxMessageSize(size int) func(*Server) {
+	return func(s *Server) {
+		s.MaxMessageSize = size
+	}
+}
+
+// MaxPushSize is an optional function of Server
+func MaxPushSize(size int64) func(*Server) {
+	return func(s *Server) {
+		s.MaxPushSize = size
+	}
+}
+
+// AdminChannelHash is an optional function of Server
+func AdminChannelHash(channel string) func(*Server) {
+	return func(s *Server) {
+		s.AdminChannelHash = channel
+	}
+}
+
+// Logger is an optional function of Server
+func Logger(logger *log.Logger) func(*Server) {
+	return func(s *Server) {
+		s.Logger = logger
+	}
+}
+
+// ListenAndServe listens on Addr and serves requests until Shutdown is called
+func (s *Server) ListenAndServe() error {
+	return s.srv.ListenAndServe()
+}
+
+// Serve serves requests accepted from l until Shutdown is called
+func (s *Server) Serve(l net.Listener) error {
+	return s.srv.Serve(l)
+}
+
+// Shutdown stops accepting requests and waits for those in progress to finish or ctx to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// RebuildSharedIndex rebuilds the shared index from the Store and caches the shared-index.dat
+// served to clients.  A Store kept in a directory gets a copy of shared-index.dat as well.
+func (s *Server) RebuildSharedIndex() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.buildSharedIndex()
+	if err != nil {
+		return err
+	}
+	s.Archive = a
+	var buf bytes.Buffer
+	if err := s.Write(&buf); err != nil {
+		return err
+	}
+	s.index = buf.Bytes()
+	if s.Store != nil && s.Store.Dir() != "" {
+		// Keep the directory usable as a file:// archive too
+		return atomicfile.WriteFile(filepath.Join(s.Store.Dir(), sharedIndex), s.index)
+	}
+	return nil
+}
+
+// RebuildSharedIndexEvery calls RebuildSharedIndex at every interval until ctx is done
+func (s *Server) RebuildSharedIndexEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.RebuildSharedIndex(); err != nil {
+				s.logf("error rebuilding %s: %s", sharedIndex, err)
+			}
+		}
+	}
+}
+
+// BuildSharedIndex rebuilds the shared index from the messages in the Store.  Cancelled,
+// overwritten and expired messages are left out so they are no longer advertised.
+func (s *Server) BuildSharedIndex() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a, err := s.buildSharedIndex()
+	if err != nil {
+		return err
+	}
+	s.Archive = a
+	return nil
+}
+
+// buildSharedIndex returns the shared index of the messages in the Store.  The caller holds s.mu.
+func (s *Server) buildSharedIndex() (*Archive, error) {
+	if s.Store == nil {
+		return nil, errors.New(invalidArchiveServer + ": no store")
+	}
+	var header Header
+	if s.Archive != nil {
+		header = s.Archive.Header
+	}
+	return indexEntries(header, s.Store.Channels(), s.Store.Messages(), s.AdminChannelHash), nil
+}
+
+// indexEntries builds a shared index with the given header listing the channels of metas and
+// the messages of posts.  Expired messages are left out so they are no longer advertised.
+func indexEntries(header Header, metas []*Entry, posts []*Entry, adminChannel string) *Archive {
+	a := &Archive{Header: header}
+	editions := make(map[crypto.ChannelID]int)
+	for _, meta := range metas {
+		editions[meta.channel] = meta.Header.Edition
+	}
+	channels := make(map[crypto.ChannelID]uint32)
+	channel := func(id crypto.ChannelID) uint32 {
+		if i, ok := channels[id]; ok {
+			return i
+		}
+		ch := ChannelHash{ChannelHash: id, ChannelEdition: uint64(editions[id])}
+		i := uint32(len(a.ChannelHashes))
+		channels[id] = i
+		a.ChannelHashes = append(a.ChannelHashes, ch)
+		return i
+	}
+	now := time.Now()
+	for _, meta := range metas {
+		if meta.Header.IsExpired(now) {
+			continue
+		}
+		channel(meta.channel)
+	}
+	if adminChannel != "" {
+		if id, err := crypto.ParseChannelID(adminChannel); err == nil {
+			a.AdminChannel = channel(id)
+		}
+	}
+	for _, e := range posts {
+		if e.Header.IsExpired(now) {
+			continue
+		}
+		scope := channel(e.channel)
+		target := scope
+		if id, ok := e.Header.TargetChannelID(); ok {
+			target = channel(id)
+		}
+		a.Messages = append(a.Messages, Message{
+			MessageID:     uint64(e.Header.PostURI.MessageID),
+			ScopeChannel:  scope,
+			TargetChannel: target,
+		})
+	}
+	a.NumChannels = uint32(len(a.ChannelHashes))
+	a.NumMessages = uint32(len(a.Messages))
+	return a
 }
 
-func (s Server) BuildSharedIndex() {
+// ServeHTTP logs and answers a single request
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	lw := &loggingWriter{ResponseWriter: w, status: http.StatusOK}
+	s.handle(lw, req)
+	s.logf("%s %s %s %d %d %s", req.RemoteAddr, req.Method, req.URL.Path, lw.status, lw.written, time.Since(start).Round(time.Millisecond))
 }
 
-func (s Server) incomingHandler(w http.ResponseWriter, req *http.Request) {
-	if req.URL.Path == "/"+sharedIndex {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		io.WriteString(w, "Pulling from this archive server is unimplemented!\n")
+func (s *Server) handle(w http.ResponseWriter, req *http.Request) {
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if path == importCgi {
+		if req.Method != http.MethodPost {
+			http.Error(w, "push with POST", http.StatusMethodNotAllowed)
+			return
+		}
+		s.importHandler(w, req)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if path == sharedIndex {
+		s.mu.RLock()
+		index := s.index
+		s.mu.RUnlock()
+		if index == nil {
+			if err := s.RebuildSharedIndex(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.mu.RLock()
+			index = s.index
+			s.mu.RUnlock()
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(index)
+		return
+	}
+	split := strings.Split(path, "/")
+	if len(split) != 2 || s.Store == nil {
+		http.NotFound(w, req)
+		return
+	}
+	channel, file := split[0], split[1]
+	var e *Entry
+	if file == metaFile {
+		e, _ = s.Store.Meta(channel)
+	} else if id, err := strconv.Atoi(strings.TrimSuffix(file, messageExt)); err == nil && strings.HasSuffix(file, messageExt) {
+		u := syndieutil.URI{Channel: channel, MessageID: id}
+		// Overwritten messages are no longer served; their replacement is only served under its own name
+		if found, ok := s.Store.Get(u); ok && found.Header.PostURI.MessageKey() == u.MessageKey() {
+			e = found
+		}
+	}
+	if e == nil {
+		http.NotFound(w, req)
 		return
 	}
-	if req.URL.Path == "/"+importCgi && req.Method == http.MethodPost {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		io.WriteString(w, "Pushing from this archive server is unimplemented!\n")
+	w.Header().Set("Content-Type", "application/x-syndie")
+	w.Write(e.Raw)
+}
+
+// importHandler accepts a push, which is a sequence of messages each preceded by its length as
+// a 32 bit big endian integer.  Every message is answered with a line saying whether it was
+// imported.
+func (s *Server) importHandler(w http.ResponseWriter, req *http.Request) {
+	if s.Push == PushNone || s.Store == nil {
+		http.Error(w, "this archive does not accept pushes", http.StatusForbidden)
 		return
 	}
-	w.WriteHeader(http.StatusNotFound)
+	body := http.MaxBytesReader(w, req.Body, s.MaxPushSize)
+	var results []string
+	var imported int
+	for {
+		var length uint32
+		if err := binary.Read(body, binary.BigEndian, &length); err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, "error reading push: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if int64(length) > int64(s.MaxMessageSize) {
+			http.Error(w, "message of "+strconv.FormatUint(uint64(length), 10)+" bytes exceeds the limit of "+strconv.Itoa(s.MaxMessageSize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		raw := make([]byte, length)
+		if _, err := io.ReadFull(body, raw); err != nil {
+			http.Error(w, "error reading push: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.accept(raw); err != nil {
+			results = append(results, "rejected: "+err.Error())
+			continue
+		}
+		imported++
+		results = append(results, "ok")
+	}
+	if imported > 0 {
+		if err := s.RebuildSharedIndex(); err != nil {
+			s.logf("error rebuilding %s: %s", sharedIndex, err)
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, r := range results {
+		io.WriteString(w, r+"\n")
+	}
+}
+
+// accept decodes a pushed message and puts it into the Store if the push policy allows it
+func (s *Server) accept(raw []byte) error {
+	m, err := s.Store.decode(raw)
+	if err != nil {
+		return err
+	}
+	h := m.Header()
+	if s.Push == PushKnownChannels {
+		channel, ok := h.TargetChannelID()
+		if h.IsMeta() {
+			channel, ok = h.ChannelID()
+		}
+		if _, known := s.Store.ChannelMeta(channel); !ok || !known {
+			return errors.New("unknown channel " + h.TargetChannelHash())
+		}
+	}
+	return s.Store.Put(m, raw)
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// loggingWriter records the status and size of a response for the request log
+type loggingWriter struct {
+	http.ResponseWriter
+	status  int
+	written int
+}
+
+func (w *loggingWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += n
+	return n, err
 }
 
 func (s *Server) Write(output io.Writer) error {
@@ -71,11 +469,9 @@ func (s *Server) Write(output io.Writer) error {
 
 	// Populate AltURIs with other known archive servers
 	for i := 0; i < int(s.NumAltURIs); i++ {
-		// TODO: why do we write the length here and not below?
-		var length uint16
+		length := uint16(len(s.AltURIs[i]))
 		w.write(&length)
-		//		uri := make([]byte, int(length))
-		w.write(s.AltURIs[i])
+		w.write([]byte(s.AltURIs[i]))
 	}
 
 	// Count the number of channels
@@ -0,0 +1,252 @@
+package archive
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+// fetchBody gets url and fails the test if the request cannot be made
+func fetchBody(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+	status, body, err := get(t, http.DefaultClient, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status, []byte(body)
+}
+
+// push sends messages to import.cgi and returns the status and the result lines
+func push(t *testing.T, url string, messages ...[]byte) (int, []string) {
+	t.Helper()
+	var body bytes.Buffer
+	if err := WritePush(&body, messages...); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Post(url+"/"+importCgi, "application/octet-stream", &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	out, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, strings.Split(strings.TrimSpace(string(out)), "\n")
+}
+
+// indexedMessages fetches shared-index.dat and returns the IDs of the messages it lists
+func indexedMessages(t *testing.T, url string) map[int]bool {
+	t.Helper()
+	status, body := fetchBody(t, url+"/"+sharedIndex)
+	if status != http.StatusOK {
+		t.Fatalf("%s: status %d", sharedIndex, status)
+	}
+	c := NewClient()
+	if err := c.Parse(bytes.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[int]bool)
+	for _, m := range c.Messages {
+		ids[int(m.MessageID)] = true
+	}
+	return ids
+}
+
+func TestServerServesMessages(t *testing.T) {
+	owner, meta, metaRaw := testChannel(t, "served")
+	hash := owner.Identity.ChannelID().String()
+	store := NewStore()
+	mustPut(t, store, meta, metaRaw)
+	_, keptRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 1)))
+	original, originalRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 2)))
+	mustPut(t, store, original, originalRaw)
+	replacement, replacementRaw := testPost(t, owner.Identity,
+		syndieutil.PostURI(postURI(hash, 3)),
+		syndieutil.OverwriteURI(postURI(hash, 2)),
+	)
+	mustPut(t, store, replacement, replacementRaw)
+	if _, err := store.Import(keptRaw); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(NewServer(UseStore(store)))
+	defer ts.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		want   []byte
+	}{
+		{hash + "/" + metaFile, http.StatusOK, metaRaw},
+		{hash + "/1" + messageExt, http.StatusOK, keptRaw},
+		{hash + "/2" + messageExt, http.StatusNotFound, nil},
+		{hash + "/3" + messageExt, http.StatusOK, replacementRaw},
+		{hash + "/4" + messageExt, http.StatusNotFound, nil},
+		{hash + "/1", http.StatusNotFound, nil},
+		{"unknown/" + metaFile, http.StatusNotFound, nil},
+		{hash + "/1" + messageExt + "/extra", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		status, body := fetchBody(t, ts.URL+"/"+tt.path)
+		if status != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.path, status, tt.status)
+		}
+		if tt.want != nil && !bytes.Equal(body, tt.want) {
+			t.Errorf("%s: served the wrong message", tt.path)
+		}
+	}
+	if ids := indexedMessages(t, ts.URL); len(ids) != 2 || !ids[1] || !ids[3] {
+		t.Errorf("index lists messages %v, want 1 and 3", ids)
+	}
+}
+
+func TestServerSharedIndexCache(t *testing.T) {
+	owner, meta, metaRaw := testChannel(t, "cached")
+	hash := owner.Identity.ChannelID().String()
+	store := NewStore()
+	mustPut(t, store, meta, metaRaw)
+	s := NewServer(UseStore(store))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	if ids := indexedMessages(t, ts.URL); len(ids) != 0 {
+		t.Fatalf("empty channel lists messages %v", ids)
+	}
+
+	post, postRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 1)))
+	mustPut(t, store, post, postRaw)
+	if ids := indexedMessages(t, ts.URL); len(ids) != 0 {
+		t.Fatalf("index was rebuilt without RebuildSharedIndex: %v", ids)
+	}
+	if err := s.RebuildSharedIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if ids := indexedMessages(t, ts.URL); !ids[1] {
+		t.Fatal("rebuilt index does not list the new message")
+	}
+
+	// A push rebuilds the index itself
+	s.Push = PushAll
+	_, pushedRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 2)))
+	if status, results := push(t, ts.URL, pushedRaw); status != http.StatusOK || results[0] != "ok" {
+		t.Fatalf("push: %d %v", status, results)
+	}
+	if ids := indexedMessages(t, ts.URL); !ids[2] {
+		t.Fatal("index was not rebuilt after a push")
+	}
+}
+
+func TestServerBuildSharedIndexWhileServing(t *testing.T) {
+	owner, meta, metaRaw := testChannel(t, "busy")
+	hash := owner.Identity.ChannelID().String()
+	store := NewStore()
+	mustPut(t, store, meta, metaRaw)
+	s := NewServer(UseStore(store), Push(PushAll))
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := s.BuildSharedIndex(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	for id := 1; id <= 5; id++ {
+		_, raw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, id)))
+		if status, results := push(t, ts.URL, raw); status != http.StatusOK || results[0] != "ok" {
+			t.Fatalf("push: %d %v", status, results)
+		}
+	}
+	<-done
+	if ids := indexedMessages(t, ts.URL); len(ids) != 5 {
+		t.Errorf("index lists messages %v, want 1 to 5", ids)
+	}
+}
+
+func TestServerPushPolicy(t *testing.T) {
+	known, knownMeta, knownMetaRaw := testChannel(t, "known")
+	unknown, _, unknownMetaRaw := testChannel(t, "unknown")
+	knownHash := known.Identity.ChannelID().String()
+	unknownHash := unknown.Identity.ChannelID().String()
+	_, knownPost := testPost(t, known.Identity, syndieutil.PostURI(postURI(knownHash, 1)))
+	_, unknownPost := testPost(t, unknown.Identity, syndieutil.PostURI(postURI(unknownHash, 1)))
+	stranger, _, _ := testChannel(t, "stranger")
+	_, forgedPost := testPost(t, stranger.Identity,
+		syndieutil.PostURI(postURI(stranger.Identity.ChannelID().String(), 1)),
+		syndieutil.TargetChannel(knownHash),
+	)
+
+	tests := []struct {
+		name     string
+		policy   PushPolicy
+		messages [][]byte
+		status   int
+		want     []string
+	}{
+		{"none", PushNone, [][]byte{knownPost}, http.StatusForbidden, nil},
+		{"known", PushKnownChannels, [][]byte{knownPost, unknownMetaRaw, unknownPost}, http.StatusOK, []string{"ok", "rejected", "rejected"}},
+		{"all", PushAll, [][]byte{knownPost, unknownMetaRaw, unknownPost}, http.StatusOK, []string{"ok", "ok", "ok"}},
+		{"posting policy", PushAll, [][]byte{forgedPost}, http.StatusOK, []string{"rejected"}},
+		{"garbage", PushAll, [][]byte{[]byte("not a message")}, http.StatusOK, []string{"rejected"}},
+	}
+	for _, tt := range tests {
+		store := NewStore()
+		mustPut(t, store, knownMeta, knownMetaRaw)
+		ts := httptest.NewServer(NewServer(UseStore(store), Push(tt.policy)))
+		status, results := push(t, ts.URL, tt.messages...)
+		ts.Close()
+		if status != tt.status {
+			t.Errorf("%s: got status %d, want %d", tt.name, status, tt.status)
+			continue
+		}
+		if tt.want == nil {
+			if len(store.Messages()) != 0 {
+				t.Errorf("%s: refused push was stored", tt.name)
+			}
+			continue
+		}
+		if len(results) != len(tt.want) {
+			t.Errorf("%s: got results %v, want %v", tt.name, results, tt.want)
+			continue
+		}
+		for i, r := range results {
+			if !strings.HasPrefix(r, tt.want[i]) {
+				t.Errorf("%s: message %d: got %q, want %s", tt.name, i, r, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestServerPushLimits(t *testing.T) {
+	owner, meta, metaRaw := testChannel(t, "limits")
+	hash := owner.Identity.ChannelID().String()
+	_, postRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 1)))
+
+	store := NewStore()
+	mustPut(t, store, meta, metaRaw)
+	ts := httptest.NewServer(NewServer(UseStore(store), Push(PushAll), MaxMessageSize(len(postRaw)-1)))
+	defer ts.Close()
+	if status, _ := push(t, ts.URL, postRaw); status != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized message: got status %d", status)
+	}
+
+	ts2 := httptest.NewServer(NewServer(UseStore(store), Push(PushAll), MaxPushSize(int64(len(postRaw)))))
+	defer ts2.Close()
+	if status, _ := push(t, ts2.URL, postRaw); status != http.StatusBadRequest {
+		t.Errorf("oversized push: got status %d", status)
+	}
+	if store.Has(postURI(hash, 1)) {
+		t.Error("message from a refused push was stored")
+	}
+
+	if status, _ := fetchBody(t, ts.URL+"/"+importCgi); status != http.StatusMethodNotAllowed {
+		t.Errorf("GET %s: got status %d", importCgi, status)
+	}
+}
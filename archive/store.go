@@ -0,0 +1,399 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+// ErrUnverifiedMetadata is returned by Store.Put for the first metadata of a channel when it is not
+// signed by the channel's own identity
+var ErrUnverifiedMetadata = errors.New("metadata is not signed by its identity")
+
+// Entry is a message held by a Store
+type Entry struct {
+	Header        *syndieutil.Header
+	Raw           []byte
+	Authorization syndieutil.Authorization
+	Cancelled     bool
+	ReplacedBy    *Entry
+	channel       crypto.ChannelID
+	sigs          syndieutil.Signatures
+}
+
+// Store holds the messages and channel metadata known to an archive and applies
+// the Cancel and OverwriteURI headers of the messages put into it
+type Store struct {
+	// Keyring holds the read keys Import uses to decode posts to private channels
+	Keyring *crypto.Keyring
+	// Logger, if set, receives a line whenever PurgeExpiredEvery removes messages
+	Logger *log.Logger
+
+	dir        string
+	mu         sync.RWMutex
+	entries    map[string]*Entry
+	meta       map[crypto.ChannelID]*Entry
+	cancels    map[string][]*Entry
+	overwrites map[string][]*Entry
+}
+
+// NewStore creates a new empty Store
+func NewStore() *Store {
+	return &Store{
+		entries:    make(map[string]*Entry),
+		meta:       make(map[crypto.ChannelID]*Entry),
+		cancels:    make(map[string][]*Entry),
+		overwrites: make(map[string][]*Entry),
+	}
+}
+
+// Put adds a decoded message along with its raw bytes to the store.  The first metadata of a
+// channel must be signed by the channel's identity, and later editions by its owner or one of
+// its managers.  Posts are checked
+// against the posting policy of their target channel, and those the policy rejects are
+// refused, or dropped later on if the channel metadata only arrives afterwards.  Any
+// cancel or overwrite a message carries is applied once the issuer is known to be
+// permitted to do so, and is held back until the target message arrives or until the
+// metadata showing the issuer may act on it does.
+func (s *Store) Put(m *syndieutil.DecodedMessage, raw []byte) error {
+	return s.put(m.Header(), m.Signatures(), raw)
+}
+
+func (s *Store) put(h *syndieutil.Header, sigs syndieutil.Signatures, raw []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if h.IsMeta() {
+		return s.putMeta(h, sigs, raw, false)
+	}
+	key := h.PostURI.MessageKey()
+	if key == "" {
+		return errors.New("invalid message: missing PostURI")
+	}
+	channel, ok := h.ChannelID()
+	if !ok {
+		return errors.New("invalid message: invalid channel hash " + h.PostURI.Channel)
+	}
+	if _, ok := s.entries[key]; ok {
+		return nil
+	}
+	var auth syndieutil.Authorization
+	if meta, ok := s.targetMeta(h); ok {
+		auth = syndieutil.Authorize(meta.Header, h, sigs)
+		if auth == syndieutil.Rejected {
+			return errors.New("unauthorized post in channel " + h.TargetChannelHash())
+		}
+	}
+	e := &Entry{Header: h, Raw: raw, Authorization: auth, channel: channel, sigs: sigs}
+	if err := s.save(e); err != nil {
+		return err
+	}
+	s.entries[key] = e
+
+	// Apply anything that arrived before the message it targets
+	s.applyPending(key)
+
+	for _, u := range h.Cancel {
+		target := u.MessageKey()
+		if target == "" || target == key {
+			continue
+		}
+		s.cancels[target] = append(s.cancels[target], e)
+		s.applyPending(target)
+	}
+	if target := h.OverwriteURI.MessageKey(); target != "" && target != key {
+		s.overwrites[target] = append(s.overwrites[target], e)
+		s.applyPending(target)
+	}
+	return nil
+}
+
+// putMeta adds channel metadata.  verified is set for metadata whose signature was already checked
+// against the editions before it, which need not be signed by the channel's identity.
+func (s *Store) putMeta(h *syndieutil.Header, sigs syndieutil.Signatures, raw []byte, verified bool) error {
+	channel, ok := h.ChannelID()
+	if !ok {
+		return errors.New("invalid metadata: missing identity")
+	}
+	if current, ok := s.meta[channel]; ok {
+		if current.Header.Edition >= h.Edition {
+			return nil
+		}
+		if syndieutil.Authorize(current.Header, h, sigs) == syndieutil.Rejected {
+			return errors.New("unauthorized metadata update for channel " + channel.String())
+		}
+	} else if !verified && !sigs.VerifyAuthorization(h.Identity) {
+		// Without an earlier edition only the channel's own identity can vouch for its metadata
+		return fmt.Errorf("%w for channel %s", ErrUnverifiedMetadata, channel.String())
+	}
+	e := &Entry{Header: h, Raw: raw, Authorization: syndieutil.Authorized, channel: channel, sigs: sigs}
+	if err := s.save(e); err != nil {
+		return err
+	}
+	s.meta[channel] = e
+
+	// Posts may have arrived before the metadata, or the new edition may change who can post
+	for key, e := range s.entries {
+		if target, ok := e.Header.TargetChannelID(); !ok || target != channel {
+			continue
+		}
+		e.Authorization = syndieutil.Authorize(h, e.Header, e.sigs)
+		if e.Authorization == syndieutil.Rejected {
+			delete(s.entries, key)
+			s.remove(e)
+		}
+	}
+	// The new edition may hold the keys that permit cancels and overwrites refused so far
+	var pending []string
+	for key := range s.cancels {
+		pending = append(pending, key)
+	}
+	for key := range s.overwrites {
+		pending = append(pending, key)
+	}
+	for _, key := range pending {
+		s.applyPending(key)
+	}
+	return nil
+}
+
+// Get returns the message a URI refers to, following any overwrites.  Cancelled
+// messages are not returned.
+func (s *Store) Get(u syndieutil.URI) (*Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.entries[u.MessageKey()]
+	if !ok {
+		return nil, false
+	}
+	for e.ReplacedBy != nil {
+		e = e.ReplacedBy
+	}
+	if e.Cancelled {
+		return nil, false
+	}
+	return e, true
+}
+
+// Has reports whether the store holds the message a URI refers to, even if it has since been
+// cancelled or overwritten
+func (s *Store) Has(u syndieutil.URI) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.entries[u.MessageKey()]
+	return ok
+}
+
+// Meta returns the current metadata message of a channel
+func (s *Store) Meta(channel string) (*Entry, bool) {
+	id, err := crypto.ParseChannelID(channel)
+	if err != nil {
+		return nil, false
+	}
+	return s.ChannelMeta(id)
+}
+
+// ChannelMeta returns the current metadata message of a channel
+func (s *Store) ChannelMeta(channel crypto.ChannelID) (*Entry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e, ok := s.meta[channel]
+	return e, ok
+}
+
+// targetMeta returns the metadata of the channel a message is addressed to.  The caller holds s.mu.
+func (s *Store) targetMeta(h *syndieutil.Header) (*Entry, bool) {
+	channel, ok := h.TargetChannelID()
+	if !ok {
+		return nil, false
+	}
+	e, ok := s.meta[channel]
+	return e, ok
+}
+
+// Channels returns the current metadata message of every known channel
+func (s *Store) Channels() []*Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Entry
+	for _, e := range s.meta {
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].channel.String() < out[j].channel.String()
+	})
+	return out
+}
+
+// Messages returns every message that has not been cancelled or overwritten
+func (s *Store) Messages() []*Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []*Entry
+	for _, e := range s.entries {
+		if e.Cancelled || e.ReplacedBy != nil {
+			continue
+		}
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].channel != out[j].channel {
+			return out[i].channel.String() < out[j].channel.String()
+		}
+		return out[i].Header.PostURI.MessageID < out[j].Header.PostURI.MessageID
+	})
+	return out
+}
+
+// PurgeExpired removes every message whose Expiration has passed as of now, along with the
+// messages those overwrote, and returns the number of messages removed
+func (s *Store) PurgeExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := make(map[*Entry]bool)
+	for _, e := range s.entries {
+		if e.Header.IsExpired(now) {
+			expired[e] = true
+		}
+	}
+	// Older versions of an expired message go with it rather than reappearing in its place
+	for _, e := range s.entries {
+		for r := e.ReplacedBy; r != nil; r = r.ReplacedBy {
+			if expired[r] {
+				expired[e] = true
+				break
+			}
+		}
+	}
+	var purged int
+	for key, e := range s.entries {
+		if expired[e] {
+			delete(s.entries, key)
+			s.remove(e)
+			purged++
+		}
+	}
+	for target, pending := range s.overwrites {
+		var kept []*Entry
+		for _, e := range pending {
+			if !expired[e] {
+				kept = append(kept, e)
+			}
+		}
+		if len(kept) == 0 {
+			delete(s.overwrites, target)
+		} else {
+			s.overwrites[target] = kept
+		}
+	}
+	for key, e := range s.meta {
+		if e.Header.IsExpired(now) {
+			delete(s.meta, key)
+			s.remove(e)
+			purged++
+		}
+	}
+	return purged
+}
+
+// PurgeExpiredEvery calls PurgeExpired at every interval until ctx is done
+func (s *Store) PurgeExpiredEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if n := s.PurgeExpired(now); n > 0 && s.Logger != nil {
+				s.Logger.Printf("purged %d expired messages", n)
+			}
+		}
+	}
+}
+
+// applyPending applies the cancels and overwrites waiting for the message stored under key.
+// Those whose issuer is not yet known to be permitted are kept to be checked again once more
+// metadata arrives, while those from issuers no longer in the store are dropped.
+func (s *Store) applyPending(key string) {
+	target, ok := s.entries[key]
+	if !ok {
+		return
+	}
+	var cancels, overwrites []*Entry
+	for _, issuer := range s.cancels[key] {
+		if s.stored(issuer) && !s.cancel(issuer, target) {
+			cancels = append(cancels, issuer)
+		}
+	}
+	for _, replacement := range s.overwrites[key] {
+		if s.stored(replacement) && !s.overwrite(replacement, target) {
+			overwrites = append(overwrites, replacement)
+		}
+	}
+	if len(cancels) == 0 {
+		delete(s.cancels, key)
+	} else {
+		s.cancels[key] = cancels
+	}
+	if len(overwrites) == 0 {
+		delete(s.overwrites, key)
+	} else {
+		s.overwrites[key] = overwrites
+	}
+}
+
+// stored reports whether e is still held by the store rather than rejected or purged
+func (s *Store) stored(e *Entry) bool {
+	return s.entries[e.Header.PostURI.MessageKey()] == e
+}
+
+// cancel cancels target if the issuer may, and reports whether it is done with the cancel
+func (s *Store) cancel(issuer *Entry, target *Entry) bool {
+	if target.Cancelled {
+		return true
+	}
+	if !s.mayModify(issuer, target) {
+		return false
+	}
+	target.Cancelled = true
+	return true
+}
+
+// overwrite replaces target if the issuer may, and reports whether it is done with the overwrite
+func (s *Store) overwrite(replacement *Entry, target *Entry) bool {
+	if target.ReplacedBy != nil {
+		return true
+	}
+	for r := replacement; r != nil; r = r.ReplacedBy {
+		if r == target {
+			return true
+		}
+	}
+	if !s.mayModify(replacement, target) {
+		return false
+	}
+	target.ReplacedBy = replacement
+	return true
+}
+
+func (s *Store) mayModify(issuer *Entry, target *Entry) bool {
+	var meta *syndieutil.Header
+	if m, ok := s.targetMeta(target.Header); ok {
+		meta = m.Header
+	}
+	// The metadata of the author's own channel holds the author's signing key
+	var authorKey string
+	if author, ok := target.Header.AuthorID(); ok {
+		if m, ok := s.meta[author]; ok {
+			authorKey = m.Header.Identity
+		}
+	}
+	return syndieutil.MayModify(issuer.sigs, target.Header, meta, authorKey)
+}
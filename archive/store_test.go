@@ -0,0 +1,307 @@
+package archive
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+// testChannel creates a channel and returns it along with its decoded metadata
+func testChannel(t *testing.T, name string) (*syndieutil.Metadata, *syndieutil.DecodedMessage, []byte) {
+	t.Helper()
+	m := syndieutil.NewMetadata()
+	if err := m.New(name); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := m.Marshal(&buf, ""); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := syndieutil.NewDecoder().Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, decoded, buf.Bytes()
+}
+
+// testPost encodes a post signed by signer, which may be nil, and returns it decoded
+func testPost(t *testing.T, signer *crypto.SigningKeypair, opts ...func(*syndieutil.Header)) (*syndieutil.DecodedMessage, []byte) {
+	t.Helper()
+	b := syndieutil.NewPostBuilder()
+	b.AddPage("text/plain", "", "hello")
+	body, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := crypto.NewSessionKey()
+	opts = append([]func(*syndieutil.Header){syndieutil.MessageType("post"), syndieutil.BodyKey(key)}, opts...)
+	var buf bytes.Buffer
+	if err := syndieutil.New(opts...).Marshal(&buf, body, key, signer); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := syndieutil.NewDecoder().Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded, buf.Bytes()
+}
+
+// testEdition encodes an edition of m's metadata listing managers and signed by signer, and
+// returns it decoded
+func testEdition(t *testing.T, m *syndieutil.Metadata, edition int, signer *crypto.SigningKeypair, managers ...*crypto.SigningKeypair) (*syndieutil.DecodedMessage, []byte) {
+	t.Helper()
+	h := m.Header()
+	h.Edition = edition
+	for _, manager := range managers {
+		h.ManagerKeys = append(h.ManagerKeys, manager.String())
+	}
+	body, err := syndieutil.NewPostBuilder().AddPage("text/plain", "", "").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := h.Marshal(&buf, body, h.BodyKey, signer); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := syndieutil.NewDecoder().Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded, buf.Bytes()
+}
+
+func postURI(channel string, id int) syndieutil.URI {
+	return syndieutil.URI{RefType: "channel", Channel: channel, MessageID: id}
+}
+
+func mustPut(t *testing.T, s *Store, m *syndieutil.DecodedMessage, raw []byte) {
+	t.Helper()
+	if err := s.Put(m, raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreCancel(t *testing.T) {
+	victim, victimMeta, victimRaw := testChannel(t, "victim")
+	attacker, attackerMeta, attackerRaw := testChannel(t, "attacker")
+	victimHash := victim.Identity.ChannelID().String()
+	attackerHash := attacker.Identity.ChannelID().String()
+	target := postURI(victimHash, 1)
+
+	for _, name := range []string{"cancel arriving after its target", "cancel arriving before its target"} {
+		s := NewStore()
+		mustPut(t, s, victimMeta, victimRaw)
+		mustPut(t, s, attackerMeta, attackerRaw)
+		post, postRaw := testPost(t, victim.Identity, syndieutil.PostURI(target))
+		forged, forgedRaw := testPost(t, attacker.Identity,
+			syndieutil.PostURI(postURI(attackerHash, 2)),
+			syndieutil.Author(victimHash),
+			syndieutil.Cancel([]syndieutil.URI{target}),
+		)
+		if name == "cancel arriving after its target" {
+			mustPut(t, s, post, postRaw)
+			mustPut(t, s, forged, forgedRaw)
+		} else {
+			mustPut(t, s, forged, forgedRaw)
+			mustPut(t, s, post, postRaw)
+		}
+		if _, ok := s.Get(target); !ok {
+			t.Fatalf("%s: forged cancel claiming to be from the author was applied", name)
+		}
+
+		genuine, genuineRaw := testPost(t, victim.Identity,
+			syndieutil.PostURI(postURI(victimHash, 3)),
+			syndieutil.Cancel([]syndieutil.URI{target}),
+		)
+		mustPut(t, s, genuine, genuineRaw)
+		if _, ok := s.Get(target); ok {
+			t.Fatalf("%s: cancel signed by the author was not applied", name)
+		}
+	}
+}
+
+func TestStoreOverwrite(t *testing.T) {
+	victim, victimMeta, victimRaw := testChannel(t, "victim")
+	attacker, attackerMeta, attackerRaw := testChannel(t, "attacker")
+	victimHash := victim.Identity.ChannelID().String()
+	attackerHash := attacker.Identity.ChannelID().String()
+	target := postURI(victimHash, 1)
+
+	s := NewStore()
+	mustPut(t, s, victimMeta, victimRaw)
+	mustPut(t, s, attackerMeta, attackerRaw)
+	post, postRaw := testPost(t, victim.Identity, syndieutil.PostURI(target))
+	mustPut(t, s, post, postRaw)
+
+	forged, forgedRaw := testPost(t, attacker.Identity,
+		syndieutil.PostURI(postURI(attackerHash, 2)),
+		syndieutil.Author(victimHash),
+		syndieutil.OverwriteURI(target),
+	)
+	mustPut(t, s, forged, forgedRaw)
+	if e, ok := s.Get(target); !ok || e.Header.PostURI.MessageID != 1 {
+		t.Fatal("forged overwrite claiming to be from the author was applied")
+	}
+
+	genuine, genuineRaw := testPost(t, victim.Identity,
+		syndieutil.PostURI(postURI(victimHash, 3)),
+		syndieutil.OverwriteURI(target),
+	)
+	mustPut(t, s, genuine, genuineRaw)
+	if e, ok := s.Get(target); !ok || e.Header.PostURI.MessageID != 3 {
+		t.Fatal("overwrite signed by the author was not applied")
+	}
+}
+
+func TestStoreModifyBeforeMetadata(t *testing.T) {
+	owner, meta, metaRaw := testChannel(t, "late")
+	attacker, _, _ := testChannel(t, "attacker")
+	hash := owner.Identity.ChannelID().String()
+	cancelled, overwritten := postURI(hash, 1), postURI(hash, 2)
+
+	s := NewStore()
+	for _, opts := range [][]func(*syndieutil.Header){
+		{syndieutil.PostURI(postURI(hash, 3)), syndieutil.Cancel([]syndieutil.URI{cancelled})},
+		{syndieutil.PostURI(cancelled)},
+		{syndieutil.PostURI(overwritten)},
+		{syndieutil.PostURI(postURI(hash, 4)), syndieutil.OverwriteURI(overwritten)},
+	} {
+		post, raw := testPost(t, owner.Identity, opts...)
+		mustPut(t, s, post, raw)
+	}
+	forged, forgedRaw := testPost(t, attacker.Identity,
+		syndieutil.PostURI(postURI(hash, 5)),
+		syndieutil.Cancel([]syndieutil.URI{postURI(hash, 4)}),
+	)
+	mustPut(t, s, forged, forgedRaw)
+	if _, ok := s.Get(cancelled); !ok {
+		t.Fatal("cancel was applied without knowing the channel's keys")
+	}
+	if e, ok := s.Get(overwritten); !ok || e.Header.PostURI.MessageID != 2 {
+		t.Fatal("overwrite was applied without knowing the channel's keys")
+	}
+
+	mustPut(t, s, meta, metaRaw)
+	if _, ok := s.Get(cancelled); ok {
+		t.Error("cancel signed by the owner was not applied once the metadata arrived")
+	}
+	if e, ok := s.Get(overwritten); !ok || e.Header.PostURI.MessageID != 4 {
+		t.Error("overwrite signed by the owner was not applied once the metadata arrived")
+	}
+	if _, ok := s.Get(postURI(hash, 4)); !ok {
+		t.Error("cancel by a stranger was applied once the metadata arrived")
+	}
+}
+
+func TestStorePurgeExpired(t *testing.T) {
+	owner, meta, metaRaw := testChannel(t, "expiring")
+	hash := owner.Identity.ChannelID().String()
+	expiration := time.Date(2024, time.March, 7, 0, 0, 0, 0, time.UTC)
+
+	s := NewStore()
+	mustPut(t, s, meta, metaRaw)
+	kept, keptRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 1)))
+	mustPut(t, s, kept, keptRaw)
+	original, originalRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 2)))
+	mustPut(t, s, original, originalRaw)
+	replacement, replacementRaw := testPost(t, owner.Identity,
+		syndieutil.PostURI(postURI(hash, 3)),
+		syndieutil.OverwriteURI(postURI(hash, 2)),
+		syndieutil.Expiration(expiration),
+	)
+	mustPut(t, s, replacement, replacementRaw)
+	pending, pendingRaw := testPost(t, owner.Identity,
+		syndieutil.PostURI(postURI(hash, 4)),
+		syndieutil.OverwriteURI(postURI(hash, 5)),
+		syndieutil.Expiration(expiration),
+	)
+	mustPut(t, s, pending, pendingRaw)
+
+	if n := s.PurgeExpired(expiration); n != 0 {
+		t.Fatalf("purged %d messages on their last valid day", n)
+	}
+	if n := s.PurgeExpired(expiration.AddDate(0, 0, 1)); n != 3 {
+		t.Fatalf("purged %d messages, want the two expired ones and the message one of them replaced", n)
+	}
+	if !s.Has(postURI(hash, 1)) {
+		t.Error("unexpired message was purged")
+	}
+	for id := 2; id <= 4; id++ {
+		if s.Has(postURI(hash, id)) {
+			t.Errorf("message %d is still held", id)
+		}
+	}
+
+	late, lateRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(hash, 5)))
+	mustPut(t, s, late, lateRaw)
+	if e, ok := s.Get(postURI(hash, 5)); !ok || e.ReplacedBy != nil {
+		t.Error("a purged overwrite was applied to a message arriving later")
+	}
+}
+
+func TestStoreRefusesForgedFirstMetadata(t *testing.T) {
+	owner, _, _ := testChannel(t, "owner")
+	attacker := crypto.NewSigningKeypair()
+	if err := attacker.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	forged, forgedRaw := testPost(t, attacker,
+		syndieutil.MessageType("meta"),
+		syndieutil.Identity(owner.Identity.String()),
+		syndieutil.ManagerKeys([]string{attacker.String()}),
+		syndieutil.Edition(5),
+	)
+	s := NewStore()
+	if err := s.Put(forged, forgedRaw); !errors.Is(err, ErrUnverifiedMetadata) {
+		t.Fatalf("got %v, want ErrUnverifiedMetadata", err)
+	}
+	if _, ok := s.Meta(owner.Identity.ChannelID().String()); ok {
+		t.Fatal("metadata signed by another key was stored as the channel's first edition")
+	}
+}
+
+func TestStoreMatchesChannelHashSpellings(t *testing.T) {
+	owner, meta, metaRaw := testChannel(t, "spelled")
+	hash := owner.Identity.ChannelID().String()
+	unpadded := strings.TrimSuffix(hash, "=")
+	if unpadded == hash {
+		t.Fatal("channel hash has no padding")
+	}
+
+	s := NewStore()
+	mustPut(t, s, meta, metaRaw)
+	if _, ok := s.Meta(unpadded); !ok {
+		t.Error("metadata is not found by the unpadded channel hash")
+	}
+	post, postRaw := testPost(t, owner.Identity, syndieutil.PostURI(postURI(unpadded, 1)))
+	mustPut(t, s, post, postRaw)
+	if e, ok := s.Get(postURI(hash, 1)); !ok || e.Authorization != syndieutil.Authorized {
+		t.Fatal("post with an unpadded PostURI was not checked against its channel's metadata")
+	}
+	if !s.Has(postURI(unpadded, 1)) {
+		t.Error("post is not found by its unpadded URI")
+	}
+
+	cancel, cancelRaw := testPost(t, owner.Identity,
+		syndieutil.PostURI(postURI(hash, 2)),
+		syndieutil.Cancel([]syndieutil.URI{postURI(unpadded, 1)}),
+	)
+	mustPut(t, s, cancel, cancelRaw)
+	if _, ok := s.Get(postURI(hash, 1)); ok {
+		t.Error("cancel naming the channel without padding was not applied")
+	}
+
+	stranger, _, _ := testChannel(t, "stranger")
+	_, forgedRaw := testPost(t, stranger.Identity,
+		syndieutil.PostURI(postURI(stranger.Identity.ChannelID().String(), 1)),
+		syndieutil.TargetChannel(unpadded),
+	)
+	if _, err := s.Import(forgedRaw); err == nil {
+		t.Error("post targeting the unpadded channel hash escaped the channel's policy")
+	}
+}
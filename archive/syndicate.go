@@ -0,0 +1,584 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+// Defaults used by NewSyndicator
+const (
+	DefaultSyncInterval    = 30 * time.Minute
+	DefaultMaxBackoff      = 24 * time.Hour
+	DefaultMaxIndexSize    = 16 * 1024 * 1024
+	DefaultMaxDiscovered   = 32
+	defaultSchedulerWakeup = time.Minute
+)
+
+// PeerStatus describes the syndication state of a single peer archive
+type PeerStatus struct {
+	URL string
+	// Push is set if locally authored messages are pushed to the peer
+	Push bool
+	// Discovered is set if the peer was found among another archive's AltURIs
+	Discovered  bool
+	LastAttempt time.Time
+	LastSuccess time.Time
+	NextAttempt time.Time
+	// Failures counts the attempts that failed since the last success
+	Failures  int
+	LastError string
+	// Pulled and Pushed count the messages exchanged with the peer since it was added
+	Pulled int
+	Pushed int
+}
+
+type peer struct {
+	PeerStatus
+	// failed remembers messages the peer offered that could not be imported so they are not fetched again
+	failed map[string]bool
+	// locked remembers messages that could not be decrypted along with how many read keys were
+	// known then, so they are fetched again once the keyring holds more
+	locked map[string]int
+}
+
+// Syndicator keeps a Store in sync with a set of peer archives.  Each peer is pulled from every
+// Interval, and after a failure the peer is retried with an exponential backoff of up to
+// MaxBackoff.  Messages for which Local returns true are pushed to the peers that accept pushes
+// whenever their shared index shows they are missing.
+type Syndicator struct {
+	Store *Store
+	// Client makes every request to the peers
+	Client   *http.Client
+	Interval time.Duration
+	// MaxBackoff bounds the wait before retrying a failing peer
+	MaxBackoff time.Duration
+	// Discover adds the AltURIs advertised by peers as pull-only peers, up to MaxDiscovered of
+	// them.  It is off unless set, and only archives reached the same way as the advertising
+	// peer, such as .i2p archives advertised by an .i2p peer, are added.
+	Discover      bool
+	MaxDiscovered int
+	// Local selects the locally authored messages that are pushed, nil pushes nothing
+	Local func(*Entry) bool
+	// MaxIndexSize and MaxMessageSize limit what is downloaded from a peer
+	MaxIndexSize   int64
+	MaxMessageSize int64
+	// DecodeWorkers is how many posts are decoded at once, one per CPU if it is not positive
+	DecodeWorkers int
+	// Logger receives a line for every sync, it may be nil
+	Logger *log.Logger
+
+	mu    sync.Mutex
+	peers map[string]*peer
+}
+
+// NewSyndicator creates a new Syndicator for a Store with no peers
+func NewSyndicator(store *Store) *Syndicator {
+	return &Syndicator{
+		Store:          store,
+		Client:         &http.Client{Timeout: 5 * time.Minute},
+		Interval:       DefaultSyncInterval,
+		MaxBackoff:     DefaultMaxBackoff,
+		MaxDiscovered:  DefaultMaxDiscovered,
+		MaxIndexSize:   DefaultMaxIndexSize,
+		MaxMessageSize: DefaultMaxMessageSize,
+		peers:          make(map[string]*peer),
+	}
+}
+
+// AuthoredBy returns a Local function selecting the metadata of the given channels and the
+// posts authored by or scoped to them
+func AuthoredBy(channels ...string) func(*Entry) bool {
+	set := make(map[crypto.ChannelID]bool)
+	for _, c := range channels {
+		if id, err := crypto.ParseChannelID(c); err == nil {
+			set[id] = true
+		}
+	}
+	return func(e *Entry) bool {
+		if e.Header.IsMeta() {
+			return set[e.channel]
+		}
+		author, ok := e.Header.AuthorID()
+		return (ok && set[author]) || set[e.channel]
+	}
+}
+
+// AddPeer adds a peer archive by the URL its shared-index.dat is served under, which may be a
+// file:// URL of a file archive.  Pushes are only made to peers added with push set.
+func (s *Syndicator) AddPeer(url string, push bool) error {
+	url, err := peerURL(url)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.peers[url]; ok {
+		p.Push = p.Push || push
+		p.Discovered = false
+		return nil
+	}
+	s.peers[url] = &peer{PeerStatus: PeerStatus{URL: url, Push: push}, failed: make(map[string]bool), locked: make(map[string]int)}
+	return nil
+}
+
+// RemovePeer stops syncing with a peer
+func (s *Syndicator) RemovePeer(url string) {
+	url, err := peerURL(url)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.peers, url)
+}
+
+// Status returns the state of every peer, sorted by URL
+func (s *Syndicator) Status() []PeerStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []PeerStatus
+	for _, p := range s.peers {
+		out = append(out, p.PeerStatus)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].URL < out[j].URL
+	})
+	return out
+}
+
+// Run syncs every peer as it becomes due until ctx is done
+func (s *Syndicator) Run(ctx context.Context) {
+	for {
+		s.SyncDue(ctx, time.Now())
+		wait := defaultSchedulerWakeup
+		s.mu.Lock()
+		for _, p := range s.peers {
+			if d := time.Until(p.NextAttempt); d < wait {
+				wait = d
+			}
+		}
+		s.mu.Unlock()
+		if wait < time.Second {
+			wait = time.Second
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// SyncDue syncs, one after another, every peer whose next attempt is due as of now
+func (s *Syndicator) SyncDue(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	var due []string
+	for url, p := range s.peers {
+		if !p.NextAttempt.After(now) {
+			due = append(due, url)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(due)
+	for _, url := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		s.SyncPeer(ctx, url)
+	}
+}
+
+// SyncPeer pulls the messages a peer has that the Store lacks and pushes it the local messages it
+// lacks, then schedules the next attempt.  It is safe to call at any time, regardless of schedule.
+func (s *Syndicator) SyncPeer(ctx context.Context, url string) error {
+	url, err := peerURL(url)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	p, ok := s.peers[url]
+	if !ok {
+		s.mu.Unlock()
+		return errors.New("unknown peer " + url)
+	}
+	p.LastAttempt = time.Now()
+	failed := make(map[string]bool)
+	for k := range p.failed {
+		failed[k] = true
+	}
+	locked := make(map[string]int)
+	for k, n := range p.locked {
+		locked[k] = n
+	}
+	push := p.Push
+	s.mu.Unlock()
+
+	pulled, pushed, alt, err := s.sync(ctx, url, push, failed, locked)
+
+	s.mu.Lock()
+	p.failed = failed
+	p.locked = locked
+	p.Pulled += pulled
+	p.Pushed += pushed
+	if err != nil {
+		p.Failures++
+		p.LastError = err.Error()
+		p.NextAttempt = time.Now().Add(s.backoff(p.Failures))
+	} else {
+		p.Failures = 0
+		p.LastError = ""
+		p.LastSuccess = time.Now()
+		p.NextAttempt = p.LastSuccess.Add(s.Interval)
+	}
+	if s.Discover {
+		s.discover(url, alt)
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.logf("sync with %s failed: %s", url, err)
+		return err
+	}
+	s.logf("synced with %s: pulled %d, pushed %d", url, pulled, pushed)
+	return nil
+}
+
+func (s *Syndicator) sync(ctx context.Context, url string, push bool, failed map[string]bool, locked map[string]int) (pulled int, pushed int, alt []string, err error) {
+	index := NewClient()
+	raw, err := fetch(ctx, s.Client, url+sharedIndex, s.MaxIndexSize)
+	switch {
+	case err == nil:
+		if err := index.Parse(bytes.NewReader(raw)); err != nil {
+			return 0, 0, nil, err
+		}
+	case strings.HasPrefix(url, "file:") && errors.Is(err, os.ErrNotExist):
+		// A file archive that does not exist yet is empty, and pushing creates it
+	default:
+		return 0, 0, nil, err
+	}
+	alt = index.AltURIs
+
+	// A message that cannot be fetched is tried again on the next sync, as is one that could
+	// not be decrypted once more read keys are known, while one refused by the Store is not
+	readKeys := s.readKeys()
+	skip := func(key string) bool {
+		n, ok := locked[key]
+		return failed[key] || (ok && n >= readKeys)
+	}
+	pull := func(key string) error {
+		if skip(key) {
+			return nil
+		}
+		raw, err := fetch(ctx, s.Client, url+key, s.MaxMessageSize)
+		if err != nil {
+			return ctx.Err()
+		}
+		_, err = s.Store.Import(raw)
+		switch {
+		case errors.Is(err, syndieutil.ErrNoKey):
+			locked[key] = readKeys
+		case err != nil:
+			failed[key] = true
+		default:
+			delete(locked, key)
+			pulled++
+		}
+		return nil
+	}
+
+	// Metadata comes first so new posts are checked against the latest channel policy
+	theirs := make(map[string]bool)
+	editions := make(map[crypto.ChannelID]uint64)
+	for _, ch := range index.ChannelHashes {
+		editions[ch.ChannelHash] = ch.ChannelEdition
+		key := ch.ChannelHash.String() + "/" + metaFile
+		if meta, ok := s.Store.ChannelMeta(ch.ChannelHash); ok && uint64(meta.Header.Edition) >= ch.ChannelEdition {
+			continue
+		}
+		if err := pull(key); err != nil {
+			return pulled, 0, alt, err
+		}
+	}
+	// Metadata may have handed out the read keys of private posts
+	readKeys = s.readKeys()
+	var missing []string
+	for _, m := range index.Messages {
+		hash := index.ChannelHashes[m.ScopeChannel].ChannelHash.String()
+		id := strconv.FormatUint(m.MessageID, 10)
+		theirs[hash+":"+id] = true
+		key := hash + "/" + id + messageExt
+		if m.MessageID > uint64(^uint(0)>>1) || skip(key) || s.Store.Has(syndieutil.URI{Channel: hash, MessageID: int(m.MessageID)}) {
+			continue
+		}
+		missing = append(missing, key)
+	}
+	n, err := s.pullPosts(ctx, url, missing, failed, locked, readKeys)
+	pulled += n
+	if err != nil {
+		return pulled, 0, alt, err
+	}
+
+	if !push || s.Local == nil {
+		return pulled, 0, alt, nil
+	}
+	var outgoing [][]byte
+	for _, e := range s.Store.Channels() {
+		if edition, ok := editions[e.channel]; ok && edition >= uint64(e.Header.Edition) {
+			continue
+		}
+		if s.Local(e) {
+			outgoing = append(outgoing, e.Raw)
+		}
+	}
+	for _, e := range s.Store.Messages() {
+		if theirs[e.Header.PostURI.MessageKey()] {
+			continue
+		}
+		if s.Local(e) {
+			outgoing = append(outgoing, e.Raw)
+		}
+	}
+	if len(outgoing) == 0 {
+		return pulled, 0, alt, nil
+	}
+	if strings.HasPrefix(url, "file:") {
+		dir, err := filePath(url)
+		if err != nil {
+			return pulled, 0, alt, err
+		}
+		pushed, err = PushDir(dir, s.Store.Keyring, outgoing...)
+		return pulled, pushed, alt, err
+	}
+	pushed, err = s.push(ctx, url+importCgi, outgoing)
+	return pulled, pushed, alt, err
+}
+
+// pullPosts fetches posts from a peer one at a time and decodes them in parallel, since checking
+// their signatures is what a large sync spends most of its time on.  Posts that fail to decode or
+// are refused by the Store are recorded in failed, except for those no read key decrypts, which
+// are recorded in locked along with the number of read keys known.
+func (s *Syndicator) pullPosts(ctx context.Context, url string, keys []string, failed map[string]bool, locked map[string]int, readKeys int) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	var opts []func(*syndieutil.Decoder)
+	if s.Store.Keyring != nil {
+		opts = append(opts, syndieutil.ReadKeyResolver(s.Store.Keyring))
+	}
+	d := syndieutil.NewDecoder(opts...)
+
+	// A post that cannot be fetched is sent as nil, keeping the results in step with keys, and
+	// is tried again on the next sync
+	in := make(chan []byte)
+	go func() {
+		defer close(in)
+		for _, key := range keys {
+			raw, err := fetch(ctx, s.Client, url+key, s.MaxMessageSize)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				raw = nil
+			}
+			select {
+			case in <- raw:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	out := make(chan syndieutil.DecodeResult)
+	done := make(chan int)
+	go func() {
+		var pulled int
+		for r := range out {
+			key := keys[r.Index]
+			switch {
+			case r.Raw == nil:
+			case errors.Is(r.Err, syndieutil.ErrNoKey):
+				locked[key] = readKeys
+			case r.Err != nil:
+				failed[key] = true
+			case s.Store.Put(r.Message, r.Raw) != nil:
+				failed[key] = true
+			default:
+				delete(locked, key)
+				pulled++
+			}
+		}
+		done <- pulled
+	}()
+	stats, err := d.DecodeStream(ctx, s.DecodeWorkers, in, out)
+	close(out)
+	pulled := <-done
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	s.logf("decoded %d posts from %s in %s (%.0f posts/s)", stats.Decoded+stats.Failed, url, stats.Elapsed, stats.MessagesPerSecond())
+	return pulled, err
+}
+
+// readKeys returns how many read keys the Store's Keyring holds, so messages that could not be
+// decrypted are only fetched again once it holds more
+func (s *Syndicator) readKeys() int {
+	if s.Store.Keyring == nil {
+		return 0
+	}
+	var n int
+	for _, channel := range s.Store.Keyring.Channels() {
+		n += len(s.Store.Keyring.ReadKeys(channel))
+	}
+	return n
+}
+
+// push sends messages to a peer's import.cgi and returns how many it accepted
+func (s *Syndicator) push(ctx context.Context, url string, messages [][]byte) (int, error) {
+	var body bytes.Buffer
+	if err := WritePush(&body, messages...); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("push to %s: %s", url, resp.Status)
+	}
+	var accepted int
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 1<<20))
+	for scanner.Scan() {
+		if scanner.Text() == "ok" {
+			accepted++
+		}
+	}
+	return accepted, scanner.Err()
+}
+
+// discover adds the archives advertised by the peer at from as pull-only peers.  The caller
+// holds s.mu.
+func (s *Syndicator) discover(from string, alt []string) {
+	var discovered int
+	for _, p := range s.peers {
+		if p.Discovered {
+			discovered++
+		}
+	}
+	class := routeClass(hostname(from))
+	for _, a := range alt {
+		if discovered >= s.MaxDiscovered {
+			return
+		}
+		url, err := peerURL(a)
+		// A remote archive must never point us at our own files or local network, nor make
+		// us reach an archive over another network than the one it was itself reached over
+		if err != nil || strings.HasPrefix(url, "file:") {
+			continue
+		}
+		host := hostname(url)
+		if host == "" || localHost(host) || routeClass(host) != class {
+			continue
+		}
+		if _, ok := s.peers[url]; ok {
+			continue
+		}
+		s.peers[url] = &peer{PeerStatus: PeerStatus{URL: url, Discovered: true}, failed: make(map[string]bool)}
+		discovered++
+	}
+}
+
+// hostname returns the host of an archive URL without its port, or "" if it has none
+func hostname(rawurl string) string {
+	u, err := neturl.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
+// localHost reports whether a host names this machine or an address of a private, loopback or
+// link-local network
+func localHost(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified()
+}
+
+// backoff doubles the interval for every consecutive failure, up to MaxBackoff
+func (s *Syndicator) backoff(failures int) time.Duration {
+	d := s.Interval
+	for i := 1; i < failures && d < s.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > s.MaxBackoff {
+		d = s.MaxBackoff
+	}
+	return d
+}
+
+func (s *Syndicator) logf(format string, v ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// WritePush writes messages in the format accepted by import.cgi, each preceded by its length
+// as a 32 bit big endian integer
+func WritePush(w io.Writer, messages ...[]byte) error {
+	for _, m := range messages {
+		if err := binary.Write(w, binary.BigEndian, uint32(len(m))); err != nil {
+			return err
+		}
+		if _, err := w.Write(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// peerURL normalizes the URL of a peer archive so that file names can be appended to it
+func peerURL(url string) (string, error) {
+	url = archiveURL(url)
+	if strings.HasPrefix(url, "file:") {
+		if _, err := filePath(url); err != nil {
+			return "", err
+		}
+		return url, nil
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return "", errors.New("unsupported archive URL " + url)
+	}
+	return url, nil
+}
@@ -0,0 +1,234 @@
+package archive
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+func TestSyndicatorBackoff(t *testing.T) {
+	s := NewSyndicator(NewStore())
+	s.Interval = time.Minute
+	s.MaxBackoff = 10 * time.Minute
+	for failures, want := range []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		if got := s.backoff(failures); got != want {
+			t.Errorf("%d failures: got %s, want %s", failures, got, want)
+		}
+	}
+
+	store := NewStore()
+	ts := httptest.NewServer(NewServer(UseStore(store)))
+	url := ts.URL + "/"
+	ts.Close()
+	if err := s.AddPeer(url, false); err != nil {
+		t.Fatal(err)
+	}
+	for failures := 1; failures <= 3; failures++ {
+		before := time.Now()
+		if err := s.SyncPeer(context.Background(), url); err == nil {
+			t.Fatal("sync with a closed server succeeded")
+		}
+		p := s.Status()[0]
+		if p.Failures != failures || p.LastError == "" {
+			t.Fatalf("got %d failures and error %q after %d failed syncs", p.Failures, p.LastError, failures)
+		}
+		if wait := p.NextAttempt.Sub(before); wait < s.backoff(failures) || wait > s.backoff(failures)+time.Minute {
+			t.Errorf("%d failures: next attempt in %s, want %s", failures, wait, s.backoff(failures))
+		}
+	}
+	if p := s.Status()[0]; !p.LastSuccess.IsZero() {
+		t.Error("failing peer has a last success")
+	}
+}
+
+func TestSyndicatorPullAndPush(t *testing.T) {
+	remote, remoteMeta, remoteMetaRaw := testChannel(t, "remote")
+	local, localMeta, localMetaRaw := testChannel(t, "local")
+	remoteHash := remote.Identity.ChannelID().String()
+	localHash := local.Identity.ChannelID().String()
+
+	theirs := NewStore()
+	mustPut(t, theirs, remoteMeta, remoteMetaRaw)
+	const posts = 20
+	for id := 1; id <= posts; id++ {
+		h, raw := testPost(t, remote.Identity, syndieutil.PostURI(postURI(remoteHash, id)))
+		mustPut(t, theirs, h, raw)
+	}
+	server := NewServer(UseStore(theirs), Push(PushAll))
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	ours := NewStore()
+	mustPut(t, ours, localMeta, localMetaRaw)
+	h, raw := testPost(t, local.Identity, syndieutil.PostURI(postURI(localHash, 1)))
+	mustPut(t, ours, h, raw)
+	s := NewSyndicator(ours)
+	s.DecodeWorkers = 4
+	s.Local = AuthoredBy(localHash)
+	if err := s.AddPeer(ts.URL, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncPeer(context.Background(), ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ours.Meta(remoteHash); !ok {
+		t.Error("remote metadata was not pulled")
+	}
+	for id := 1; id <= posts; id++ {
+		if e, ok := ours.Get(postURI(remoteHash, id)); !ok || e.Authorization != syndieutil.Authorized {
+			t.Errorf("post %d was not pulled and authorized", id)
+		}
+	}
+	if _, ok := theirs.Meta(localHash); !ok {
+		t.Error("local metadata was not pushed")
+	}
+	if !theirs.Has(postURI(localHash, 1)) {
+		t.Error("local post was not pushed")
+	}
+	p := s.Status()[0]
+	if p.Pulled != posts+1 || p.Pushed != 2 || p.Failures != 0 || p.LastSuccess.IsZero() {
+		t.Errorf("got status %+v", p)
+	}
+
+	// Nothing is exchanged again once both sides are in sync
+	if err := server.RebuildSharedIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncPeer(context.Background(), ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if p := s.Status()[0]; p.Pulled != posts+1 || p.Pushed != 2 {
+		t.Errorf("second sync exchanged messages again: %+v", p)
+	}
+}
+
+func TestSyndicatorRetriesUndecryptable(t *testing.T) {
+	private, meta, metaRaw := testChannel(t, "private")
+	hash := private.Identity.ChannelID().String()
+	readKey := crypto.NewSessionKey()
+	body, err := syndieutil.NewPostBuilder(syndieutil.PostURI(postURI(hash, 1))).AddPage("text/plain", "", "private").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var post bytes.Buffer
+	if err := syndieutil.New(syndieutil.MessageType("post"), syndieutil.TargetChannel(hash)).Marshal(&post, body, readKey, private.Identity); err != nil {
+		t.Fatal(err)
+	}
+
+	theirs := NewStore()
+	theirs.Keyring = crypto.NewKeyring()
+	theirs.Keyring.AddReadKey(hash, readKey)
+	mustPut(t, theirs, meta, metaRaw)
+	if _, err := theirs.Import(post.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	var fetches int32
+	server := NewServer(UseStore(theirs))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/"+hash+"/1"+messageExt {
+			atomic.AddInt32(&fetches, 1)
+		}
+		server.ServeHTTP(w, req)
+	}))
+	defer ts.Close()
+
+	ours := NewStore()
+	ours.Keyring = crypto.NewKeyring()
+	s := NewSyndicator(ours)
+	if err := s.AddPeer(ts.URL, false); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.SyncPeer(context.Background(), ts.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ours.Has(postURI(hash, 1)) {
+		t.Fatal("private post was imported without its read key")
+	}
+	if n := atomic.LoadInt32(&fetches); n != 1 {
+		t.Fatalf("private post was fetched %d times before its read key was known", n)
+	}
+
+	ours.Keyring.AddReadKey(hash, readKey)
+	if err := s.SyncPeer(context.Background(), ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ours.Get(postURI(hash, 1)); !ok {
+		t.Error("private post was not pulled once its read key was known")
+	}
+}
+
+func TestSyndicatorDiscover(t *testing.T) {
+	store := NewStore()
+	server := NewServer(UseStore(store))
+	server.AltURIs = []string{
+		"http://archive.example/",
+		"http://archive.example:8080",
+		"http://other.i2p/",
+		"http://hidden.onion/",
+		"file:///var/lib/syndie",
+		"http://127.0.0.1:6667/",
+		"http://10.1.2.3/",
+		"http://192.168.1.1/",
+		"http://169.254.169.254/",
+		"http://[::1]/",
+		"http://[fe80::1]/",
+		"http://0.0.0.0/",
+		"http://localhost:8080/",
+		"gopher://archive.example/",
+	}
+	server.NumAltURIs = byte(len(server.AltURIs))
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	s := NewSyndicator(NewStore())
+	if err := s.AddPeer(ts.URL, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SyncPeer(context.Background(), ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.Status()); n != 1 {
+		t.Fatalf("discovered %d peers with discovery off", n-1)
+	}
+
+	s.Discover = true
+	if err := s.SyncPeer(context.Background(), ts.URL); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, p := range s.Status() {
+		if p.Discovered {
+			if p.Push {
+				t.Errorf("discovered peer %s is pushed to", p.URL)
+			}
+			got[p.URL] = true
+		}
+	}
+	if len(got) != 2 || !got["http://archive.example/"] || !got["http://archive.example:8080/"] {
+		t.Errorf("discovered %v, want only the public clearnet archives", got)
+	}
+
+	// An .i2p peer may only lead to other .i2p archives
+	s = NewSyndicator(NewStore())
+	s.discover("http://peer.i2p/", server.AltURIs)
+	status := s.Status()
+	if len(status) != 1 || status[0].URL != "http://other.i2p/" {
+		t.Errorf("an .i2p peer led to %v", status)
+	}
+
+	s = NewSyndicator(NewStore())
+	s.MaxDiscovered = 1
+	s.discover("http://peer.example/", []string{"http://a.example/", "http://b.example/"})
+	if n := len(s.Status()); n != 1 {
+		t.Errorf("discovered %d peers, want MaxDiscovered", n)
+	}
+}
@@ -0,0 +1,250 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults used by NewTransport
+const (
+	DefaultDialTimeout           = 2 * time.Minute
+	DefaultResponseHeaderTimeout = 2 * time.Minute
+	DefaultRequestTimeout        = 10 * time.Minute
+	DefaultRetries               = 2
+	DefaultRetryWait             = 5 * time.Second
+)
+
+// Route says how to reach a class of hosts.  At most one of its fields should be set, and the
+// zero Route connects directly.
+type Route struct {
+	// HTTPProxy is an HTTP proxy such as I2P's at http://127.0.0.1:4444
+	HTTPProxy *url.URL
+	// SOCKS5 is the address of a SOCKS5 proxy such as Tor's at 127.0.0.1:9050.  Hostnames are
+	// resolved by the proxy.
+	SOCKS5 string
+	// Dial makes the connections itself, such as SAMSession.Dial
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (r Route) direct() bool {
+	return r.HTTPProxy == nil && r.SOCKS5 == "" && r.Dial == nil
+}
+
+// Transport fetches from archives over the route matching each archive's host.  Hosts ending in
+// .i2p use I2P and hosts ending in .onion use Onion, and neither is ever connected to directly,
+// so their names never reach the system resolver.  Every other host uses Clearnet.
+type Transport struct {
+	I2P      Route
+	Onion    Route
+	Clearnet Route
+	// DialTimeout and ResponseHeaderTimeout bound each attempt, Timeout bounds a whole request
+	// including its retries
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+	Timeout               time.Duration
+	// Retries is how many more times a request is attempted after a network error or a 5xx
+	// response, waiting RetryWait longer each time
+	Retries   int
+	RetryWait time.Duration
+
+	mu         sync.Mutex
+	transports map[string]*http.Transport
+}
+
+// NewTransport creates a new Transport that connects directly to clearnet hosts only
+func NewTransport() *Transport {
+	return &Transport{
+		DialTimeout:           DefaultDialTimeout,
+		ResponseHeaderTimeout: DefaultResponseHeaderTimeout,
+		Timeout:               DefaultRequestTimeout,
+		Retries:               DefaultRetries,
+		RetryWait:             DefaultRetryWait,
+	}
+}
+
+// HTTPClient returns an http.Client making its requests through the Transport, for use as
+// Client.HTTPClient or Syndicator.Client
+func (t *Transport) HTTPClient() *http.Client {
+	return &http.Client{Transport: t, Timeout: t.Timeout}
+}
+
+// RouteFor returns the name and Route of the class a host belongs to
+func (t *Transport) RouteFor(host string) (string, Route) {
+	switch class := routeClass(host); class {
+	case "i2p":
+		return class, t.I2P
+	case "onion":
+		return class, t.Onion
+	default:
+		return class, t.Clearnet
+	}
+}
+
+// routeClass returns the name of the class of hosts a host belongs to: i2p, onion or clearnet
+func routeClass(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	switch {
+	case strings.HasSuffix(host, ".i2p"):
+		return "i2p"
+	case strings.HasSuffix(host, ".onion"):
+		return "onion"
+	}
+	return "clearnet"
+}
+
+// RoundTrip sends a request over the route for its host, retrying it if it failed in a way
+// that may be temporary and it can be sent again
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	class, route := t.RouteFor(req.URL.Hostname())
+	if class != "clearnet" && route.direct() {
+		return nil, fmt.Errorf("no route configured for .%s host %s", class, req.URL.Hostname())
+	}
+	rt := t.transport(class, route)
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for attempt := 0; ; attempt++ {
+		r := req
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+		resp, err := rt.RoundTrip(r)
+		if attempt >= t.Retries || !replayable || req.Context().Err() != nil {
+			return resp, err
+		}
+		if err == nil {
+			if resp.StatusCode < 500 {
+				return resp, nil
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(t.RetryWait * time.Duration(attempt+1)):
+		}
+	}
+}
+
+// transport returns the http.Transport for a class of hosts, creating it on first use
+func (t *Transport) transport(class string, route Route) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if rt, ok := t.transports[class]; ok {
+		return rt
+	}
+	dialer := &net.Dialer{Timeout: t.DialTimeout}
+	rt := &http.Transport{
+		DialContext:           dialer.DialContext,
+		ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+		TLSHandshakeTimeout:   t.DialTimeout,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	switch {
+	case route.HTTPProxy != nil:
+		rt.Proxy = http.ProxyURL(route.HTTPProxy)
+	case route.SOCKS5 != "":
+		proxy := route.SOCKS5
+		rt.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSOCKS5(ctx, dialer, proxy, addr)
+		}
+	case route.Dial != nil:
+		rt.DialContext = route.Dial
+	}
+	if t.transports == nil {
+		t.transports = make(map[string]*http.Transport)
+	}
+	t.transports[class] = rt
+	return rt
+}
+
+// dialSOCKS5 connects to addr through a SOCKS5 proxy without authentication, passing the
+// hostname along so that the proxy resolves it
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxy string, addr string) (net.Conn, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, errors.New("socks5: invalid port " + portString)
+	}
+	if len(host) > 255 {
+		return nil, errors.New("socks5: hostname too long")
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxy)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		return nil, err
+	}
+
+	// Offer no authentication only
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return fail(err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fail(err)
+	}
+	if reply[0] != 5 || reply[1] != 0 {
+		return fail(errors.New("socks5: proxy requires authentication"))
+	}
+
+	req := []byte{5, 1, 0, 3, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return fail(err)
+	}
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fail(err)
+	}
+	if header[0] != 5 {
+		return fail(errors.New("socks5: invalid reply"))
+	}
+	if header[1] != 0 {
+		return fail(fmt.Errorf("socks5: connecting to %s failed with code %d", addr, header[1]))
+	}
+	// Skip the address the proxy bound to
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return fail(err)
+		}
+		skip = int(n[0])
+	default:
+		return fail(errors.New("socks5: invalid address type in reply"))
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fail(err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,245 @@
+package archive
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSOCKS5 is a SOCKS5 proxy without authentication that connects every hostname to backend
+// and records the hostnames it was asked for
+type fakeSOCKS5 struct {
+	l       net.Listener
+	backend string
+	mu      sync.Mutex
+	hosts   []string
+}
+
+func newFakeSOCKS5(t *testing.T, backend string) *fakeSOCKS5 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeSOCKS5{l: l, backend: backend}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return p
+}
+
+func (p *fakeSOCKS5) serve(conn net.Conn) {
+	defer conn.Close()
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+		return
+	}
+	conn.Write([]byte{5, 0})
+	req := make([]byte, 5)
+	if _, err := io.ReadFull(conn, req); err != nil || req[3] != 3 {
+		return
+	}
+	host := make([]byte, int(req[4])+2)
+	if _, err := io.ReadFull(conn, host); err != nil {
+		return
+	}
+	p.mu.Lock()
+	p.hosts = append(p.hosts, string(host[:len(host)-2]))
+	p.mu.Unlock()
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer backend.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(backend, conn)
+	io.Copy(conn, backend)
+}
+
+func (p *fakeSOCKS5) requested() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.hosts...)
+}
+
+func get(t *testing.T, c *http.Client, u string) (int, string, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body), err
+}
+
+func TestTransportRouteFor(t *testing.T) {
+	tr := NewTransport()
+	for host, want := range map[string]string{
+		"archive.i2p":       "i2p",
+		"ARCHIVE.I2P.":      "i2p",
+		"abc.b32.i2p":       "i2p",
+		"example.onion":     "onion",
+		"example.com":       "clearnet",
+		"127.0.0.1":         "clearnet",
+		"i2p.example.com":   "clearnet",
+		"onion.example.org": "clearnet",
+	} {
+		if got, _ := tr.RouteFor(host); got != want {
+			t.Errorf("RouteFor(%q) = %s, want %s", host, got, want)
+		}
+	}
+}
+
+func TestTransportRefusesUnroutedHosts(t *testing.T) {
+	c := NewTransport().HTTPClient()
+	for _, u := range []string{"http://archive.i2p/", "http://example.onion/"} {
+		if _, _, err := get(t, c, u); err == nil || !strings.Contains(err.Error(), "no route") {
+			t.Errorf("GET %s = %v, want no route error", u, err)
+		}
+	}
+}
+
+func TestTransportHTTPProxy(t *testing.T) {
+	s := NewServer()
+	var hosts []string
+	var mu sync.Mutex
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hosts = append(hosts, r.URL.Host)
+		mu.Unlock()
+		s.ServeHTTP(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	tr := NewTransport()
+	tr.I2P = Route{HTTPProxy: proxyURL}
+	c := NewClient()
+	c.HTTPClient = tr.HTTPClient()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Fetch(ctx, "http://archive.i2p/"); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(hosts) != 1 || hosts[0] != "archive.i2p" {
+		t.Errorf("proxy saw %q, want archive.i2p", hosts)
+	}
+}
+
+func TestTransportSOCKS5(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello from "+r.Host)
+	}))
+	defer backend.Close()
+	socks := newFakeSOCKS5(t, backend.Listener.Addr().String())
+
+	tr := NewTransport()
+	tr.Onion = Route{SOCKS5: socks.l.Addr().String()}
+	status, body, err := get(t, tr.HTTPClient(), "http://example.onion/shared-index.dat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || body != "hello from example.onion" {
+		t.Errorf("GET = %d %q", status, body)
+	}
+	if hosts := socks.requested(); len(hosts) != 1 || hosts[0] != "example.onion" {
+		t.Errorf("proxy was asked for %q, want the unresolved hostname", hosts)
+	}
+}
+
+func TestTransportDial(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	var dialed []string
+	tr := NewTransport()
+	tr.Clearnet = Route{Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		var d net.Dialer
+		return d.DialContext(ctx, network, backend.Listener.Addr().String())
+	}}
+	if _, body, err := get(t, tr.HTTPClient(), "http://archive.example:8080/"); err != nil || body != "ok" {
+		t.Fatalf("GET = %q, %v", body, err)
+	}
+	if len(dialed) != 1 || dialed[0] != "archive.example:8080" {
+		t.Errorf("dialed %q, want archive.example:8080", dialed)
+	}
+}
+
+func TestTransportRetries(t *testing.T) {
+	var calls int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= 2 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	tr := NewTransport()
+	tr.Retries = 1
+	tr.RetryWait = time.Millisecond
+	if status, _, err := get(t, tr.HTTPClient(), backend.URL); err != nil || status != http.StatusServiceUnavailable {
+		t.Errorf("with one retry GET = %d, %v, want 503", status, err)
+	}
+
+	atomic.StoreInt32(&calls, 0)
+	tr = NewTransport()
+	tr.Retries = 2
+	tr.RetryWait = time.Millisecond
+	if status, body, err := get(t, tr.HTTPClient(), backend.URL); err != nil || status != http.StatusOK || body != "ok" {
+		t.Errorf("with two retries GET = %d %q, %v, want 200", status, body, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("backend was called %d times, want 3", n)
+	}
+}
+
+func TestTransportResponseHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	tr := NewTransport()
+	tr.Retries = 0
+	tr.ResponseHeaderTimeout = 50 * time.Millisecond
+	start := time.Now()
+	if _, _, err := get(t, tr.HTTPClient(), backend.URL); err == nil {
+		t.Fatal("GET of a stalled archive succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("GET took %s to time out", elapsed)
+	}
+}
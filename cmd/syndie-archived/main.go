@@ -0,0 +1,286 @@
+// Command syndie-archived serves a Syndie archive from a directory over HTTP
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kpetku/libsyndie/archive"
+)
+
+// config holds the settings of the daemon, read from an optional JSON file and overridden by flags
+type config struct {
+	Listen         string   `json:"listen"`
+	Data           string   `json:"data"`
+	Push           string   `json:"push"`
+	MaxMessageSize int      `json:"maxMessageSize"`
+	MaxPushSize    int64    `json:"maxPushSize"`
+	AdminChannel   string   `json:"adminChannel"`
+	IndexInterval  string   `json:"indexInterval"`
+	PurgeInterval  string   `json:"purgeInterval"`
+	Peers          []string `json:"peers"`
+	PullPeers      []string `json:"pullPeers"`
+	LocalChannels  []string `json:"localChannels"`
+	Discover       bool     `json:"discover"`
+	SyncInterval   string   `json:"syncInterval"`
+	SAM            string   `json:"sam"`
+	I2PKeys        string   `json:"i2pKeys"`
+	I2PProxy       string   `json:"i2pProxy"`
+	OnionProxy     string   `json:"onionProxy"`
+	ClearnetProxy  string   `json:"clearnetProxy"`
+}
+
+func main() {
+	log.SetPrefix("syndie-archived: ")
+	if err := run(os.Args[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func run(args []string) error {
+	cfg := config{
+		Listen:         archive.DefaultAddr,
+		Data:           "archive",
+		Push:           archive.PushKnownChannels.String(),
+		MaxMessageSize: archive.DefaultMaxMessageSize,
+		MaxPushSize:    archive.DefaultMaxPushSize,
+		IndexInterval:  "5m",
+		PurgeInterval:  "1h",
+		SyncInterval:   "30m",
+	}
+	fs := flag.NewFlagSet("syndie-archived", flag.ExitOnError)
+	configFile := fs.String("config", "", "JSON `file` to read settings from, flags override it")
+	fs.StringVar(&cfg.Listen, "listen", cfg.Listen, "`address` to serve HTTP on")
+	fs.StringVar(&cfg.Data, "data", cfg.Data, "`directory` the messages are stored in")
+	fs.StringVar(&cfg.Push, "push", cfg.Push, "which pushes to accept: none, known or all")
+	fs.IntVar(&cfg.MaxMessageSize, "max-message-size", cfg.MaxMessageSize, "largest pushed message in `bytes`")
+	fs.Int64Var(&cfg.MaxPushSize, "max-push-size", cfg.MaxPushSize, "largest push request in `bytes`")
+	fs.StringVar(&cfg.AdminChannel, "admin-channel", cfg.AdminChannel, "`hash` of the channel advertised as the admin channel")
+	fs.StringVar(&cfg.IndexInterval, "index-interval", cfg.IndexInterval, "how often shared-index.dat is rebuilt")
+	fs.StringVar(&cfg.PurgeInterval, "purge-interval", cfg.PurgeInterval, "how often expired messages are purged")
+	fs.Var((*listFlag)(&cfg.Peers), "peer", "`url` of an archive to pull from and push local messages to, may be repeated")
+	fs.Var((*listFlag)(&cfg.PullPeers), "pull", "`url` of an archive to only pull from, may be repeated")
+	fs.Var((*listFlag)(&cfg.LocalChannels), "local", "`hash` of a channel whose messages are pushed to peers, may be repeated")
+	fs.BoolVar(&cfg.Discover, "discover", cfg.Discover, "also pull from the archives peers advertise")
+	fs.StringVar(&cfg.SyncInterval, "sync-interval", cfg.SyncInterval, "how often each peer is synced")
+	fs.StringVar(&cfg.SAM, "sam", cfg.SAM, "`address` of a SAM bridge to also serve and sync over I2P")
+	fs.StringVar(&cfg.I2PKeys, "i2p-keys", cfg.I2PKeys, "`file` keeping the I2P destination keys, created if missing")
+	fs.StringVar(&cfg.I2PProxy, "i2p-proxy", cfg.I2PProxy, "`url` of the HTTP proxy used for .i2p peers when there is no SAM bridge")
+	fs.StringVar(&cfg.OnionProxy, "onion-proxy", cfg.OnionProxy, "`address` of the SOCKS5 proxy used for .onion peers")
+	fs.StringVar(&cfg.ClearnetProxy, "clearnet-proxy", cfg.ClearnetProxy, "`url` of an HTTP proxy, or socks5://address, used for other peers")
+	fs.Parse(args)
+
+	if *configFile != "" {
+		// Remember the flags given on the command line so they win over the file
+		set := make(map[string]string)
+		fs.Visit(func(f *flag.Flag) {
+			set[f.Name] = f.Value.String()
+		})
+		data, err := os.ReadFile(*configFile)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return fmt.Errorf("error reading %s: %s", *configFile, err)
+		}
+		for name, value := range set {
+			if _, ok := fs.Lookup(name).Value.(*listFlag); ok {
+				// Repeated flags replace the list from the file rather than adding to it
+				*fs.Lookup(name).Value.(*listFlag) = nil
+				for _, v := range strings.Split(value, ",") {
+					fs.Set(name, v)
+				}
+				continue
+			}
+			fs.Set(name, value)
+		}
+	}
+
+	push, err := archive.ParsePushPolicy(cfg.Push)
+	if err != nil {
+		return err
+	}
+	indexInterval, err := time.ParseDuration(cfg.IndexInterval)
+	if err != nil || indexInterval <= 0 {
+		return fmt.Errorf("invalid index interval %q", cfg.IndexInterval)
+	}
+	purgeInterval, err := time.ParseDuration(cfg.PurgeInterval)
+	if err != nil || purgeInterval <= 0 {
+		return fmt.Errorf("invalid purge interval %q", cfg.PurgeInterval)
+	}
+	syncInterval, err := time.ParseDuration(cfg.SyncInterval)
+	if err != nil || syncInterval <= 0 {
+		return fmt.Errorf("invalid sync interval %q", cfg.SyncInterval)
+	}
+
+	store, err := archive.OpenStore(cfg.Data, nil)
+	if err != nil {
+		return err
+	}
+	logger := log.New(os.Stderr, "syndie-archived: ", log.LstdFlags)
+	logger.Printf("loaded %d channels and %d messages from %s", len(store.Channels()), len(store.Messages()), cfg.Data)
+
+	s := archive.NewServer(
+		archive.Addr(cfg.Listen),
+		archive.UseStore(store),
+		archive.Push(push),
+		archive.MaxMessageSize(cfg.MaxMessageSize),
+		archive.MaxPushSize(cfg.MaxPushSize),
+		archive.AdminChannelHash(cfg.AdminChannel),
+		archive.Logger(logger),
+	)
+	if err := s.RebuildSharedIndex(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go s.RebuildSharedIndexEvery(ctx, indexInterval)
+	store.Logger = logger
+	go store.PurgeExpiredEvery(ctx, purgeInterval)
+
+	transport, err := newTransport(cfg)
+	if err != nil {
+		return err
+	}
+	syndicator := archive.NewSyndicator(store)
+	syndicator.Client = transport.HTTPClient()
+	syndicator.Interval = syncInterval
+	syndicator.Discover = cfg.Discover
+	syndicator.Local = archive.AuthoredBy(cfg.LocalChannels...)
+	syndicator.Logger = logger
+	for _, url := range cfg.Peers {
+		if err := syndicator.AddPeer(url, true); err != nil {
+			return err
+		}
+	}
+	for _, url := range cfg.PullPeers {
+		if err := syndicator.AddPeer(url, false); err != nil {
+			return err
+		}
+	}
+
+	errs := make(chan error, 2)
+	servers := 1
+	if cfg.SAM != "" {
+		session, err := openSAM(ctx, cfg.SAM, cfg.I2PKeys)
+		if err != nil {
+			return err
+		}
+		defer session.Close()
+		l, err := session.Listen()
+		if err != nil {
+			return err
+		}
+		transport.I2P = archive.Route{Dial: session.Dial}
+		servers++
+		go func() {
+			logger.Printf("serving %s on %s", cfg.Data, session.Addr().Base32())
+			errs <- s.Serve(l)
+		}()
+	}
+	if len(cfg.Peers)+len(cfg.PullPeers) > 0 {
+		go syndicator.Run(ctx)
+	}
+	go func() {
+		logger.Printf("serving %s on %s, accepting %s pushes", cfg.Data, cfg.Listen, push)
+		errs <- s.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+	logger.Print("shutting down")
+	shutdown, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := s.Shutdown(shutdown); err != nil {
+		return err
+	}
+	for i := 0; i < servers; i++ {
+		if err := <-errs; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// newTransport sets up the routes to peers from the proxy settings
+func newTransport(cfg config) (*archive.Transport, error) {
+	t := archive.NewTransport()
+	var err error
+	if t.I2P, err = parseRoute(cfg.I2PProxy); err != nil {
+		return nil, err
+	}
+	if cfg.OnionProxy != "" {
+		t.Onion = archive.Route{SOCKS5: strings.TrimPrefix(cfg.OnionProxy, "socks5://")}
+	}
+	if t.Clearnet, err = parseRoute(cfg.ClearnetProxy); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// parseRoute reads an http:// proxy URL or a socks5:// proxy address
+func parseRoute(proxy string) (archive.Route, error) {
+	if proxy == "" {
+		return archive.Route{}, nil
+	}
+	if strings.HasPrefix(proxy, "socks5://") {
+		return archive.Route{SOCKS5: strings.TrimPrefix(proxy, "socks5://")}, nil
+	}
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return archive.Route{}, fmt.Errorf("invalid proxy %q", proxy)
+	}
+	return archive.Route{HTTPProxy: u}, nil
+}
+
+// openSAM opens a SAM session using the destination kept in keysFile, saving a new one there if
+// the file does not exist yet
+func openSAM(ctx context.Context, samAddr string, keysFile string) (*archive.SAMSession, error) {
+	var keys string
+	if keysFile != "" {
+		data, err := os.ReadFile(keysFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		keys = strings.TrimSpace(string(data))
+	}
+	dial, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	session, err := archive.NewSAMSession(dial, samAddr, keys)
+	if err != nil {
+		return nil, err
+	}
+	if keysFile != "" && keys == "" {
+		if err := os.WriteFile(keysFile, []byte(session.PrivateKeys()+"\n"), 0o600); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// listFlag collects every value of a flag that may be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
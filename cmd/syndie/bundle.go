@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kpetku/libsyndie/archive"
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	data := fs.String("data", "", "file archive `directory` to export from")
+	out := fs.String("out", "", "bundle `file` to write")
+	var channels listFlag
+	fs.Var(&channels, "channel", "`hash` of a channel to export, may be repeated, all channels if not given")
+	fs.Parse(args)
+	if *data == "" || *out == "" {
+		return errors.New("export: -data and -out are required")
+	}
+	store, err := archive.OpenStore(*data, nil)
+	if err != nil {
+		return err
+	}
+	var include func(*archive.Entry) bool
+	if len(channels) > 0 {
+		targets := make(map[crypto.ChannelID]bool)
+		for _, c := range channels {
+			id, err := crypto.ParseChannelID(c)
+			if err != nil {
+				return fmt.Errorf("export: %s", err)
+			}
+			targets[id] = true
+		}
+		authored := archive.AuthoredBy(channels...)
+		include = func(e *archive.Entry) bool {
+			target, ok := e.Header.TargetChannelID()
+			return authored(e) || (ok && targets[target])
+		}
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := archive.ExportBundle(f, store, include); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func importBundles(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	data := fs.String("data", "", "file archive `directory` to import into, created if missing")
+	fs.Parse(args)
+	if *data == "" || fs.NArg() == 0 {
+		return errors.New("import: -data and at least one bundle are required")
+	}
+	store, err := archive.OpenStore(*data, nil)
+	if err != nil {
+		return err
+	}
+	for _, file := range fs.Args() {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		report, err := archive.ImportBundle(f, info.Size(), store)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		fmt.Printf("%s: imported %d, rejected %d\n", file, report.Imported, len(report.Rejected))
+		var names []string
+		for name := range report.Rejected {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s: %s\n", name, report.Rejected[name])
+		}
+	}
+	return archive.WriteSharedIndex(*data, store)
+}
+
+func syncArchives(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	data := fs.String("data", "", "file archive `directory` to sync, created if missing")
+	var local listFlag
+	fs.Var(&local, "local", "`hash` of a channel whose messages are pushed to each archive, may be repeated")
+	fs.Parse(args)
+	if *data == "" || fs.NArg() == 0 {
+		return errors.New("sync: -data and at least one archive URL are required")
+	}
+	store, err := archive.OpenStore(*data, nil)
+	if err != nil {
+		return err
+	}
+	s := archive.NewSyndicator(store)
+	s.Client = archive.NewTransport().HTTPClient()
+	s.Local = archive.AuthoredBy(local...)
+	for _, url := range fs.Args() {
+		if err := s.AddPeer(url, len(local) > 0); err != nil {
+			return err
+		}
+	}
+	s.SyncDue(context.Background(), time.Now())
+	for _, p := range s.Status() {
+		if p.LastError != "" {
+			fmt.Printf("%s: %s\n", p.URL, p.LastError)
+			continue
+		}
+		fmt.Printf("%s: pulled %d, pushed %d\n", p.URL, p.Pulled, p.Pushed)
+	}
+	return archive.WriteSharedIndex(*data, store)
+}
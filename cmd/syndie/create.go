@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/nym"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+func newChannel(args []string) error {
+	fs := flag.NewFlagSet("newchannel", flag.ExitOnError)
+	out := fs.String("out", "", "write the channel's metadata message to `file`")
+	private := fs.Bool("private", false, "encrypt the metadata with the channel's read key")
+	keys := fs.String("keys", "", "write the channel's manage, reply and read keys as key files to `directory`")
+	nymDir := fs.String("nym", "", "add the channel as an identity of the nym kept in `directory`")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("newchannel: expected a channel name")
+	}
+	if *keys == "" && *nymDir == "" {
+		return errors.New("newchannel: -keys or -nym is required to keep the channel's private keys")
+	}
+	m := syndieutil.NewMetadata()
+	if *nymDir != "" {
+		n, err := nym.Open(*nymDir)
+		if err != nil {
+			return err
+		}
+		if _, m, err = n.CreateIdentity(fs.Arg(0)); err != nil {
+			return err
+		}
+	} else if err := m.New(fs.Arg(0)); err != nil {
+		return err
+	}
+	hash := m.Identity.ChannelID().String()
+	fmt.Println("Channel=" + hash)
+	fmt.Println("Identity=" + m.Identity.String())
+	fmt.Println("EncryptKey=" + m.EncryptKey.String())
+	if *keys != "" {
+		if err := writeKeyFiles(*keys, hash, m); err != nil {
+			return err
+		}
+	}
+	if *out == "" {
+		return nil
+	}
+	var readerKey crypto.SessionKey
+	if *private {
+		readerKey = m.CurrentReadKey()
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.Marshal(f, readerKey)
+}
+
+// writeKeyFiles writes the keys of a new channel to dir as <channel>-<type>.key files
+func writeKeyFiles(dir string, hash string, m *syndieutil.Metadata) error {
+	manage, err := crypto.NewSigningKeyFile(crypto.ManageKey, hash, m.Identity)
+	if err != nil {
+		return err
+	}
+	keys := []*crypto.KeyFile{manage, crypto.NewReplyKeyFile(hash, m.EncryptKey)}
+	for _, key := range m.ReadKeys {
+		keys = append(keys, crypto.NewReadKeyFile(hash, key))
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		name := filepath.Join(dir, hash+"-"+string(key.Type)+".key")
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err != nil {
+			return err
+		}
+		if err := key.Marshal(f); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSigningKey reads the signing keypair held in a manage or post key file
+func readSigningKey(file string) (*crypto.SigningKeypair, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var key crypto.KeyFile
+	if err := key.Unmarshal(f); err != nil {
+		return nil, err
+	}
+	return key.SigningKeypair()
+}
+
+func post(args []string) error {
+	fs := flag.NewFlagSet("post", flag.ExitOnError)
+	keyFile := fs.String("key", "", "manage or post key `file` of the author's channel")
+	nymDir := fs.String("nym", "", "post as an identity of the nym kept in `directory` instead of -key")
+	target := fs.String("channel", "", "`hash` of the channel to post in, defaults to the author's channel")
+	subject := fs.String("subject", "", "subject of the post")
+	readKey := fs.String("readkey", "", "encrypt with this channel read `key` instead of a public body key")
+	avatar := fs.String("avatar", "", "`file` holding a 32x32 PNG avatar")
+	out := fs.String("out", "", "write the post to `file`")
+	var pages, attachments, tags, refs listFlag
+	fs.Var(&pages, "page", "`file` holding a page, text/html if it ends in .html, may be repeated")
+	fs.Var(&attachments, "attach", "`file` to attach, may be repeated")
+	fs.Var(&tags, "tag", "`tag` for the post, may be repeated")
+	fs.Var(&refs, "ref", "`uri` of a message this post replies to, parent first, may be repeated")
+	fs.Parse(args)
+	if (*keyFile == "") == (*nymDir == "") || *out == "" {
+		return errors.New("post: -out and one of -key or -nym are required")
+	}
+	var signer *crypto.SigningKeypair
+	if *nymDir != "" {
+		n, err := nym.Open(*nymDir)
+		if err != nil {
+			return err
+		}
+		author, ok := n.Author(*target)
+		if !ok {
+			return errors.New("post: the nym has no identities")
+		}
+		signer = author.Keypair
+	} else {
+		var err error
+		if signer, err = readSigningKey(*keyFile); err != nil {
+			return fmt.Errorf("post: %s: %s", *keyFile, err)
+		}
+	}
+	channel := signer.ChannelID().String()
+	if *target == "" {
+		*target = channel
+	}
+
+	var references []syndieutil.URI
+	for _, r := range refs {
+		u := syndieutil.URI{}
+		if err := u.Marshall(r); err != nil {
+			return fmt.Errorf("post: invalid reference %s: %s", r, err)
+		}
+		references = append(references, u)
+	}
+	postURI := syndieutil.URI{RefType: "channel", Channel: channel, MessageID: int(time.Now().UnixNano() / int64(time.Millisecond))}
+	b := syndieutil.NewPostBuilder(
+		syndieutil.Subject(*subject),
+		syndieutil.PostURI(postURI),
+		syndieutil.TargetChannel(*target),
+		syndieutil.References(references),
+	)
+	for _, t := range tags {
+		b.AddTag(t)
+	}
+	for _, p := range pages {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		contentType := "text/plain"
+		if ext := strings.ToLower(filepath.Ext(p)); ext == ".html" || ext == ".htm" {
+			contentType = "text/html"
+		}
+		b.AddPage(contentType, filepath.Base(p), string(data))
+	}
+	for _, a := range attachments {
+		f, err := os.Open(a)
+		if err != nil {
+			return err
+		}
+		b.AddAttachment(filepath.Base(a), "", "", f)
+		f.Close()
+	}
+	if *avatar != "" {
+		data, err := os.ReadFile(*avatar)
+		if err != nil {
+			return err
+		}
+		b.SetAvatar(data)
+	}
+	body, err := b.Build()
+	if err != nil {
+		return err
+	}
+
+	public := syndieutil.New(syndieutil.MessageType("post"))
+	key := *readKey
+	if key == "" {
+		key = crypto.NewSessionKey()
+		public.Set(syndieutil.BodyKey(key))
+	} else {
+		// Readers need the target channel to know which read keys to try
+		public.Set(syndieutil.TargetChannel(*target))
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		return err
+	}
+	if err := public.Marshal(f, body, key, signer); err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Println(postURI.String())
+	return f.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var readKeys listFlag
+	fs.Var(&readKeys, "readkey", "`channel:key` read key to try for a channel, may be repeated")
+	var keyFiles listFlag
+	fs.Var(&keyFiles, "keyfile", "key `file` exported by a Syndie client, may be repeated")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("dump: no files given")
+	}
+	keyring := crypto.NewKeyring()
+	if err := addKeyFiles(keyring, keyFiles); err != nil {
+		return err
+	}
+	for _, rk := range readKeys {
+		split := strings.SplitN(rk, ":", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("dump: invalid read key %q", rk)
+		}
+		keyring.AddReadKey(split[0], split[1])
+	}
+	for _, file := range fs.Args() {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("### %s\n", file)
+		dumpMessage(raw, keyring)
+	}
+	return nil
+}
+
+func dumpMessage(raw []byte, keyring *crypto.Keyring) {
+	fmt.Println("== public headers ==")
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		fmt.Println(line)
+	}
+
+	decoded, err := syndieutil.NewDecoder(syndieutil.ReadKeyResolver(keyring)).Decode(bytes.NewReader(raw))
+	if err != nil {
+		fmt.Println("== unable to decode:", err, "==")
+		return
+	}
+	h, m := decoded.Header(), decoded.Message()
+	fmt.Println("== decoded headers ==")
+	fmt.Print(h.String())
+	for i, p := range m.Page {
+		fmt.Printf("== page %d: %s %q ==\n", i, p.ContentType, p.Title)
+		fmt.Println(p.Data)
+		if len(p.References) > 0 {
+			fmt.Printf("== page %d references ==\n", i)
+			var refs bytes.Buffer
+			syndieutil.WriteReferences(&refs, p.References)
+			fmt.Print(refs.String())
+		}
+	}
+	for i, a := range m.Attachment {
+		fmt.Printf("== attachment %d: %q %s, %d bytes ==\n", i, a.Name, a.ContentType, len(a.Data))
+		if a.Description != "" {
+			fmt.Println(a.Description)
+		}
+	}
+	if img, err := m.AvatarImage(); err == nil && img != nil {
+		fmt.Printf("== avatar: %dx%d ==\n", img.Bounds().Dx(), img.Bounds().Dy())
+	}
+	if len(m.References) > 0 {
+		fmt.Println("== references ==")
+		var refs bytes.Buffer
+		syndieutil.WriteReferences(&refs, m.References)
+		fmt.Print(refs.String())
+	}
+}
+
+// addKeyFiles adds the keys in key files to a keyring
+func addKeyFiles(keyring *crypto.Keyring, files []string) error {
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		var key crypto.KeyFile
+		err = key.Unmarshal(f)
+		f.Close()
+		if err == nil {
+			err = keyring.Add(&key)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	return nil
+}
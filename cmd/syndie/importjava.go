@@ -0,0 +1,78 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/kpetku/libsyndie/archive"
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+func importJava(args []string) error {
+	fs := flag.NewFlagSet("import-java", flag.ExitOnError)
+	data := fs.String("data", "", "file archive `directory` to import into, created if missing")
+	var readKeys listFlag
+	fs.Var(&readKeys, "readkey", "`channel:key` read key to try for a channel, may be repeated")
+	var keyFiles listFlag
+	fs.Var(&keyFiles, "keyfile", "key `file` exported by a Syndie client, may be repeated")
+	fs.Parse(args)
+	if *data == "" || fs.NArg() != 1 {
+		return errors.New("import-java: -data and one Java Syndie directory are required")
+	}
+	keyring := crypto.NewKeyring()
+	if err := addKeyFiles(keyring, keyFiles); err != nil {
+		return err
+	}
+	for _, rk := range readKeys {
+		split := strings.SplitN(rk, ":", 2)
+		if len(split) != 2 {
+			return fmt.Errorf("import-java: invalid read key %q", rk)
+		}
+		keyring.AddReadKey(split[0], split[1])
+	}
+	store, err := archive.OpenStore(*data, keyring)
+	if err != nil {
+		return err
+	}
+	report, err := archive.ImportJavaSyndie(fs.Arg(0), store, keyring)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("imported %d messages and %d keys\n", len(report.Imported), report.Keys)
+	if len(report.Undecryptable) > 0 {
+		fmt.Printf("could not decrypt %d:\n", len(report.Undecryptable))
+		for _, name := range report.Undecryptable {
+			fmt.Printf("  %s\n", name)
+		}
+	}
+	if len(report.Unverified) > 0 {
+		fmt.Printf("could not verify %d:\n", len(report.Unverified))
+		for _, name := range sortedKeys(report.Unverified) {
+			fmt.Printf("  %s: %s\n", name, report.Unverified[name])
+		}
+	}
+	if len(report.Rejected) > 0 {
+		fmt.Printf("rejected %d:\n", len(report.Rejected))
+		var names []string
+		for name := range report.Rejected {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %s: %s\n", name, report.Rejected[name])
+		}
+	}
+	return archive.WriteSharedIndex(*data, store)
+}
+
+func sortedKeys(m map[string]string) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
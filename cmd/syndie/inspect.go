@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/kpetku/libsyndie/archive"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+func uri(args []string) error {
+	if len(args) == 0 {
+		return errors.New("uri: no URIs given")
+	}
+	for _, arg := range args {
+		u := syndieutil.URI{}
+		if err := u.Marshall(arg); err != nil {
+			fmt.Printf("%s: %s\n", arg, err)
+			continue
+		}
+		fmt.Println(u.String())
+		v := reflect.ValueOf(u)
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).IsZero() {
+				fmt.Printf("  %s: %v\n", v.Type().Field(i).Name, v.Field(i).Interface())
+			}
+		}
+	}
+	return nil
+}
+
+func index(args []string) error {
+	if len(args) == 0 {
+		return errors.New("index: no files given")
+	}
+	for _, file := range args {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		c := archive.NewClient()
+		err = c.Parse(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %s", file, err)
+		}
+		fmt.Printf("### %s\n", file)
+		fmt.Printf("flags: %#04x\nadmin channel: %d\n", c.ArchiveFlags, c.AdminChannel)
+		for _, alt := range c.AltURIs {
+			fmt.Println("alternate archive:", alt)
+		}
+		for i, ch := range c.ChannelHashes {
+			fmt.Printf("channel %d: %s edition %d flags %#02x\n", i, ch.ChannelHash.String(), ch.ChannelEdition, ch.ChannelFlags)
+		}
+		for _, url := range c.Urls {
+			fmt.Println(url)
+		}
+	}
+	return nil
+}
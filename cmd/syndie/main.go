@@ -0,0 +1,73 @@
+// Command syndie inspects and creates Syndie messages, URIs and archive indexes
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const usage = `usage: syndie <command> [arguments]
+
+commands:
+  dump [-keyfile f]... file...             print the headers, pages and attachments of messages
+  newchannel -keys dir|-nym dir [-out f] name
+                                           create a channel and save its private keys
+  post -key file|-nym dir -out file        write a post, see "syndie post -h"
+  uri uri...                               parse and print syndie URIs
+  index file...                            parse and print shared-index.dat files
+  export -data dir -out file [-channel h]  write the messages of a file archive to a bundle
+  import -data dir bundle...               import bundles into a file archive
+  sync -data dir [-local h] url...         sync a file archive with other archives, file:// included
+  import-java -data dir javadir            import a Java Syndie data directory into a file archive
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "dump":
+		err = dump(args)
+	case "newchannel":
+		err = newChannel(args)
+	case "post":
+		err = post(args)
+	case "uri":
+		err = uri(args)
+	case "index":
+		err = index(args)
+	case "export":
+		err = export(args)
+	case "import":
+		err = importBundles(args)
+	case "sync":
+		err = syncArchives(args)
+	case "import-java":
+		err = importJava(args)
+	case "help", "-h", "-help", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "syndie:", err)
+		os.Exit(1)
+	}
+}
+
+// listFlag collects every value of a flag that may be repeated
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
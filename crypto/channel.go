@@ -0,0 +1,84 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"errors"
+	"strings"
+
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+	"github.com/go-i2p/go-i2p/lib/crypto"
+)
+
+// ChannelID identifies a channel by the SHA256 hash of the DSA public key of its identity.  It is
+// written as the 44 character I2P base64 encoding of the hash, as in URIs, message headers and
+// archive paths.
+type ChannelID [32]byte
+
+// ChannelIDFromPublicKey derives the ChannelID of the channel whose identity is a DSA public key
+func ChannelIDFromPublicKey(pub crypto.DSAPublicKey) ChannelID {
+	return sha256.Sum256(pub[:])
+}
+
+// ChannelIDFromIdentity derives the ChannelID of the channel whose identity is a base64 encoded
+// DSA public key, as found in the Identity, ChannelManagerKeys and AuthorizedKeys headers
+func ChannelIDFromIdentity(identity string) (ChannelID, error) {
+	decoded, err := base64.I2PEncoding.DecodeString(identity)
+	if err != nil {
+		return ChannelID{}, err
+	}
+	var pub crypto.DSAPublicKey
+	if len(decoded) != len(pub) {
+		return ChannelID{}, errors.New("invalid identity key length")
+	}
+	copy(pub[:], decoded)
+	return ChannelIDFromPublicKey(pub), nil
+}
+
+// ParseChannelID parses the base64 encoding of a ChannelID.  The trailing padding may be left out.
+func ParseChannelID(s string) (ChannelID, error) {
+	var id ChannelID
+	s = strings.TrimSpace(s)
+	if len(s) == 43 {
+		s += "="
+	}
+	decoded, err := base64.I2PEncoding.DecodeString(s)
+	if err != nil {
+		return id, errors.New("invalid channel hash " + s)
+	}
+	if len(decoded) != len(id) {
+		return id, errors.New("invalid channel hash length " + s)
+	}
+	copy(id[:], decoded)
+	return id, nil
+}
+
+// String returns the base64 encoding of the ChannelID
+func (c ChannelID) String() string {
+	return base64.I2PEncoding.EncodeToString(c[:])
+}
+
+// ShortIdent returns the first six characters of the ChannelID in brackets, the way Syndie
+// abbreviates channels for display
+func (c ChannelID) ShortIdent() string {
+	return "[" + c.String()[:6] + "]"
+}
+
+// IsZero reports whether the ChannelID is unset
+func (c ChannelID) IsZero() bool {
+	return c == ChannelID{}
+}
+
+// MarshalText encodes the ChannelID as base64
+func (c ChannelID) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// UnmarshalText decodes a ChannelID encoded as base64
+func (c *ChannelID) UnmarshalText(text []byte) error {
+	id, err := ParseChannelID(string(text))
+	if err != nil {
+		return err
+	}
+	*c = id
+	return nil
+}
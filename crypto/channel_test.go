@@ -0,0 +1,63 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+)
+
+func TestChannelID(t *testing.T) {
+	skp := NewSigningKeypair()
+	if err := skp.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256(skp.Pub[:])
+	want := base64.I2PEncoding.EncodeToString(hash[:])
+	if got := skp.ChannelID().String(); got != want {
+		t.Fatalf("got ChannelID %s, want the hash of the public key %s", got, want)
+	}
+	if id, err := ChannelIDFromIdentity(skp.String()); err != nil || id != skp.ChannelID() {
+		t.Errorf("ChannelIDFromIdentity: %v", err)
+	}
+	for _, s := range []string{want, strings.TrimSuffix(want, "="), " " + want + "\n"} {
+		if id, err := ParseChannelID(s); err != nil || id != skp.ChannelID() {
+			t.Errorf("ParseChannelID(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "not a hash", want[:40], base64.I2PEncoding.EncodeToString(make([]byte, 33))} {
+		if _, err := ParseChannelID(s); err == nil {
+			t.Errorf("ParseChannelID(%q) succeeded", s)
+		}
+	}
+	if got := skp.ChannelID().ShortIdent(); got != "["+want[:6]+"]" {
+		t.Errorf("got ShortIdent %s", got)
+	}
+
+	data, err := json.Marshal(map[string]ChannelID{"channel": skp.ChannelID()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]ChannelID
+	if err := json.Unmarshal(data, &decoded); err != nil || decoded["channel"] != skp.ChannelID() {
+		t.Errorf("ChannelID did not round trip through JSON: %v", err)
+	}
+}
+
+// SigningKeypair.Hash used to hash the base64 encoded public key rather than the key itself, so it
+// named no channel any other client knows.  It now returns the ChannelID, a different value.
+func TestSigningKeypairHashChanged(t *testing.T) {
+	skp := NewSigningKeypair()
+	if err := skp.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	legacy := sha256.Sum256([]byte(skp.String()))
+	if skp.Hash() == base64.I2PEncoding.EncodeToString(legacy[:]) {
+		t.Fatal("Hash still hashes the base64 encoded public key")
+	}
+	if skp.Hash() != skp.ChannelID().String() {
+		t.Errorf("Hash returns %s, want the ChannelID %s", skp.Hash(), skp.ChannelID())
+	}
+}
@@ -0,0 +1,150 @@
+package crypto
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+)
+
+// KeyType says what a key in a key file is used for
+type KeyType string
+
+const (
+	// ManageKey is the private DSA key of a channel's identity or of one of its managers, allowing
+	// its holder to publish new editions of the channel's metadata
+	ManageKey KeyType = "manage"
+	// PostKey is a private DSA key allowed to post in a channel
+	PostKey KeyType = "post"
+	// ReplyKey is the private ElGamal key that decrypts private replies sent to a channel
+	ReplyKey KeyType = "reply"
+	// ReadKey is an AES-256 key that decrypts posts to a private channel
+	ReadKey KeyType = "read"
+)
+
+// keyLength is the length of the raw key of each KeyType
+var keyLength = map[KeyType]int{
+	ManageKey: 20,
+	PostKey:   20,
+	ReplyKey:  256,
+	ReadKey:   32,
+}
+
+// maxKeyFileSize bounds how much of a key file is read
+const maxKeyFileSize = 16 * 1024
+
+// KeyFile is a single key in the format Syndie clients exchange keys in, a small text file of
+// "keyType=", "scope=" and "raw=" lines
+type KeyFile struct {
+	Type KeyType
+	// Scope is the base64 encoded hash of the channel the key belongs to
+	Scope string
+	// Raw is the base64 encoded key
+	Raw string
+}
+
+// NewSigningKeyFile creates a KeyFile holding the private key of a SigningKeypair as a manage or
+// post key for a channel
+func NewSigningKeyFile(t KeyType, scope string, skp *SigningKeypair) (*KeyFile, error) {
+	if t != ManageKey && t != PostKey {
+		return nil, fmt.Errorf("a signing key cannot be a %s key", t)
+	}
+	return &KeyFile{Type: t, Scope: scope, Raw: skp.PrivateString()}, nil
+}
+
+// NewReplyKeyFile creates a KeyFile holding the private key of a PrivateReplyKeypair for a channel
+func NewReplyKeyFile(scope string, r *PrivateReplyKeypair) *KeyFile {
+	return &KeyFile{Type: ReplyKey, Scope: scope, Raw: r.PrivateString()}
+}
+
+// NewReadKeyFile creates a KeyFile holding a read key for a channel
+func NewReadKeyFile(scope string, key SessionKey) *KeyFile {
+	return &KeyFile{Type: ReadKey, Scope: scope, Raw: key}
+}
+
+// Unmarshal reads a key file.  Field names are case insensitive, "=" may be used instead of ":",
+// and lines other than keytype, scope and raw are ignored.
+func (k *KeyFile) Unmarshal(r io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, maxKeyFileSize+1))
+	if err != nil {
+		return err
+	}
+	if len(data) > maxKeyFileSize {
+		return errors.New("key file too large")
+	}
+	var parsed KeyFile
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		sep := strings.IndexAny(line, ":=")
+		if sep <= 0 {
+			continue
+		}
+		value := strings.TrimSpace(line[sep+1:])
+		switch strings.ToLower(strings.TrimSpace(line[:sep])) {
+		case "keytype":
+			parsed.Type = KeyType(strings.ToLower(value))
+		case "scope":
+			parsed.Scope = value
+		case "raw":
+			parsed.Raw = value
+		}
+	}
+	if err := parsed.Validate(); err != nil {
+		return err
+	}
+	*k = parsed
+	return nil
+}
+
+// Marshal writes the key file the way Java Syndie exports keys, see KeyExport in
+// src/syndie/db/KeyExport.java, so that Java Syndie's KeyImport reads it back
+func (k *KeyFile) Marshal(w io.Writer) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "keyType=%s\nscope=%s\nraw=%s\n", k.Type, k.Scope, k.Raw)
+	return err
+}
+
+// Validate checks that the key file has a known type, a scope and a raw key of the right length
+func (k *KeyFile) Validate() error {
+	want, ok := keyLength[k.Type]
+	if !ok {
+		return fmt.Errorf("unknown key type %q", k.Type)
+	}
+	if k.Scope == "" {
+		return errors.New("key file has no scope")
+	}
+	if scope, err := base64.I2PEncoding.DecodeString(k.Scope); err != nil || len(scope) != 32 {
+		return errors.New("invalid key file scope " + k.Scope)
+	}
+	raw, err := base64.I2PEncoding.DecodeString(k.Raw)
+	if err != nil {
+		return fmt.Errorf("invalid %s key: %s", k.Type, err)
+	}
+	// Java Syndie writes ElGamal keys without their leading zero bytes
+	if len(raw) != want && !(k.Type == ReplyKey && len(raw) > 0 && len(raw) < want) {
+		return fmt.Errorf("invalid %s key length %d", k.Type, len(raw))
+	}
+	return nil
+}
+
+// SigningKeypair returns the keypair of a manage or post key
+func (k *KeyFile) SigningKeypair() (*SigningKeypair, error) {
+	if k.Type != ManageKey && k.Type != PostKey {
+		return nil, fmt.Errorf("a %s key is not a signing key", k.Type)
+	}
+	return ParseSigningKeypair(k.Raw)
+}
+
+// PrivateReplyKeypair returns the keypair of a reply key
+func (k *KeyFile) PrivateReplyKeypair() (*PrivateReplyKeypair, error) {
+	if k.Type != ReplyKey {
+		return nil, fmt.Errorf("a %s key is not a reply key", k.Type)
+	}
+	return ParsePrivateReplyKeypair(k.Raw)
+}
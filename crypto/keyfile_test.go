@@ -0,0 +1,168 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+)
+
+// testScope returns a random base64 encoded channel hash
+func testScope() string {
+	hash := make([]byte, 32)
+	rand.Read(hash)
+	return base64.I2PEncoding.EncodeToString(hash)
+}
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	scope := testScope()
+	signer := NewSigningKeypair()
+	if err := signer.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := NewPrivateReplyKeypair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	manage, err := NewSigningKeyFile(ManageKey, scope, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	post, err := NewSigningKeyFile(PostKey, scope, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSigningKeyFile(ReadKey, scope, signer); err == nil {
+		t.Error("a signing key was made into a read key file")
+	}
+
+	for _, k := range []*KeyFile{manage, post, NewReplyKeyFile(scope, reply), NewReadKeyFile(scope, NewSessionKey())} {
+		var buf bytes.Buffer
+		if err := k.Marshal(&buf); err != nil {
+			t.Fatalf("%s: %s", k.Type, err)
+		}
+		want := "keyType=" + string(k.Type) + "\nscope=" + scope + "\nraw=" + k.Raw + "\n"
+		if buf.String() != want {
+			t.Errorf("%s: wrote %q, want %q", k.Type, buf.String(), want)
+		}
+		var got KeyFile
+		if err := got.Unmarshal(&buf); err != nil {
+			t.Fatalf("%s: %s", k.Type, err)
+		}
+		if got != *k {
+			t.Errorf("%s: read back %+v", k.Type, got)
+		}
+	}
+
+	if skp, err := manage.SigningKeypair(); err != nil || skp.Pub != signer.Pub {
+		t.Errorf("manage key does not hold the signing keypair: %v", err)
+	}
+	if r, err := NewReplyKeyFile(scope, reply).PrivateReplyKeypair(); err != nil || r.String() != reply.String() {
+		t.Errorf("reply key does not hold the reply keypair: %v", err)
+	}
+	if _, err := manage.PrivateReplyKeypair(); err == nil {
+		t.Error("a manage key was read as a reply key")
+	}
+}
+
+func TestKeyFileUnmarshal(t *testing.T) {
+	scope := testScope()
+	key := NewSessionKey()
+	for _, text := range []string{
+		"keyType=read\nscope=" + scope + "\nraw=" + key + "\n",
+		"keytype: read\nscope: " + scope + "\nraw: " + key + "\n",
+		"# exported key\r\nKEYTYPE = READ\r\nScope = " + scope + "\r\nRaw = " + key + "\r\ncomment=ignored\r\n",
+	} {
+		var k KeyFile
+		if err := k.Unmarshal(strings.NewReader(text)); err != nil {
+			t.Errorf("%q: %s", text, err)
+			continue
+		}
+		if k.Type != ReadKey || k.Scope != scope || k.Raw != key {
+			t.Errorf("%q: read %+v", text, k)
+		}
+	}
+}
+
+func TestKeyFileValidate(t *testing.T) {
+	scope := testScope()
+	encode := func(n int) string {
+		return base64.I2PEncoding.EncodeToString(make([]byte, n))
+	}
+	short := make([]byte, 31)
+	rand.Read(short)
+	tests := []struct {
+		name string
+		key  KeyFile
+		ok   bool
+	}{
+		{"read key", KeyFile{ReadKey, scope, encode(32)}, true},
+		{"manage key", KeyFile{ManageKey, scope, encode(20)}, true},
+		{"post key", KeyFile{PostKey, scope, encode(20)}, true},
+		{"reply key", KeyFile{ReplyKey, scope, encode(256)}, true},
+		{"short reply key", KeyFile{ReplyKey, scope, encode(255)}, true},
+		{"unknown type", KeyFile{"archive", scope, encode(32)}, false},
+		{"short read key", KeyFile{ReadKey, scope, encode(31)}, false},
+		{"long manage key", KeyFile{ManageKey, scope, encode(21)}, false},
+		{"long reply key", KeyFile{ReplyKey, scope, encode(257)}, false},
+		{"empty reply key", KeyFile{ReplyKey, scope, ""}, false},
+		{"raw not base64", KeyFile{ReadKey, scope, "not base64!"}, false},
+		{"no scope", KeyFile{ReadKey, "", encode(32)}, false},
+		{"short scope", KeyFile{ReadKey, base64.I2PEncoding.EncodeToString(short), encode(32)}, false},
+		{"scope not base64", KeyFile{ReadKey, "../../etc", encode(32)}, false},
+	}
+	for _, tt := range tests {
+		err := tt.key.Validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+		if err != nil {
+			var buf bytes.Buffer
+			if tt.key.Marshal(&buf) == nil {
+				t.Errorf("%s: invalid key file was written", tt.name)
+			}
+		}
+	}
+}
+
+func TestParsePrivateReplyKeypairShortKey(t *testing.T) {
+	// Java Syndie drops the leading zero bytes of ElGamal keys
+	x := make([]byte, 255)
+	rand.Read(x)
+	x[0] |= 1
+	short := base64.I2PEncoding.EncodeToString(x)
+	r, err := ParsePrivateReplyKeypair(short)
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := base64.I2PEncoding.DecodeString(r.PrivateString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(priv) != replyKeyLength || priv[0] != 0 || !bytes.Equal(priv[1:], x) {
+		t.Fatal("private key is not padded to its full length")
+	}
+	if pub, err := base64.I2PEncoding.DecodeString(r.String()); err != nil || len(pub) != replyKeyLength {
+		t.Fatalf("public key is %d bytes", len(pub))
+	}
+	full, err := ParsePrivateReplyKeypair(r.PrivateString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if full.String() != r.String() {
+		t.Error("short and padded private keys derive different public keys")
+	}
+
+	k := NewReplyKeyFile(testScope(), r)
+	k.Raw = short
+	if fromFile, err := k.PrivateReplyKeypair(); err != nil || fromFile.String() != r.String() {
+		t.Errorf("short reply key file: %v", err)
+	}
+	for _, bad := range []string{"", base64.I2PEncoding.EncodeToString(make([]byte, 257)), "not base64!"} {
+		if _, err := ParsePrivateReplyKeypair(bad); err == nil {
+			t.Errorf("parsed reply key %q", bad)
+		}
+	}
+}
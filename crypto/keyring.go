@@ -0,0 +1,264 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/kpetku/libsyndie/internal/atomicfile"
+)
+
+// keyFileExt is the extension of the key files a Keyring is saved as
+const keyFileExt = ".key"
+
+// Keyring holds the keys known to the local user, indexed by the hash of the channel they belong to
+type Keyring struct {
+	mu       sync.RWMutex
+	readKeys map[string][]SessionKey
+	// keys holds the manage, post and reply keys
+	keys map[string][]*KeyFile
+}
+
+// NewKeyring creates a new empty Keyring
+func NewKeyring() *Keyring {
+	return &Keyring{
+		readKeys: make(map[string][]SessionKey),
+		keys:     make(map[string][]*KeyFile),
+	}
+}
+
+// Add adds a key of any type, ignoring keys that are already known
+func (k *Keyring) Add(key *KeyFile) error {
+	if err := key.Validate(); err != nil {
+		return err
+	}
+	copied := *key
+	copied.Scope = canonicalChannel(key.Scope)
+	key = &copied
+	switch key.Type {
+	case ReadKey:
+		k.AddReadKey(key.Scope, key.Raw)
+		return nil
+	case ReplyKey:
+		if _, err := key.PrivateReplyKeypair(); err != nil {
+			return err
+		}
+	default:
+		if _, err := key.SigningKeypair(); err != nil {
+			return err
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, known := range k.keys[key.Scope] {
+		if *known == *key {
+			return nil
+		}
+	}
+	k.keys[key.Scope] = append(k.keys[key.Scope], key)
+	return nil
+}
+
+// SigningKeys returns the manage or post keys known for a channel, oldest first
+func (k *Keyring) SigningKeys(channel string, t KeyType) []*SigningKeypair {
+	var keypairs []*SigningKeypair
+	for _, key := range k.Keys(channel) {
+		if key.Type != t {
+			continue
+		}
+		if skp, err := key.SigningKeypair(); err == nil {
+			keypairs = append(keypairs, skp)
+		}
+	}
+	return keypairs
+}
+
+// ReplyKeys returns the reply keys known for a channel, oldest first
+func (k *Keyring) ReplyKeys(channel string) []*PrivateReplyKeypair {
+	var keypairs []*PrivateReplyKeypair
+	for _, key := range k.Keys(channel) {
+		if key.Type != ReplyKey {
+			continue
+		}
+		if r, err := key.PrivateReplyKeypair(); err == nil {
+			keypairs = append(keypairs, r)
+		}
+	}
+	return keypairs
+}
+
+// Keys returns every key known for a channel as key files, read keys last
+func (k *Keyring) Keys(channel string) []*KeyFile {
+	channel = canonicalChannel(channel)
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	var keys []*KeyFile
+	for _, key := range k.keys[channel] {
+		copied := *key
+		keys = append(keys, &copied)
+	}
+	for _, key := range k.readKeys[channel] {
+		keys = append(keys, NewReadKeyFile(channel, key))
+	}
+	return keys
+}
+
+// Channels returns the hashes of the channels any key is known for, sorted
+func (k *Keyring) Channels() []string {
+	k.mu.RLock()
+	seen := make(map[string]bool)
+	for channel, keys := range k.keys {
+		seen[channel] = len(keys) > 0
+	}
+	for channel, keys := range k.readKeys {
+		seen[channel] = seen[channel] || len(keys) > 0
+	}
+	k.mu.RUnlock()
+	var channels []string
+	for channel, known := range seen {
+		if known {
+			channels = append(channels, channel)
+		}
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// Remove forgets a key of any type
+func (k *Keyring) Remove(key *KeyFile) {
+	scope := canonicalChannel(key.Scope)
+	if key.Type == ReadKey {
+		k.RemoveReadKey(scope, key.Raw)
+		return
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := k.keys[scope]
+	for i, known := range keys {
+		if known.Type == key.Type && known.Raw == key.Raw {
+			k.keys[scope] = append(keys[:i:i], keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddReadKey adds an AES-256 read key for a channel, ignoring keys that are already known
+func (k *Keyring) AddReadKey(channel string, key SessionKey) {
+	channel = canonicalChannel(channel)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, known := range k.readKeys[channel] {
+		if known == key {
+			return
+		}
+	}
+	k.readKeys[channel] = append(k.readKeys[channel], key)
+}
+
+// ReadKeys returns the read keys known for a channel, oldest first
+func (k *Keyring) ReadKeys(channel string) []SessionKey {
+	channel = canonicalChannel(channel)
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]SessionKey(nil), k.readKeys[channel]...)
+}
+
+// RemoveReadKey forgets a read key for a channel
+func (k *Keyring) RemoveReadKey(channel string, key SessionKey) {
+	channel = canonicalChannel(channel)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keys := k.readKeys[channel]
+	for i, known := range keys {
+		if known == key {
+			k.readKeys[channel] = append(keys[:i:i], keys[i+1:]...)
+			return
+		}
+	}
+}
+
+// canonicalChannel rewrites a channel hash the way ChannelID.String writes it, so that keys are
+// found however the hash was written.  Invalid hashes are returned unchanged.
+func canonicalChannel(channel string) string {
+	if id, err := ParseChannelID(channel); err == nil {
+		return id.String()
+	}
+	return channel
+}
+
+// LoadKeyring creates a Keyring holding the keys in the key files in dir, which are files ending
+// in .key such as the ones Save writes.  A missing dir gives an empty Keyring.
+func LoadKeyring(dir string) (*Keyring, error) {
+	k := NewKeyring()
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), keyFileExt) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var key KeyFile
+		if err := key.Unmarshal(bytes.NewReader(data)); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name(), err)
+		}
+		if err := k.Add(&key); err != nil {
+			return nil, fmt.Errorf("%s: %s", f.Name(), err)
+		}
+	}
+	return k, nil
+}
+
+// Save writes every key in the Keyring to dir as a key file readable only by its owner, and
+// removes the key files of keys that are no longer in the Keyring
+func (k *Keyring) Save(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	keep := make(map[string]bool)
+	for _, channel := range k.Channels() {
+		for _, key := range k.Keys(channel) {
+			name := keyFileName(key)
+			keep[name] = true
+			var buf bytes.Buffer
+			if err := key.Marshal(&buf); err != nil {
+				return err
+			}
+			if err := atomicfile.WriteFile(filepath.Join(dir, name), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), keyFileExt) && !keep[f.Name()] {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// keyFileName names a key's file after its type and a hash of its scope and key, since channel
+// hashes may contain characters some filesystems do not allow
+func keyFileName(key *KeyFile) string {
+	sum := sha256.Sum256([]byte(key.Scope + " " + key.Raw))
+	return string(key.Type) + "-" + hex.EncodeToString(sum[:8]) + keyFileExt
+}
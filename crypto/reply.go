@@ -1,7 +1,9 @@
 package crypto
 
 import (
+	"bytes"
 	"crypto/rand"
+	"errors"
 
 	"github.com/go-i2p/go-i2p/lib/common/base64"
 	"github.com/go-i2p/go-i2p/lib/crypto"
@@ -27,8 +29,41 @@ func NewPrivateReplyKeypair() (*PrivateReplyKeypair, error) {
 	return &prk, err
 }
 
-// String returns the base64 encoded public elgamal key used for private message replies
+// replyKeyLength is the length of I2P's ElGamal keys
+const replyKeyLength = 256
+
+// String returns the base64 encoded public elgamal key used for private message replies, padded
+// on the left to its full length
 func (r PrivateReplyKeypair) String() string {
-	// TODO: r.PrivKey.Y.Bytes() ...?
-	return base64.I2PEncoding.EncodeToString(r.PrivKey.Y.Bytes())
+	key := make([]byte, replyKeyLength)
+	r.PrivKey.Y.FillBytes(key)
+	return base64.I2PEncoding.EncodeToString(key)
+}
+
+// PrivateString returns the base64 encoded private ElGamal key, padded on the left to its full
+// length
+func (r PrivateReplyKeypair) PrivateString() string {
+	key := make([]byte, replyKeyLength)
+	r.PrivKey.X.FillBytes(key)
+	return base64.I2PEncoding.EncodeToString(key)
+}
+
+// ParsePrivateReplyKeypair rebuilds a PrivateReplyKeypair from its base64 encoded private ElGamal key
+func ParsePrivateReplyKeypair(priv string) (*PrivateReplyKeypair, error) {
+	decoded, err := base64.I2PEncoding.DecodeString(priv)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) == 0 || len(decoded) > replyKeyLength {
+		return nil, errors.New("invalid reply key length")
+	}
+	// ElgamalGenerate reads the private key from its random source and derives the public key
+	// with I2P's group parameters, which are not exported otherwise
+	x := make([]byte, replyKeyLength)
+	copy(x[replyKeyLength-len(decoded):], decoded)
+	var key elgamal.PrivateKey
+	if err := crypto.ElgamalGenerate(&key, bytes.NewReader(x)); err != nil {
+		return nil, err
+	}
+	return &PrivateReplyKeypair{PubKey: key.PublicKey, PrivKey: key}, nil
 }
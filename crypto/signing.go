@@ -1,12 +1,45 @@
 package crypto
 
 import (
-	"crypto/sha256"
+	"crypto/dsa"
+	"crypto/rand"
+	"errors"
+	"math/big"
 
 	"github.com/go-i2p/go-i2p/lib/common/base64"
 	"github.com/go-i2p/go-i2p/lib/crypto"
 )
 
+// dsaQ is the subgroup order of I2P's DSA parameters
+var dsaQ = new(big.Int).SetBytes([]byte{
+	0xa5, 0xdf, 0xc2, 0x8f, 0xef, 0x4c, 0xa1, 0xe2, 0x86, 0x74, 0x4c, 0xd8, 0xee, 0xd9, 0xd2, 0x9d,
+	0x68, 0x40, 0x46, 0xb7,
+})
+
+// dsaP is the prime modulus of I2P's DSA parameters
+var dsaP = new(big.Int).SetBytes([]byte{
+	0x9c, 0x05, 0xb2, 0xaa, 0x96, 0x0d, 0x9b, 0x97, 0xb8, 0x93, 0x19, 0x63, 0xc9, 0xcc, 0x9e, 0x8c,
+	0x30, 0x26, 0xe9, 0xb8, 0xed, 0x92, 0xfa, 0xd0, 0xa6, 0x9c, 0xc8, 0x86, 0xd5, 0xbf, 0x80, 0x15,
+	0xfc, 0xad, 0xae, 0x31, 0xa0, 0xad, 0x18, 0xfa, 0xb3, 0xf0, 0x1b, 0x00, 0xa3, 0x58, 0xde, 0x23,
+	0x76, 0x55, 0xc4, 0x96, 0x4a, 0xfa, 0xa2, 0xb3, 0x37, 0xe9, 0x6a, 0xd3, 0x16, 0xb9, 0xfb, 0x1c,
+	0xc5, 0x64, 0xb5, 0xae, 0xc5, 0xb6, 0x9a, 0x9f, 0xf6, 0xc3, 0xe4, 0x54, 0x87, 0x07, 0xfe, 0xf8,
+	0x50, 0x3d, 0x91, 0xdd, 0x86, 0x02, 0xe8, 0x67, 0xe6, 0xd3, 0x5d, 0x22, 0x35, 0xc1, 0x86, 0x9c,
+	0xe2, 0x47, 0x9c, 0x3b, 0x9d, 0x54, 0x01, 0xde, 0x04, 0xe0, 0x72, 0x7f, 0xb3, 0x3d, 0x65, 0x11,
+	0x28, 0x5d, 0x4c, 0xf2, 0x95, 0x38, 0xd9, 0xe3, 0xb6, 0x05, 0x1f, 0x5b, 0x22, 0xcc, 0x1c, 0x93,
+})
+
+// dsaG is the generator of I2P's DSA parameters
+var dsaG = new(big.Int).SetBytes([]byte{
+	0x0c, 0x1f, 0x4d, 0x27, 0xd4, 0x00, 0x93, 0xb4, 0x29, 0xe9, 0x62, 0xd7, 0x22, 0x38, 0x24, 0xe0,
+	0xbb, 0xc4, 0x7e, 0x7c, 0x83, 0x2a, 0x39, 0x23, 0x6f, 0xc6, 0x83, 0xaf, 0x84, 0x88, 0x95, 0x81,
+	0x07, 0x5f, 0xf9, 0x08, 0x2e, 0xd3, 0x23, 0x53, 0xd4, 0x37, 0x4d, 0x73, 0x01, 0xcd, 0xa1, 0xd2,
+	0x3c, 0x43, 0x1f, 0x46, 0x98, 0x59, 0x9d, 0xda, 0x02, 0x45, 0x18, 0x24, 0xff, 0x36, 0x97, 0x52,
+	0x59, 0x36, 0x47, 0xcc, 0x3d, 0xdc, 0x19, 0x7d, 0xe9, 0x85, 0xe4, 0x3d, 0x13, 0x6c, 0xdc, 0xfc,
+	0x6b, 0xd5, 0x40, 0x9c, 0xd2, 0xf4, 0x50, 0x82, 0x11, 0x42, 0xa5, 0xe6, 0xf8, 0xeb, 0x1c, 0x3a,
+	0xb5, 0xd0, 0x48, 0x4b, 0x81, 0x29, 0xfc, 0xf1, 0x7b, 0xce, 0x4f, 0x7f, 0x33, 0x32, 0x1c, 0x3c,
+	0xb3, 0xdb, 0xb1, 0x4a, 0x90, 0x5e, 0x7b, 0x2b, 0x3e, 0x93, 0xbe, 0x47, 0x08, 0xcb, 0xcc, 0x82,
+})
+
 // SigningKeypair is a DSA keypair used for replying to sign Syndie messages
 type SigningKeypair struct {
 	Pub  crypto.DSAPublicKey
@@ -18,19 +51,23 @@ func NewSigningKeypair() *SigningKeypair {
 	return new(SigningKeypair)
 }
 
-// Generate generates a new signing key pair
+// Generate generates a new signing key pair.  The keys are padded on the left to their full
+// length, which the go-i2p helpers do not do for keys with leading zero bytes.
 func (skp *SigningKeypair) Generate() error {
-	privKey, err := skp.Priv.Generate()
-	if err != nil {
+	priv := dsa.PrivateKey{PublicKey: dsa.PublicKey{Parameters: dsa.Parameters{P: dsaP, Q: dsaQ, G: dsaG}}}
+	if err := dsa.GenerateKey(&priv, rand.Reader); err != nil {
 		return err
 	}
-	skp.Priv = privKey
-	pubKey, err := privKey.Public()
-	if err != nil {
-		return err
-	}
-	skp.Pub = pubKey
-	return err
+	priv.X.FillBytes(skp.Priv[:])
+	skp.Pub = publicKey(skp.Priv)
+	return nil
+}
+
+// publicKey derives the public DSA key of a private key
+func publicKey(priv crypto.DSAPrivateKey) crypto.DSAPublicKey {
+	var pub crypto.DSAPublicKey
+	new(big.Int).Exp(dsaG, new(big.Int).SetBytes(priv[:]), dsaP).FillBytes(pub[:])
+	return pub
 }
 
 // String returns the base64 encoded public DSA key used for signing messages
@@ -38,10 +75,64 @@ func (i SigningKeypair) String() string {
 	return base64.I2PEncoding.EncodeToString(i.Pub[:])
 }
 
-// Hash returns the sha256 base64 encoded short hash of the SigningKeypair public key
+// ChannelID returns the ChannelID of the channel the SigningKeypair is the identity of
+func (i SigningKeypair) ChannelID() ChannelID {
+	return ChannelIDFromPublicKey(i.Pub)
+}
+
+// Hash returns the base64 encoded ChannelID of the channel the SigningKeypair is the identity of
 func (i SigningKeypair) Hash() string {
-	foo := sha256.New()
-	bar := base64.I2PEncoding.EncodeToString(i.Pub[:])
-	foo.Write([]byte(bar))
-	return base64.I2PEncoding.EncodeToString(foo.Sum(nil))
+	return i.ChannelID().String()
+}
+
+// Verify checks a DSA signature made over a SHA256 hash by the base64 encoded public key.
+// Syndie signs the whole 256 bit hash reduced modulo q rather than truncating it.
+func Verify(pub string, hash []byte, sig []byte) bool {
+	decoded, err := base64.I2PEncoding.DecodeString(pub)
+	if err != nil || len(decoded) != len(crypto.DSAPublicKey{}) {
+		return false
+	}
+	var key crypto.DSAPublicKey
+	copy(key[:], decoded)
+	v, err := key.NewVerifier()
+	if err != nil {
+		return false
+	}
+	return v.VerifyHash(reduceHash(hash), sig) == nil
+}
+
+func reduceHash(hash []byte) []byte {
+	return new(big.Int).Mod(new(big.Int).SetBytes(hash), dsaQ).Bytes()
+}
+
+// ParseSigningKeypair rebuilds a SigningKeypair from its base64 encoded private DSA key
+func ParseSigningKeypair(priv string) (*SigningKeypair, error) {
+	decoded, err := base64.I2PEncoding.DecodeString(priv)
+	if err != nil {
+		return nil, err
+	}
+	skp := NewSigningKeypair()
+	if len(decoded) != len(skp.Priv) {
+		return nil, errors.New("invalid signing key length")
+	}
+	copy(skp.Priv[:], decoded)
+	if new(big.Int).SetBytes(skp.Priv[:]).Sign() == 0 {
+		return nil, errors.New("invalid signing key")
+	}
+	skp.Pub = publicKey(skp.Priv)
+	return skp, nil
+}
+
+// PrivateString returns the base64 encoded private DSA key
+func (i SigningKeypair) PrivateString() string {
+	return base64.I2PEncoding.EncodeToString(i.Priv[:])
+}
+
+// Sign makes a DSA signature over a SHA256 hash that Verify accepts
+func (i SigningKeypair) Sign(hash []byte) ([]byte, error) {
+	signer, err := i.Priv.NewSigner()
+	if err != nil {
+		return nil, err
+	}
+	return signer.SignHash(reduceHash(hash))
 }
@@ -0,0 +1,62 @@
+package crypto
+
+import (
+	"crypto/sha256"
+	"testing"
+)
+
+func TestSignVerify(t *testing.T) {
+	hash := sha256.Sum256([]byte("message"))
+	other := sha256.Sum256([]byte("another message"))
+	// About one key in 256 has a public key with a leading zero byte, so make sure to meet some
+	var leadingZero int
+	for i := 0; i < 2048 && leadingZero < 2; i++ {
+		skp := NewSigningKeypair()
+		if err := skp.Generate(); err != nil {
+			t.Fatal(err)
+		}
+		if skp.Pub[0] != 0 && i >= 16 {
+			continue
+		}
+		if skp.Pub[0] == 0 {
+			leadingZero++
+		}
+		sig, err := skp.Sign(hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !Verify(skp.String(), hash[:], sig) {
+			t.Fatalf("signature by %s does not verify", skp.String())
+		}
+		if Verify(skp.String(), other[:], sig) {
+			t.Fatal("signature verifies for another hash")
+		}
+		parsed, err := ParseSigningKeypair(skp.PrivateString())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed.Pub != skp.Pub {
+			t.Fatal("parsed private key derives another public key")
+		}
+	}
+}
+
+func TestParseSigningKeypairLeadingZero(t *testing.T) {
+	skp := NewSigningKeypair()
+	skp.Priv[19] = 5
+	parsed, err := ParseSigningKeypair(skp.PrivateString())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := sha256.Sum256([]byte("message"))
+	sig, err := parsed.Sign(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Verify(parsed.String(), hash[:], sig) {
+		t.Error("signature by a small private key does not verify")
+	}
+	if _, err := ParseSigningKeypair(NewSigningKeypair().PrivateString()); err == nil {
+		t.Error("zero private key accepted")
+	}
+}
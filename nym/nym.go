@@ -0,0 +1,327 @@
+// Package nym manages the local user of Syndie, called a nym: the identities they own, the
+// channels each of those can manage or post to, and the keys they hold for other channels
+package nym
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/kpetku/libsyndie/crypto"
+	"github.com/kpetku/libsyndie/internal/atomicfile"
+	"github.com/kpetku/libsyndie/syndieutil"
+)
+
+const (
+	keysDir   = "keys"
+	indexFile = "nym.json"
+)
+
+// ErrUnknownIdentity is returned for channel hashes that are not one of the nym's identities
+var ErrUnknownIdentity = errors.New("unknown identity")
+
+// Identity is a channel owned by the nym, whose signing key it holds
+type Identity struct {
+	Name string
+	// Channel is the base64 encoded hash of the channel
+	Channel string
+	Keypair *crypto.SigningKeypair
+}
+
+// Nym is a local user.  Its keys are kept in a Keyring, where each identity is the manage key of
+// its own channel and the right of an identity to manage or post to another channel is its
+// private key held as a manage or post key for that channel.
+type Nym struct {
+	Keyring *crypto.Keyring
+
+	mu  sync.RWMutex
+	dir string
+	// names holds the name of each identity, by channel hash
+	names           map[string]string
+	defaultIdentity string
+}
+
+// index is the part of a Nym that is not kept in its keyring
+type index struct {
+	Default string            `json:"default,omitempty"`
+	Names   map[string]string `json:"names,omitempty"`
+}
+
+// New creates a new Nym without identities that is only held in memory
+func New() *Nym {
+	return &Nym{Keyring: crypto.NewKeyring(), names: make(map[string]string)}
+}
+
+// Open loads the Nym kept in dir, creating an empty one if dir does not exist.  Its keyring is
+// saved as key files in dir/keys after every change made through the Nym.
+func Open(dir string) (*Nym, error) {
+	keyring, err := crypto.LoadKeyring(filepath.Join(dir, keysDir))
+	if err != nil {
+		return nil, err
+	}
+	n := New()
+	n.Keyring = keyring
+	data, err := os.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var idx index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, err
+		}
+		for channel, name := range idx.Names {
+			n.names[channel] = name
+		}
+		n.defaultIdentity = idx.Default
+	}
+	n.dir = dir
+	return n, nil
+}
+
+// Save writes the Nym to its directory.  Changes made through the Nym are saved already, so it
+// is only needed after changing its Keyring directly.
+func (n *Nym) Save() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.save()
+}
+
+// save writes the Nym to its directory.  The caller holds the write lock, so only one save
+// writes the index at a time.
+func (n *Nym) save() error {
+	if n.dir == "" {
+		return nil
+	}
+	if err := n.Keyring.Save(filepath.Join(n.dir, keysDir)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(index{Default: n.defaultIdentity, Names: n.names}, "", "\t")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(n.dir, indexFile), data)
+}
+
+// CreateIdentity creates a new channel owned by the nym, adding its manage, reply and read keys
+// to the keyring.  The returned Metadata is not published anywhere, so it is up to the caller to
+// Marshal it and post it to an archive.
+func (n *Nym) CreateIdentity(name string) (*Identity, *syndieutil.Metadata, error) {
+	m := syndieutil.NewMetadata()
+	if err := m.New(name); err != nil {
+		return nil, nil, err
+	}
+	id, err := n.AddIdentity(name, m.Identity)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := n.Keyring.Add(crypto.NewReplyKeyFile(id.Channel, m.EncryptKey)); err != nil {
+		return nil, nil, err
+	}
+	m.AddReadKeys(n.Keyring)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return id, m, n.save()
+}
+
+// AddIdentity adds an existing channel whose signing key is known, such as one created by another
+// Syndie client.  The first identity added becomes the default.
+func (n *Nym) AddIdentity(name string, keypair *crypto.SigningKeypair) (*Identity, error) {
+	channel := keypair.ChannelID().String()
+	key, err := crypto.NewSigningKeyFile(crypto.ManageKey, channel, keypair)
+	if err != nil {
+		return nil, err
+	}
+	if err := n.Keyring.Add(key); err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.names[channel] = name
+	if n.defaultIdentity == "" {
+		n.defaultIdentity = channel
+	}
+	return &Identity{Name: name, Channel: channel, Keypair: keypair}, n.save()
+}
+
+// RemoveIdentity forgets an identity along with every key it holds for its own channel and the
+// rights it was granted to other channels
+func (n *Nym) RemoveIdentity(channel string) error {
+	id, ok := n.Identity(channel)
+	if !ok {
+		return ErrUnknownIdentity
+	}
+	for _, key := range n.Keyring.Keys(channel) {
+		n.Keyring.Remove(key)
+	}
+	private := id.Keypair.PrivateString()
+	for _, c := range n.Keyring.Channels() {
+		for _, key := range n.Keyring.Keys(c) {
+			if key.Raw == private {
+				n.Keyring.Remove(key)
+			}
+		}
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.names, channel)
+	if n.defaultIdentity == channel {
+		n.defaultIdentity = ""
+		if ids := n.identities(); len(ids) > 0 {
+			n.defaultIdentity = ids[0].Channel
+		}
+	}
+	return n.save()
+}
+
+// Identity returns the identity owning a channel
+func (n *Nym) Identity(channel string) (*Identity, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.identity(channel)
+}
+
+func (n *Nym) identity(channel string) (*Identity, bool) {
+	for _, skp := range n.Keyring.SigningKeys(channel, crypto.ManageKey) {
+		if skp.ChannelID().String() == channel {
+			return &Identity{Name: n.names[channel], Channel: channel, Keypair: skp}, true
+		}
+	}
+	return nil, false
+}
+
+// Identities returns the identities of the nym, sorted by name
+func (n *Nym) Identities() []*Identity {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.identities()
+}
+
+func (n *Nym) identities() []*Identity {
+	var ids []*Identity
+	for _, channel := range n.Keyring.Channels() {
+		if id, ok := n.identity(channel); ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.SliceStable(ids, func(i, j int) bool { return ids[i].Name < ids[j].Name })
+	return ids
+}
+
+// Default returns the identity used to compose messages unless another one is chosen
+func (n *Nym) Default() (*Identity, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if id, ok := n.identity(n.defaultIdentity); ok {
+		return id, true
+	}
+	if ids := n.identities(); len(ids) > 0 {
+		return ids[0], true
+	}
+	return nil, false
+}
+
+// SetDefault chooses the identity used to compose messages
+func (n *Nym) SetDefault(channel string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.identity(channel); !ok {
+		return ErrUnknownIdentity
+	}
+	n.defaultIdentity = channel
+	return n.save()
+}
+
+// Grant records that an identity may manage or post to another channel, because that channel's
+// metadata lists its key among the managers or authorized posters
+func (n *Nym) Grant(identity string, channel string, t crypto.KeyType) error {
+	id, ok := n.Identity(identity)
+	if !ok {
+		return ErrUnknownIdentity
+	}
+	key, err := crypto.NewSigningKeyFile(t, channel, id.Keypair)
+	if err != nil {
+		return err
+	}
+	if err := n.Keyring.Add(key); err != nil {
+		return err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.save()
+}
+
+// Revoke forgets that an identity may manage or post to another channel
+func (n *Nym) Revoke(identity string, channel string, t crypto.KeyType) error {
+	id, ok := n.Identity(identity)
+	if !ok {
+		return ErrUnknownIdentity
+	}
+	key, err := crypto.NewSigningKeyFile(t, channel, id.Keypair)
+	if err != nil {
+		return err
+	}
+	n.Keyring.Remove(key)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.save()
+}
+
+// CanManage reports whether an identity may publish metadata for a channel, which it always may
+// for its own
+func (n *Nym) CanManage(identity string, channel string) bool {
+	return n.holds(identity, channel, crypto.ManageKey)
+}
+
+// CanPost reports whether an identity may post to a channel as an authorized poster, which it
+// may for the channels it can manage as well
+func (n *Nym) CanPost(identity string, channel string) bool {
+	return n.holds(identity, channel, crypto.PostKey) || n.CanManage(identity, channel)
+}
+
+func (n *Nym) holds(identity string, channel string, t crypto.KeyType) bool {
+	id, ok := n.Identity(identity)
+	if !ok {
+		return false
+	}
+	for _, skp := range n.Keyring.SigningKeys(channel, t) {
+		if skp.Pub == id.Keypair.Pub {
+			return true
+		}
+	}
+	return false
+}
+
+// Channels returns the channels an identity may manage, or post to when t is crypto.PostKey,
+// sorted by hash
+func (n *Nym) Channels(identity string, t crypto.KeyType) []string {
+	var channels []string
+	for _, channel := range n.Keyring.Channels() {
+		if (t == crypto.PostKey && n.CanPost(identity, channel)) || (t == crypto.ManageKey && n.CanManage(identity, channel)) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+// Author chooses the identity to compose a message to a channel with: the default identity if it
+// may post there, or else the first identity that may, or else the default identity, whose post
+// is then only accepted by channels allowing public posts or replies
+func (n *Nym) Author(channel string) (*Identity, bool) {
+	def, ok := n.Default()
+	if !ok {
+		return nil, false
+	}
+	if n.CanPost(def.Channel, channel) {
+		return def, true
+	}
+	for _, id := range n.Identities() {
+		if n.CanPost(id.Channel, channel) {
+			return id, true
+		}
+	}
+	return def, true
+}
@@ -0,0 +1,263 @@
+package nym
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+func newKeypair(t *testing.T) *crypto.SigningKeypair {
+	t.Helper()
+	skp := crypto.NewSigningKeypair()
+	if err := skp.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	return skp
+}
+
+func TestOpenSaveRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	n, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, meta, err := n.CreateIdentity("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := n.AddIdentity("bob", newKeypair(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.SetDefault(bob.Channel); err != nil {
+		t.Fatal(err)
+	}
+	other := newKeypair(t).ChannelID().String()
+	if err := n.Grant(alice.Channel, other, crypto.PostKey); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := reopened.Identities()
+	if len(ids) != 2 || ids[0].Name != "alice" || ids[1].Name != "bob" {
+		t.Fatalf("reopened nym has identities %v", ids)
+	}
+	if ids[0].Keypair.Pub != alice.Keypair.Pub || ids[0].Channel != alice.Channel {
+		t.Error("alice's signing key was not kept")
+	}
+	if def, ok := reopened.Default(); !ok || def.Channel != bob.Channel {
+		t.Error("the default identity was not kept")
+	}
+	if !reopened.CanPost(alice.Channel, other) {
+		t.Error("a granted post key was not kept")
+	}
+	if keys := reopened.Keyring.ReadKeys(alice.Channel); len(keys) != 1 || keys[0] != meta.CurrentReadKey() {
+		t.Errorf("alice's read keys were not kept: %v", keys)
+	}
+	reply := reopened.Keyring.Keys(alice.Channel)
+	var replyKeys int
+	for _, k := range reply {
+		if k.Type == crypto.ReplyKey {
+			replyKeys++
+		}
+	}
+	if replyKeys != 1 {
+		t.Errorf("alice has %d reply keys, want 1", replyKeys)
+	}
+
+	// Changes made to the keyring directly are kept once saved
+	extra := crypto.NewSessionKey()
+	reopened.Keyring.AddReadKey(other, extra)
+	if err := reopened.Save(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := again.Keyring.ReadKeys(other); len(keys) != 1 || keys[0] != extra {
+		t.Errorf("saved read key was not kept: %v", keys)
+	}
+}
+
+func TestGrantRevoke(t *testing.T) {
+	n := New()
+	alice, err := n.AddIdentity("alice", newKeypair(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := newKeypair(t).ChannelID().String()
+	if n.CanPost(alice.Channel, channel) || n.CanManage(alice.Channel, channel) {
+		t.Fatal("identity may use a channel it was never granted")
+	}
+	if !n.CanManage(alice.Channel, alice.Channel) || !n.CanPost(alice.Channel, alice.Channel) {
+		t.Fatal("identity may not use its own channel")
+	}
+
+	if err := n.Grant(alice.Channel, channel, crypto.PostKey); err != nil {
+		t.Fatal(err)
+	}
+	if !n.CanPost(alice.Channel, channel) || n.CanManage(alice.Channel, channel) {
+		t.Error("post key grants the wrong rights")
+	}
+	if err := n.Grant(alice.Channel, channel, crypto.ManageKey); err != nil {
+		t.Fatal(err)
+	}
+	if !n.CanManage(alice.Channel, channel) {
+		t.Error("manage key was not granted")
+	}
+	if got := n.Channels(alice.Channel, crypto.ManageKey); len(got) != 2 {
+		t.Errorf("alice manages %v, want her own channel and the granted one", got)
+	}
+
+	if err := n.Revoke(alice.Channel, channel, crypto.ManageKey); err != nil {
+		t.Fatal(err)
+	}
+	if n.CanManage(alice.Channel, channel) || !n.CanPost(alice.Channel, channel) {
+		t.Error("revoking the manage key did not leave only the post key")
+	}
+	if err := n.Revoke(alice.Channel, channel, crypto.PostKey); err != nil {
+		t.Fatal(err)
+	}
+	if n.CanPost(alice.Channel, channel) {
+		t.Error("post key was not revoked")
+	}
+
+	stranger := newKeypair(t).ChannelID().String()
+	if err := n.Grant(stranger, channel, crypto.PostKey); err != ErrUnknownIdentity {
+		t.Errorf("granting to an unknown identity: got %v", err)
+	}
+	if err := n.Grant(alice.Channel, channel, crypto.ReadKey); err == nil {
+		t.Error("granted a read key as a signing key")
+	}
+}
+
+func TestRemoveIdentity(t *testing.T) {
+	dir := t.TempDir()
+	n, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _, err := n.CreateIdentity("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := n.AddIdentity("bob", newKeypair(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := newKeypair(t).ChannelID().String()
+	if err := n.Grant(alice.Channel, channel, crypto.PostKey); err != nil {
+		t.Fatal(err)
+	}
+	if def, _ := n.Default(); def.Channel != alice.Channel {
+		t.Fatal("the first identity is not the default")
+	}
+
+	if err := n.RemoveIdentity(alice.Channel); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := n.Identity(alice.Channel); ok {
+		t.Error("removed identity is still known")
+	}
+	if len(n.Keyring.Keys(alice.Channel)) != 0 {
+		t.Error("the keys of the removed identity's channel were kept")
+	}
+	if n.CanPost(alice.Channel, channel) || len(n.Keyring.Keys(channel)) != 0 {
+		t.Error("the rights granted to the removed identity were kept")
+	}
+	if def, ok := n.Default(); !ok || def.Channel != bob.Channel {
+		t.Error("the default identity was not reassigned")
+	}
+	if err := n.RemoveIdentity(alice.Channel); err != ErrUnknownIdentity {
+		t.Errorf("removing twice: got %v", err)
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := reopened.Identities(); len(ids) != 1 || ids[0].Channel != bob.Channel {
+		t.Errorf("reopened nym has identities %v", ids)
+	}
+	if def, ok := reopened.Default(); !ok || def.Channel != bob.Channel {
+		t.Error("the reassigned default identity was not saved")
+	}
+}
+
+func TestAuthor(t *testing.T) {
+	n := New()
+	if _, ok := n.Author("anything"); ok {
+		t.Fatal("a nym without identities chose an author")
+	}
+	alice, err := n.AddIdentity("alice", newKeypair(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := n.AddIdentity("bob", newKeypair(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := newKeypair(t).ChannelID().String()
+	if err := n.Grant(bob.Channel, channel, crypto.PostKey); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		channel string
+		want    string
+	}{
+		{"own channel of the default", alice.Channel, alice.Channel},
+		{"own channel of another identity", bob.Channel, bob.Channel},
+		{"channel another identity may post to", channel, bob.Channel},
+		{"channel no identity may post to", newKeypair(t).ChannelID().String(), alice.Channel},
+	}
+	for _, tt := range tests {
+		if id, ok := n.Author(tt.channel); !ok || id.Channel != tt.want {
+			t.Errorf("%s: got %v", tt.name, id)
+		}
+	}
+	if err := n.SetDefault(bob.Channel); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := n.Author(alice.Channel); id.Channel != alice.Channel {
+		t.Error("the default was chosen for a channel it may not post to")
+	}
+	if err := n.SetDefault(channel); err != ErrUnknownIdentity {
+		t.Errorf("setting an unknown default: got %v", err)
+	}
+}
+
+func TestConcurrentChanges(t *testing.T) {
+	n, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, err := n.AddIdentity("alice", newKeypair(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		channel := newKeypair(t).ChannelID().String()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.Grant(alice.Channel, channel, crypto.PostKey); err != nil {
+				t.Error(err)
+			}
+			if err := n.Save(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := n.Channels(alice.Channel, crypto.PostKey); len(got) != 9 {
+		t.Errorf("alice may post to %d channels, want her own and the 8 granted ones", len(got))
+	}
+}
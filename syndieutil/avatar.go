@@ -0,0 +1,111 @@
+package syndieutil
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// ValidateAvatar checks that data is a PNG of at most 32x32 pixels within maxSize bytes.  Only
+// the PNG header is read, so no pixel data is decoded.
+func ValidateAvatar(data []byte, maxSize int) error {
+	if len(data) > maxSize {
+		return fmt.Errorf("avatar: %d bytes exceeds the limit of %d", len(data), maxSize)
+	}
+	if !bytes.HasPrefix(data, pngSignature) {
+		return errors.New("avatar: not a PNG image")
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("avatar: %s", err)
+	}
+	if cfg.Width < 1 || cfg.Height < 1 || cfg.Width > avatarDimension || cfg.Height > avatarDimension {
+		return fmt.Errorf("avatar: %dx%d is not within %dx%d", cfg.Width, cfg.Height, avatarDimension, avatarDimension)
+	}
+	return nil
+}
+
+// AvatarImage decodes the avatar of the message, returning nil if it has none.  The avatar was
+// validated when the message was parsed, and its pixels are only decoded here.
+func (m Message) AvatarImage() (image.Image, error) {
+	if len(m.Avatar) == 0 {
+		return nil, nil
+	}
+	return DecodeAvatar(m.Avatar, len(m.Avatar))
+}
+
+// EncodeAvatar scales an image down to fit within 32x32 pixels, keeping its aspect ratio,
+// and encodes it as a valid avatar32.png
+func EncodeAvatar(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	if b.Empty() {
+		return nil, errors.New("avatar: empty image")
+	}
+	w, h := b.Dx(), b.Dy()
+	if w > avatarDimension || h > avatarDimension {
+		if w >= h {
+			w, h = avatarDimension, atLeast(1, h*avatarDimension/w)
+		} else {
+			w, h = atLeast(1, w*avatarDimension/h), avatarDimension
+		}
+		img = scale(img, w, h)
+	}
+	var buf bytes.Buffer
+	enc := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := enc.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	if err := ValidateAvatar(buf.Bytes(), DefaultMaxAvatarSize); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// DecodeAvatar validates an avatar32.png as ValidateAvatar does and decodes it.  The size and
+// dimensions are checked before any pixel data is decoded.
+func DecodeAvatar(data []byte, maxSize int) (image.Image, error) {
+	if err := ValidateAvatar(data, maxSize); err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("avatar: %s", err)
+	}
+	return img, nil
+}
+
+// scale resizes img to w by h pixels by averaging the source pixels covered by each destination pixel
+func scale(img image.Image, w, h int) image.Image {
+	src := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := src.Min.Y + y*src.Dy()/h
+		y1 := atLeast(y0+1, src.Min.Y+(y+1)*src.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := src.Min.X + x*src.Dx()/w
+			x1 := atLeast(x0+1, src.Min.X+(x+1)*src.Dx()/w)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := img.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+			dst.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+func atLeast(min, n int) int {
+	if n < min {
+		return min
+	}
+	return n
+}
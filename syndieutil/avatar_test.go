@@ -0,0 +1,119 @@
+package syndieutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 0x80, A: 0xff})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// padPNG adds a tEXt chunk of n bytes after the IHDR chunk, growing the file without changing the image
+func padPNG(data []byte, n int) []byte {
+	chunk := make([]byte, 8, 12+n)
+	binary.BigEndian.PutUint32(chunk, uint32(n))
+	copy(chunk[4:], "tEXt")
+	chunk = append(chunk, "pad\x00"...)
+	chunk = append(chunk, bytes.Repeat([]byte{'x'}, n-4)...)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], crc32.ChecksumIEEE(chunk[4:]))
+	chunk = append(chunk, crc[:]...)
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	out := append([]byte(nil), data[:ihdrEnd]...)
+	out = append(out, chunk...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func TestValidateAvatar(t *testing.T) {
+	small := encodePNG(t, 32, 32)
+	if err := ValidateAvatar(small, DefaultMaxAvatarSize); err != nil {
+		t.Fatal(err)
+	}
+	if img, err := DecodeAvatar(small, DefaultMaxAvatarSize); err != nil || img.Bounds().Dx() != 32 {
+		t.Fatalf("decoding a valid avatar: %v", err)
+	}
+	tests := map[string][]byte{
+		"too wide":     encodePNG(t, 33, 8),
+		"too tall":     encodePNG(t, 8, 33),
+		"not a PNG":    []byte("GIF89a"),
+		"truncated":    small[:len(pngSignature)+10],
+		"too large":    padPNG(small, DefaultMaxAvatarSize),
+		"empty":        nil,
+		"corrupt IHDR": append(append([]byte(nil), small[:16]...), 0, 0, 0, 0, 0, 0, 0, 0),
+	}
+	for name, data := range tests {
+		if err := ValidateAvatar(data, DefaultMaxAvatarSize); err == nil {
+			t.Errorf("%s: avatar accepted", name)
+		}
+	}
+}
+
+func TestEncodeAvatarScales(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 50))
+	data, err := EncodeAvatar(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeAvatar(data, DefaultMaxAvatarSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := decoded.Bounds(); b.Dx() != 32 || b.Dy() != 16 {
+		t.Errorf("scaled to %dx%d, want 32x16", b.Dx(), b.Dy())
+	}
+}
+
+func TestAvatarSizeLimits(t *testing.T) {
+	large := padPNG(encodePNG(t, 32, 32), 2*DefaultMaxAvatarSize)
+	if err := NewPostBuilder().AddPage("text/plain", "", "x").SetAvatar(large).err; err == nil {
+		t.Fatal("builder accepted an avatar over its default limit")
+	}
+	b := NewPostBuilder()
+	b.MaxAvatarSize = 4 * DefaultMaxAvatarSize
+	body, err := b.AddPage("text/plain", "", "x").SetAvatar(large).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := crypto.NewSessionKey()
+	var raw bytes.Buffer
+	if err := New(MessageType("post"), BodyKey(key)).Marshal(&raw, body, key, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := NewDecoder().Decode(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Message().Avatar) != 0 {
+		t.Error("default decoder kept an avatar over its limit")
+	}
+	m, err = NewDecoder(MaxAvatarSize(b.MaxAvatarSize)).Decode(bytes.NewReader(raw.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(m.Message().Avatar, large) {
+		t.Fatal("decoder with the builder's limit dropped the avatar")
+	}
+	if img, err := m.Message().AvatarImage(); err != nil || img.Bounds().Dx() != 32 {
+		t.Errorf("decoding the avatar lazily: %v", err)
+	}
+}
@@ -20,48 +20,115 @@ const syndieMessage = "Syndie.Message.1."
 const invalidMessage = "invalid message"
 const limit = 1024
 
+// The payload holds a 16 byte IV and a 32 byte HMAC around at least one block of ciphertext,
+// which is bounded by the limits placed on the zip's contents
+const minPayloadSize = ivSize + aes.BlockSize + hmacSize
+const maxPayloadSize = 2 * DefaultMaxZipTotalSize
+
+// Errors returned by Unmarshal for messages that cannot be decrypted or whose HMAC does not match
+var (
+	ErrNoKey   = errors.New("no key available to decrypt the message")
+	ErrBadHMAC = errors.New("unable to verify HMAC")
+)
+
+// decodeState holds what is needed while decoding a single message into a Header
+type decodeState struct {
+	h                *Header
+	keys             KeyResolver
+	maxPayloadSize   int
+	maxHeaderLines   int
+	limits           messageLimits
+	reader           *bufio.Reader
+	state            state
+	err              error
+	iv               []byte
+	ciphertext       []byte
+	mac              []byte
+	plain            []byte
+	zipped           []byte
+	totalPayloadSize int
+	msg              *Message
+	signature        []byte
+	sigs             Signatures
+	raw              *bytes.Buffer
+	key              []byte
+}
+
+type state int
+
+const (
+	readMagicVersionLine state = iota
+	readHeaderKeyPairs
+	readSizeLine
+	readPayload
+	decrypt
+	readBody
+	readZippedPayload
+	readSignature
+	parseSignatures
+	invalid
+)
+
+// Unmarshal decodes a message into the header.  A Header can only be decoded into once and
+// keeps no signatures, so use a Decoder to decode many messages, to try read keys for messages
+// without a BodyKey or to check who signed a message.
 func (h *Header) Unmarshal(r io.Reader) (*Message, error) {
-	h.reader = bufio.NewReader(r)
+	d := &decodeState{h: h, maxPayloadSize: maxPayloadSize, maxHeaderLines: limit, limits: defaultMessageLimits()}
+	return d.decode(r)
+}
+
+// learnReadKeys remembers the read keys metadata hands out to readers of its channel.  Only
+// metadata signed by the channel's own identity is trusted to speak for the channel.
+func learnReadKeys(k readKeyAdder, h *Header, sigs Signatures) {
+	if !h.IsMeta() || !sigs.VerifyAuthorization(h.Identity) {
+		return
+	}
+	for _, key := range h.ChannelReadKeys {
+		k.AddReadKey(h.ChannelHash(), key)
+	}
+}
+
+func (d *decodeState) decode(r io.Reader) (*Message, error) {
+	d.raw = new(bytes.Buffer)
+	d.reader = bufio.NewReader(io.TeeReader(r, d.raw))
 	for state := 0; state < int(invalid); state++ {
-		err := h.next()
-		if err != nil || h.err != nil {
+		err := d.next()
+		if err != nil || d.err != nil {
 			return nil, err
 		}
-		h.state++
+		d.state++
 	}
-	return h.msg, nil
+	return d.msg, nil
 }
 
-func (h *Header) next() (err error) {
-	switch h.state {
+func (d *decodeState) next() (err error) {
+	switch d.state {
 	case readMagicVersionLine:
-		h.err = h.readMagicVersionLine()
+		d.err = d.readMagicVersionLine()
 	case readHeaderKeyPairs:
-		h.err = h.readHeaderKeyPairs()
+		d.err = d.readHeaderKeyPairs()
 	case readSizeLine:
-		h.err = h.readSizeLine()
-	case readIV:
-		h.err = h.readIV()
+		d.err = d.readSizeLine()
+	case readPayload:
+		d.err = d.readPayload()
 	case decrypt:
-		h.err = h.decrypt()
-	case readInternalPayloadSize:
-		h.err = h.readInternalPayloadSize()
-	case readInternalTotalSize:
-		h.err = h.readInternalTotalSize()
+		d.err = d.decrypt()
+	case readBody:
+		d.err = d.readBody()
 	case readZippedPayload:
-		h.err = h.readZippedPayload()
+		d.err = d.readZippedPayload()
 	case readSignature:
-		h.err = h.readSignature()
-	case verifyHMAC:
-		h.err = h.verifyHMAC()
+		d.err = d.readSignature()
+	case parseSignatures:
+		d.err = d.parseSignatures()
 	case invalid:
-		h.err = errors.New(invalidMessage)
+		d.err = errors.New(invalidMessage)
 	}
-	return h.err
+	return d.err
 }
 
-func (h *Header) readMagicVersionLine() error {
-	line, err := h.reader.ReadString('\n')
+func (d *decodeState) readMagicVersionLine() error {
+	line, err := d.reader.ReadString('\n')
 	if err != nil {
 		return err
 	}
@@ -72,13 +139,13 @@ func (h *Header) readMagicVersionLine() error {
 	return nil
 }
 
-func (h *Header) readHeaderKeyPairs() error {
+func (d *decodeState) readHeaderKeyPairs() error {
 	var counter int
 	for {
-		if counter > limit {
+		if counter > d.maxHeaderLines {
 			return errors.New(invalidMessage)
 		}
-		line, err := h.reader.ReadString('\n')
+		line, err := d.reader.ReadString('\n')
 		line = strings.TrimSpace(line)
 		if err != nil {
 			return err
@@ -86,14 +153,14 @@ func (h *Header) readHeaderKeyPairs() error {
 		if len(line) == 0 {
 			break
 		}
-		h.ReadLine(line)
+		d.h.ReadLine(line)
 		counter++
 	}
 	return nil
 }
 
-func (h *Header) readSizeLine() error {
-	line, err := h.reader.ReadString('\n')
+func (d *decodeState) readSizeLine() error {
+	line, err := d.reader.ReadString('\n')
 	if err != nil {
 		return errors.New(invalidMessage)
 	}
@@ -105,113 +172,115 @@ func (h *Header) readSizeLine() error {
 	if err != nil {
 		return err
 	}
-	h.totalPayloadSize = size
+	if size < minPayloadSize || size > d.maxPayloadSize {
+		return errors.New(invalidMessage + ": payload size out of range")
+	}
+	d.totalPayloadSize = size
 	return nil
 }
 
-func (h *Header) decrypt() error {
-	decrypted := make([]byte, h.totalPayloadSize)
-	payload := make([]byte, h.totalPayloadSize)
-	io.ReadFull(h.reader, payload)
-	privKey, err := base64.I2PEncoding.DecodeString(h.BodyKey)
+func (d *decodeState) readPayload() error {
+	// Read without trusting Size for the allocation, so a short message costs only what it holds
+	payload, err := io.ReadAll(io.LimitReader(d.reader, int64(d.totalPayloadSize)))
+	if err != nil || len(payload) != d.totalPayloadSize {
+		return errors.New(invalidMessage + ": truncated payload")
+	}
+	d.iv, d.ciphertext, d.mac, err = splitPayload(payload)
+	return err
+}
+
+func (d *decodeState) decrypt() error {
+	key, err := d.bodyKey()
 	if err != nil {
-		return errors.New("error decoding: " + err.Error())
+		return err
 	}
-	if h.totalPayloadSize%aes.BlockSize != 0 {
-		return errors.New("ciphertext is not a multiple of the block size")
+	// Nothing is decrypted until the HMAC shows the payload is intact
+	if !d.hmacMatches(key) {
+		return ErrBadHMAC
 	}
-	block, err := aes.NewCipher([]byte(privKey))
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return errors.New("error initializing NewCipher: %s" + err.Error())
+		return errors.New("error initializing NewCipher: " + err.Error())
 	}
-	decrypter := cipher.NewCBCDecrypter(block, h.iv)
-	decrypter.CryptBlocks(decrypted, payload)
-	h.encryptedPayload = payload
-	h.enclosedReader = bytes.NewReader(decrypted)
+	d.plain = make([]byte, len(d.ciphertext))
+	cipher.NewCBCDecrypter(block, d.iv).CryptBlocks(d.plain, d.ciphertext)
+	d.key = key
 	return nil
 }
 
-func (h *Header) readInternalPayloadSize() error {
-	var counter int
-	zero := make([]byte, 1)
-	for {
-		if counter > limit {
-			return errors.New(invalidMessage)
-		}
-		_, err := h.enclosedReader.Read(zero)
+// bodyKey returns the BodyKey if the message has one, and otherwise tries every read key
+// in the keyring for the target channel until one matches the HMAC of the payload
+func (d *decodeState) bodyKey() ([]byte, error) {
+	if d.h.BodyKey != "" {
+		key, err := base64.I2PEncoding.DecodeString(d.h.BodyKey)
 		if err != nil {
-			return errors.New(invalidMessage)
+			return nil, errors.New("error decoding: " + err.Error())
 		}
-		if bytes.Equal(zero, []byte{0x0}) {
-			h.internalPayloadSize = readInt(h.enclosedReader)
-			return nil
-		}
-		counter++
+		return key, nil
 	}
-}
-
-func (h *Header) readInternalTotalSize() error {
-	internalTotalSize := readInt(h.enclosedReader)
-	if h.totalPayloadSize != internalTotalSize+len(h.iv) {
-		return errors.New(invalidMessage)
+	if d.keys != nil {
+		for _, readKey := range d.keys.ReadKeys(d.h.TargetChannelHash()) {
+			key, err := base64.I2PEncoding.DecodeString(readKey)
+			if err != nil {
+				continue
+			}
+			if d.hmacMatches(key) {
+				return key, nil
+			}
+		}
 	}
-	return nil
+	return nil, ErrNoKey
 }
 
-func (h *Header) readIV() error {
-	iv, err := h.reader.Peek(16)
-	h.iv = iv
+func (d *decodeState) readBody() error {
+	zipped, err := openBody(d.plain)
+	d.zipped = zipped
 	return err
 }
 
-func (h *Header) readZippedPayload() error {
-	var payload = make([]byte, h.internalPayloadSize)
-	io.ReadFull(h.enclosedReader, payload)
-	zr, err := zip.NewReader(bytes.NewReader(payload), int64(h.internalPayloadSize))
+func (d *decodeState) readZippedPayload() error {
+	zr, err := zip.NewReader(bytes.NewReader(d.zipped), int64(len(d.zipped)))
 	if err != nil {
 		return err
 	}
-	m, err := h.ParseMessage(zr)
+	m, err := d.h.parseMessage(zr, d.limits)
 	if err != nil {
 		return err
 	}
-	h.msg = &m
+	d.msg = &m
 	return nil
 }
 
-func (h *Header) readSignature() error {
+func (d *decodeState) readSignature() error {
 	var err error
-	h.signature, err = io.ReadAll(h.reader)
-	return err
+	d.signature, err = io.ReadAll(d.reader)
+	if err != nil {
+		return err
+	}
+	// Signatures cover everything up to the signature lines themselves
+	signed := sha256.Sum256(d.raw.Bytes()[:d.raw.Len()-len(d.signature)])
+	d.sigs.hash = signed[:]
+	return nil
 }
 
-func (h *Header) verifyHMAC() error {
-	scanner := bufio.NewScanner(bytes.NewBuffer(h.signature))
+func (d *decodeState) parseSignatures() error {
+	scanner := bufio.NewScanner(bytes.NewBuffer(d.signature))
 	scanner.Scan()
-	// TODO: check authorization
 	authorizationSig, err := value(scanner.Text())
-	_ = authorizationSig
 	if err != nil {
 		return errors.New("invalid signature")
 	}
+	d.sigs.authorization, _ = base64.I2PEncoding.DecodeString(authorizationSig)
 	scanner.Scan()
-	// TODO: check authentication
 	authenticationSig, err := value(scanner.Text())
 	if err != nil {
 		return errors.New("invalid signature")
 	}
-	_ = authenticationSig
-	// check the hmac
-	var hmacPreKey bytes.Buffer
-	k, _ := base64.I2PEncoding.DecodeString(h.BodyKey)
-	hmacPreKey.Write(k)
-	hmacPreKey.Write(h.iv)
-	sha := sha256.New()
-	sha.Write(hmacPreKey.Bytes())
-	hm := hmac.New(sha256.New, sha.Sum(nil))
-	hm.Write(h.encryptedPayload[16 : len(h.encryptedPayload)-32])
-	if !hmac.Equal(hm.Sum(nil), h.encryptedPayload[len(h.encryptedPayload)-32:]) {
-		return errors.New("unable to verify HMAC")
-	}
+	d.sigs.authentication, _ = base64.I2PEncoding.DecodeString(authenticationSig)
+	d.sigs.mask = d.h.AuthenticationMask
 	return nil
 }
+
+func (d *decodeState) hmacMatches(key []byte) bool {
+	return hmac.Equal(bodyHMAC(key, d.iv, d.ciphertext), d.mac)
+}
@@ -0,0 +1,140 @@
+package syndieutil
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// DecodeResult is the outcome of decoding one message of a stream
+type DecodeResult struct {
+	// Index is the position of the message in the stream, counting from zero
+	Index   int
+	Raw     []byte
+	Message *DecodedMessage
+	Err     error
+}
+
+// DecodeStats describes the work done by DecodeStream
+type DecodeStats struct {
+	Decoded int
+	Failed  int
+	Bytes   int64
+	Elapsed time.Duration
+}
+
+// MessagesPerSecond returns the number of messages, decoded or not, handled per second
+func (s DecodeStats) MessagesPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Decoded+s.Failed) / s.Elapsed.Seconds()
+}
+
+// BytesPerSecond returns the number of raw message bytes handled per second
+func (s DecodeStats) BytesPerSecond() float64 {
+	if s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.Bytes) / s.Elapsed.Seconds()
+}
+
+// DecodeStream decodes the raw messages received from in across a pool of workers goroutines,
+// or one per CPU if workers is not positive, and sends a DecodeResult for each to out.  Results
+// are sent as they are ready, so they may arrive out of order.  It returns once in is closed
+// and every result has been sent, or once ctx is done, in which case messages still waiting
+// are dropped and ctx.Err() is returned.  out is not closed.
+func (d *Decoder) DecodeStream(ctx context.Context, workers int, in <-chan []byte, out chan<- DecodeResult) (DecodeStats, error) {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	type job struct {
+		index int
+		raw   []byte
+	}
+	start := time.Now()
+	jobs := make(chan job)
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		stats DecodeStats
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				m, err := d.Decode(bytes.NewReader(j.raw))
+				mu.Lock()
+				if err != nil {
+					stats.Failed++
+				} else {
+					stats.Decoded++
+				}
+				stats.Bytes += int64(len(j.raw))
+				mu.Unlock()
+				select {
+				case out <- DecodeResult{Index: j.index, Raw: j.raw, Message: m, Err: err}:
+				case <-ctx.Done():
+				}
+			}
+		}()
+	}
+
+	var index int
+feed:
+	for {
+		select {
+		case raw, ok := <-in:
+			if !ok {
+				break feed
+			}
+			select {
+			case jobs <- job{index: index, raw: raw}:
+				index++
+			case <-ctx.Done():
+				break feed
+			}
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	stats.Elapsed = time.Since(start)
+	return stats, ctx.Err()
+}
+
+// DecodeAll decodes messages across a pool of workers as DecodeStream does, returning their
+// results in the order of the messages
+func (d *Decoder) DecodeAll(ctx context.Context, workers int, raws [][]byte) ([]DecodeResult, DecodeStats, error) {
+	in := make(chan []byte)
+	out := make(chan DecodeResult)
+	go func() {
+		defer close(in)
+		for _, raw := range raws {
+			select {
+			case in <- raw:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	results := make([]DecodeResult, len(raws))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for r := range out {
+			results[r.Index] = r
+		}
+	}()
+	stats, err := d.DecodeStream(ctx, workers, in, out)
+	close(out)
+	<-done
+	if err != nil {
+		return nil, stats, err
+	}
+	return results, stats, nil
+}
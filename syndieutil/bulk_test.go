@@ -0,0 +1,95 @@
+package syndieutil
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestDecodeAll(t *testing.T) {
+	_, meta, posts := testChannel(t, 16)
+	raws := append([][]byte{meta, []byte("not a message")}, posts...)
+	d := NewDecoder()
+	results, stats, err := d.DecodeAll(context.Background(), 4, raws)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(raws) {
+		t.Fatalf("got %d results for %d messages", len(results), len(raws))
+	}
+	var failed int
+	for i, r := range results {
+		if r.Index != i || !bytes.Equal(r.Raw, raws[i]) {
+			t.Fatalf("result %d is out of order", i)
+		}
+		_, err := d.Decode(bytes.NewReader(raws[i]))
+		if (err == nil) != (r.Err == nil) {
+			t.Errorf("message %d: Decode returned %v but DecodeAll returned %v", i, err, r.Err)
+		}
+		if r.Err != nil {
+			failed++
+		} else if r.Message == nil {
+			t.Errorf("message %d has neither a result nor an error", i)
+		}
+	}
+	if results[1].Err == nil {
+		t.Error("garbage decoded without an error")
+	}
+	if stats.Failed != failed || stats.Decoded != len(raws)-failed {
+		t.Errorf("stats report %d decoded and %d failed, want %d and %d", stats.Decoded, stats.Failed, len(raws)-failed, failed)
+	}
+}
+
+func TestDecodeStreamCancel(t *testing.T) {
+	_, _, posts := testChannel(t, 4)
+	ctx, cancel := context.WithCancel(context.Background())
+	in := make(chan []byte)
+	out := make(chan DecodeResult)
+	errc := make(chan error, 1)
+	go func() {
+		_, err := NewDecoder().DecodeStream(ctx, 2, in, out)
+		errc <- err
+	}()
+	in <- posts[0]
+	<-out
+	// Nobody reads the next result, so only cancelling lets DecodeStream return
+	in <- posts[1]
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Errorf("DecodeStream returned %v, want context.Canceled", err)
+	}
+}
+
+// benchmarkMessages returns a channel's metadata and posts, and a Decoder checking the posts
+// against the metadata so that their signatures are verified as during a sync
+func benchmarkMessages(b *testing.B) ([][]byte, *Decoder) {
+	_, meta, posts := testChannel(b, 64)
+	h := New()
+	if _, err := h.Unmarshal(bytes.NewReader(meta)); err != nil {
+		b.Fatalf("decoding metadata: %s", err)
+	}
+	d := NewDecoder(MetadataResolver(func(string) *Header { return h }))
+	return append([][]byte{meta}, posts...), d
+}
+
+func BenchmarkDecodeSingle(b *testing.B) {
+	raws, d := benchmarkMessages(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, raw := range raws {
+			d.Decode(bytes.NewReader(raw))
+		}
+	}
+	b.ReportMetric(float64(b.N*len(raws))/b.Elapsed().Seconds(), "msgs/s")
+}
+
+func BenchmarkDecodeParallel(b *testing.B) {
+	raws, d := benchmarkMessages(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := d.DecodeAll(context.Background(), 0, raws); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(raws))/b.Elapsed().Seconds(), "msgs/s")
+}
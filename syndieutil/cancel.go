@@ -0,0 +1,109 @@
+package syndieutil
+
+import "github.com/kpetku/libsyndie/crypto"
+
+// IsMeta reports whether the header belongs to a channel metadata message
+func (h *Header) IsMeta() bool {
+	return h.MessageType == "meta"
+}
+
+// ChannelHash returns the hash of the channel a message was posted in, or for metadata
+// messages the hash of the channel they describe
+func (h *Header) ChannelHash() string {
+	if h.IsMeta() {
+		hash, err := ChanHash(h.Identity)
+		if err != nil {
+			return ""
+		}
+		return hash
+	}
+	return canonicalHash(h.PostURI.Channel)
+}
+
+// ChannelID returns the ChannelID of the channel ChannelHash names, if it is a valid one
+func (h *Header) ChannelID() (crypto.ChannelID, bool) {
+	id, err := crypto.ParseChannelID(h.ChannelHash())
+	return id, err == nil
+}
+
+// TargetChannelID returns the ChannelID of the channel TargetChannelHash names, if it is a valid one
+func (h *Header) TargetChannelID() (crypto.ChannelID, bool) {
+	id, err := crypto.ParseChannelID(h.TargetChannelHash())
+	return id, err == nil
+}
+
+// AuthorID returns the ChannelID of the channel AuthorHash names, if it is a valid one
+func (h *Header) AuthorID() (crypto.ChannelID, bool) {
+	id, err := crypto.ParseChannelID(h.AuthorHash())
+	return id, err == nil
+}
+
+// canonicalHash rewrites a channel hash the way ChannelID.String writes it, so that hashes
+// written differently by other clients still match.  Invalid hashes are returned unchanged.
+func canonicalHash(hash string) string {
+	if id, err := crypto.ParseChannelID(hash); err == nil {
+		return id.String()
+	}
+	return hash
+}
+
+// TargetChannelHash returns the hash of the channel a message is addressed to, which is
+// the channel it was posted in unless a TargetChannel header is present
+func (h *Header) TargetChannelHash() string {
+	if h.TargetChannel != "" {
+		return canonicalHash(h.TargetChannel)
+	}
+	return h.ChannelHash()
+}
+
+// AuthorHash returns the channel hash of the message author, which defaults to the
+// channel the message was posted in when no Author header is present
+func (h *Header) AuthorHash() string {
+	if h.Author != "" {
+		return canonicalHash(h.Author)
+	}
+	return h.ChannelHash()
+}
+
+// ManagedBy reports whether the channel described by the metadata header h lists
+// the author hash as its owner or one of its managers
+func (h *Header) ManagedBy(author string) bool {
+	if author == "" {
+		return false
+	}
+	keys := append([]string{h.Identity}, h.ManagerKeys...)
+	for _, key := range keys {
+		hash, err := ChanHash(key)
+		if err == nil && hash == author {
+			return true
+		}
+	}
+	return false
+}
+
+// MayModify reports whether the issuer of a Cancel or OverwriteURI, whose signatures are issuer,
+// may act on target.  The issuer must have signed with the key of the target's author or of a manager of the target's channel.
+// meta is the current metadata header of the target's channel and authorKey the public signing
+// key of the target's author, either of which may be empty if unknown.
+func MayModify(issuer Signatures, target, meta *Header, authorKey string) bool {
+	author := target.AuthorHash()
+	var keys []string
+	if hash, err := ChanHash(authorKey); err == nil && hash == author {
+		keys = append(keys, authorKey)
+	}
+	if meta != nil {
+		keys = append(keys, meta.Identity)
+		keys = append(keys, meta.ManagerKeys...)
+		for _, key := range meta.AuthorizedKeys {
+			if hash, err := ChanHash(key); err == nil && hash == author {
+				keys = append(keys, key)
+			}
+		}
+	}
+	for _, key := range keys {
+		if issuer.VerifyAuthorization(key) || issuer.VerifyAuthentication(key) {
+			return true
+		}
+	}
+	return false
+}
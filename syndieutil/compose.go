@@ -0,0 +1,255 @@
+package syndieutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Default limits applied by a PostBuilder
+const (
+	DefaultMaxPageSize       = 256 * 1024
+	DefaultMaxAttachmentSize = 1024 * 1024
+	DefaultMaxPostSize       = 4 * 1024 * 1024
+	DefaultMaxAvatarSize     = 32 * 1024
+	avatarDimension          = 32
+)
+
+// PostBuilder assembles the pages, attachments, avatar, references and tags of a post and
+// serializes them into the zip layout read by ParseMessage
+type PostBuilder struct {
+	MaxPageSize       int
+	MaxAttachmentSize int
+	MaxPostSize       int
+	MaxAvatarSize     int
+
+	header      *Header
+	pages       []Page
+	attachments []Attachment
+	avatar      []byte
+	references  []*ReferenceNode
+	err         error
+}
+
+// NewPostBuilder creates a new PostBuilder and accepts a list of Header option functions
+// for the headers stored inside the post
+func NewPostBuilder(opts ...func(*Header)) *PostBuilder {
+	return &PostBuilder{
+		MaxPageSize:       DefaultMaxPageSize,
+		MaxAttachmentSize: DefaultMaxAttachmentSize,
+		MaxPostSize:       DefaultMaxPostSize,
+		MaxAvatarSize:     DefaultMaxAvatarSize,
+		header:            New(opts...),
+	}
+}
+
+// Header returns the headers stored inside the post
+func (b *PostBuilder) Header() *Header {
+	return b.header
+}
+
+// AddPage adds a text/plain or text/html page with an optional title
+func (b *PostBuilder) AddPage(contentType, title, data string) *PostBuilder {
+	switch contentType {
+	case "text/plain", "text/html":
+	default:
+		return b.fail(fmt.Errorf("page %d: unsupported content type %s", len(b.pages), contentType))
+	}
+	if len(data) > b.MaxPageSize {
+		return b.fail(fmt.Errorf("page %d: %d bytes exceeds the limit of %d", len(b.pages), len(data), b.MaxPageSize))
+	}
+	b.pages = append(b.pages, Page{ContentType: contentType, Title: title, Data: data})
+	return b
+}
+
+// AddPageReference adds a node to the reference tree of the page added last
+func (b *PostBuilder) AddPageReference(n *ReferenceNode) *PostBuilder {
+	if len(b.pages) == 0 {
+		return b.fail(errors.New("page reference added before any page"))
+	}
+	p := &b.pages[len(b.pages)-1]
+	p.References = append(p.References, n)
+	return b
+}
+
+// AddAttachment adds an attachment whose data is read from r
+func (b *PostBuilder) AddAttachment(name, contentType, description string, r io.Reader) *PostBuilder {
+	data, err := io.ReadAll(io.LimitReader(r, int64(b.MaxAttachmentSize)+1))
+	if err != nil {
+		return b.fail(fmt.Errorf("attachment %s: %s", name, err))
+	}
+	if len(data) > b.MaxAttachmentSize {
+		return b.fail(fmt.Errorf("attachment %s: exceeds the limit of %d bytes", name, b.MaxAttachmentSize))
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	b.attachments = append(b.attachments, Attachment{
+		Name:        name,
+		ContentType: contentType,
+		Description: description,
+		Data:        data,
+	})
+	return b
+}
+
+// SetAvatar sets the avatar32.png of the post, which must be a PNG of at most 32x32 pixels
+func (b *PostBuilder) SetAvatar(data []byte) *PostBuilder {
+	if err := ValidateAvatar(data, b.MaxAvatarSize); err != nil {
+		return b.fail(err)
+	}
+	b.avatar = data
+	return b
+}
+
+// SetAvatarImage scales an image to fit within 32x32 pixels and sets it as the avatar of the post
+func (b *PostBuilder) SetAvatarImage(img image.Image) *PostBuilder {
+	data, err := EncodeAvatar(img)
+	if err != nil {
+		return b.fail(err)
+	}
+	return b.SetAvatar(data)
+}
+
+// AddReference adds a node to the references.cfg tree of the post
+func (b *PostBuilder) AddReference(n *ReferenceNode) *PostBuilder {
+	b.references = append(b.references, n)
+	return b
+}
+
+// AddTag adds a tag to the Tags header of the post
+func (b *PostBuilder) AddTag(tag string) *PostBuilder {
+	tag = strings.TrimSpace(tag)
+	if tag == "" || strings.ContainsAny(tag, " \t\r\n") {
+		return b.fail(fmt.Errorf("invalid tag %q", tag))
+	}
+	b.header.Tags = append(b.header.Tags, tag)
+	return b
+}
+
+// Message returns the post as the Message that ParseMessage would produce
+func (b *PostBuilder) Message() (Message, error) {
+	if err := b.validate(); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		Page:       append([]Page(nil), b.pages...),
+		Attachment: append([]Attachment(nil), b.attachments...),
+		Avatar:     b.avatar,
+		References: b.references,
+	}, nil
+}
+
+// Build serializes the post into a zip containing headers.dat, pageN.cfg and pageN.dat,
+// attachN.cfg and attachN.dat, avatar32.png and references.cfg
+func (b *PostBuilder) Build() ([]byte, error) {
+	if err := b.validate(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	add := func(name string, data []byte) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	if err := add(headersFile, []byte(b.header.String())); err != nil {
+		return nil, err
+	}
+	for i, p := range b.pages {
+		var cfg strings.Builder
+		cfg.WriteString("Content-type=" + p.ContentType + newLine)
+		if p.Title != "" {
+			cfg.WriteString("Title=" + stripLine(p.Title) + newLine)
+		}
+		if len(p.References) > 0 {
+			var refs bytes.Buffer
+			if err := WriteReferences(&refs, p.References); err != nil {
+				return nil, err
+			}
+			for _, line := range strings.Split(strings.TrimSuffix(refs.String(), newLine), newLine) {
+				cfg.WriteString("References=" + line + newLine)
+			}
+		}
+		n := strconv.Itoa(i)
+		if err := add(pagePrefix+n+".cfg", []byte(cfg.String())); err != nil {
+			return nil, err
+		}
+		if err := add(pagePrefix+n+".dat", []byte(p.Data)); err != nil {
+			return nil, err
+		}
+	}
+	for i, a := range b.attachments {
+		var cfg strings.Builder
+		cfg.WriteString("Name=" + stripLine(a.Name) + newLine)
+		cfg.WriteString("Content-type=" + stripLine(a.ContentType) + newLine)
+		if a.Description != "" {
+			cfg.WriteString("Description=" + stripLine(a.Description) + newLine)
+		}
+		n := strconv.Itoa(i)
+		if err := add(attachPrefix+n+".cfg", []byte(cfg.String())); err != nil {
+			return nil, err
+		}
+		if err := add(attachPrefix+n+".dat", a.Data); err != nil {
+			return nil, err
+		}
+	}
+	if b.avatar != nil {
+		if err := add(avatarFile, b.avatar); err != nil {
+			return nil, err
+		}
+	}
+	if len(b.references) > 0 {
+		var refs bytes.Buffer
+		if err := WriteReferences(&refs, b.references); err != nil {
+			return nil, err
+		}
+		if err := add(referencesFile, refs.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (b *PostBuilder) validate() error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.pages) == 0 && len(b.attachments) == 0 {
+		return errors.New("post has no pages or attachments")
+	}
+	total := len(b.avatar)
+	for _, p := range b.pages {
+		total += len(p.Data)
+	}
+	for _, a := range b.attachments {
+		total += len(a.Data)
+	}
+	if total > b.MaxPostSize {
+		return fmt.Errorf("post is %d bytes which exceeds the limit of %d", total, b.MaxPostSize)
+	}
+	return nil
+}
+
+// fail records the first error so the builder calls can be chained
+func (b *PostBuilder) fail(err error) *PostBuilder {
+	if b.err == nil {
+		b.err = err
+	}
+	return b
+}
+
+func stripLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
@@ -0,0 +1,277 @@
+package syndieutil
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+// ErrUnauthorized is returned by a Decoder for messages its VerifyPolicy refuses
+var ErrUnauthorized = errors.New("message not authorized")
+
+// KeyResolver supplies the read keys tried when decrypting a message that carries no BodyKey.
+// A crypto.Keyring is a KeyResolver.
+type KeyResolver interface {
+	ReadKeys(channel string) []crypto.SessionKey
+}
+
+// readKeyAdder is implemented by KeyResolvers such as crypto.Keyring that can remember the read
+// keys published in channel metadata
+type readKeyAdder interface {
+	AddReadKey(channel string, key crypto.SessionKey)
+}
+
+// VerifyPolicy decides which decoded messages a Decoder returns, based on their Authorization
+type VerifyPolicy int
+
+const (
+	// AcceptAll returns every message that decrypts and whose HMAC matches
+	AcceptAll VerifyPolicy = iota
+	// RejectUnauthorized refuses messages the posting policy of their channel rejects, but
+	// accepts messages to channels whose metadata is unknown
+	RejectUnauthorized
+	// RequireAuthorized refuses every message that is not Authorized or an UnauthorizedReply,
+	// including messages to channels whose metadata is unknown
+	RequireAuthorized
+)
+
+// Verification holds the outcome of checking the signatures of a decoded message
+type Verification struct {
+	// Authorization is the outcome of the posting policy of the message's channel.  Metadata
+	// signed by its own identity is Authorized even when no earlier metadata is known.
+	Authorization Authorization
+	// SelfSigned reports whether metadata is signed by the identity it describes
+	SelfSigned bool
+}
+
+// DecodedMessage is a message decoded by a Decoder.  It shares nothing with the Decoder or other
+// messages and is never modified, so it can be used from many goroutines.
+type DecodedMessage struct {
+	header       Header
+	message      Message
+	signatures   Signatures
+	verification Verification
+}
+
+// Header returns a copy of the headers of the message, both public and encrypted
+func (m *DecodedMessage) Header() *Header {
+	h := m.header.clone()
+	return &h
+}
+
+// Message returns a copy of the pages, attachments, avatar and references of the message
+func (m *DecodedMessage) Message() *Message {
+	msg := m.message.clone()
+	return &msg
+}
+
+// Signatures returns the signatures of the message, to check them against other keys
+func (m *DecodedMessage) Signatures() Signatures {
+	return m.signatures
+}
+
+// Verification returns the outcome of checking the signatures of the message
+func (m *DecodedMessage) Verification() Verification {
+	return m.verification
+}
+
+// Decoder decodes Syndie messages.  It is configured once by NewDecoder and may then be used
+// from many goroutines at once.
+type Decoder struct {
+	keys           KeyResolver
+	metadata       func(channel string) *Header
+	maxPayloadSize int
+	maxHeaderLines int
+	limits         messageLimits
+	policy         VerifyPolicy
+}
+
+// NewDecoder creates a new Decoder and accepts a list of option functions
+func NewDecoder(opts ...func(*Decoder)) *Decoder {
+	d := &Decoder{
+		maxPayloadSize: maxPayloadSize,
+		maxHeaderLines: limit,
+		limits:         defaultMessageLimits(),
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// ReadKeyResolver is an optional function of Decoder.  When the resolver can add read keys, as
+// a crypto.Keyring can, the read keys published in decoded metadata are added to it.
+func ReadKeyResolver(keys KeyResolver) func(*Decoder) {
+	return func(d *Decoder) {
+		d.keys = keys
+	}
+}
+
+// MetadataResolver is an optional function of Decoder that supplies the current metadata of a
+// channel, or nil if it is unknown, to check messages against the channel's posting policy
+func MetadataResolver(metadata func(channel string) *Header) func(*Decoder) {
+	return func(d *Decoder) {
+		d.metadata = metadata
+	}
+}
+
+// MaxPayloadSize is an optional function of Decoder
+func MaxPayloadSize(size int) func(*Decoder) {
+	return func(d *Decoder) {
+		d.maxPayloadSize = size
+	}
+}
+
+// MaxHeaderLines is an optional function of Decoder
+func MaxHeaderLines(lines int) func(*Decoder) {
+	return func(d *Decoder) {
+		d.maxHeaderLines = lines
+	}
+}
+
+// MaxZipEntries is an optional function of Decoder
+func MaxZipEntries(entries int) func(*Decoder) {
+	return func(d *Decoder) {
+		d.limits.maxZipEntries = entries
+	}
+}
+
+// MaxZipEntrySize is an optional function of Decoder that limits the decompressed size of each
+// entry in the zip payload of a message
+func MaxZipEntrySize(size int64) func(*Decoder) {
+	return func(d *Decoder) {
+		d.limits.maxZipEntrySize = size
+	}
+}
+
+// MaxZipTotalSize is an optional function of Decoder that limits the decompressed size of all the
+// entries in the zip payload of a message together
+func MaxZipTotalSize(size int64) func(*Decoder) {
+	return func(d *Decoder) {
+		d.limits.maxZipTotalSize = size
+	}
+}
+
+// MaxAvatarSize is an optional function of Decoder.  Avatars larger than size are dropped, so
+// match the MaxAvatarSize of the PostBuilder when it allows larger avatars than the default.
+func MaxAvatarSize(size int) func(*Decoder) {
+	return func(d *Decoder) {
+		d.limits.maxAvatarSize = size
+	}
+}
+
+// Verify is an optional function of Decoder
+func Verify(policy VerifyPolicy) func(*Decoder) {
+	return func(d *Decoder) {
+		d.policy = policy
+	}
+}
+
+// Decode decodes a single message
+func (d *Decoder) Decode(r io.Reader) (*DecodedMessage, error) {
+	h := &Header{}
+	state := &decodeState{
+		h:              h,
+		keys:           d.keys,
+		maxPayloadSize: d.maxPayloadSize,
+		maxHeaderLines: d.maxHeaderLines,
+		limits:         d.limits,
+	}
+	m, err := state.decode(r)
+	if err != nil {
+		return nil, err
+	}
+	v := d.verify(h, state.sigs)
+	switch {
+	case d.policy == RejectUnauthorized && v.Authorization == Rejected,
+		d.policy == RequireAuthorized && v.Authorization != Authorized && v.Authorization != UnauthorizedReply:
+		return nil, fmt.Errorf("%w: %s", ErrUnauthorized, v.Authorization)
+	}
+	if adder, ok := d.keys.(readKeyAdder); ok {
+		learnReadKeys(adder, h, state.sigs)
+	}
+	return &DecodedMessage{header: *h, message: *m, signatures: state.sigs, verification: v}, nil
+}
+
+func (d *Decoder) verify(h *Header, sigs Signatures) Verification {
+	var v Verification
+	if h.IsMeta() {
+		v.SelfSigned = sigs.VerifyAuthorization(h.Identity)
+	}
+	var meta *Header
+	if d.metadata != nil {
+		meta = d.metadata(h.TargetChannelHash())
+	}
+	switch {
+	case meta != nil:
+		v.Authorization = Authorize(meta, h, sigs)
+	case v.SelfSigned:
+		v.Authorization = Authorized
+	default:
+		v.Authorization = Unchecked
+	}
+	return v
+}
+
+// clone copies a Header without sharing any of its slices
+func (h Header) clone() Header {
+	c := h
+	c.PostURI = h.PostURI.clone()
+	c.OverwriteURI = h.OverwriteURI.clone()
+	c.References = cloneURIs(h.References)
+	c.Cancel = cloneURIs(h.Cancel)
+	c.Tags = append([]string(nil), h.Tags...)
+	c.AuthorizedKeys = append([]string(nil), h.AuthorizedKeys...)
+	c.ManagerKeys = append([]string(nil), h.ManagerKeys...)
+	c.ChannelReadKeys = append([]string(nil), h.ChannelReadKeys...)
+	return c
+}
+
+func (u URI) clone() URI {
+	u.Tag = append([]string(nil), u.Tag...)
+	return u
+}
+
+func cloneURIs(uris []URI) []URI {
+	if uris == nil {
+		return nil
+	}
+	c := make([]URI, len(uris))
+	for i, u := range uris {
+		c[i] = u.clone()
+	}
+	return c
+}
+
+// clone copies a Message without sharing any of its slices
+func (m Message) clone() Message {
+	c := Message{
+		Page:   append([]Page(nil), m.Page...),
+		Avatar: append([]byte(nil), m.Avatar...),
+	}
+	for i := range c.Page {
+		c.Page[i].References = cloneReferences(c.Page[i].References)
+	}
+	for _, a := range m.Attachment {
+		a.Data = append([]byte(nil), a.Data...)
+		c.Attachment = append(c.Attachment, a)
+	}
+	c.References = cloneReferences(m.References)
+	return c
+}
+
+func cloneReferences(nodes []*ReferenceNode) []*ReferenceNode {
+	if nodes == nil {
+		return nil
+	}
+	c := make([]*ReferenceNode, len(nodes))
+	for i, n := range nodes {
+		copied := *n
+		copied.URI = n.URI.clone()
+		copied.Children = cloneReferences(n.Children)
+		c[i] = &copied
+	}
+	return c
+}
@@ -0,0 +1,135 @@
+package syndieutil
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+// testChannel creates a channel and returns its encoded metadata along with count posts to it,
+// the first half signed by the channel's identity and the rest unsigned
+func testChannel(t testing.TB, count int) (*Metadata, []byte, [][]byte) {
+	t.Helper()
+	m := NewMetadata()
+	if err := m.New("decoder test"); err != nil {
+		t.Fatal(err)
+	}
+	var meta bytes.Buffer
+	if err := m.Marshal(&meta, ""); err != nil {
+		t.Fatal(err)
+	}
+	channel := m.Identity.ChannelID().String()
+	var posts [][]byte
+	for i := 0; i < count; i++ {
+		b := NewPostBuilder(
+			Subject("post "+strconv.Itoa(i)),
+			PostURI(URI{RefType: "channel", Channel: channel, MessageID: i + 1}),
+		)
+		b.AddPage("text/plain", "", "hello "+strconv.Itoa(i))
+		body, err := b.Build()
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := crypto.NewSessionKey()
+		var signer *crypto.SigningKeypair
+		if i < count/2 {
+			signer = m.Identity
+		}
+		var buf bytes.Buffer
+		if err := New(MessageType("post"), BodyKey(key)).Marshal(&buf, body, key, signer); err != nil {
+			t.Fatal(err)
+		}
+		posts = append(posts, buf.Bytes())
+	}
+	return m, meta.Bytes(), posts
+}
+
+func TestDecoderMatchesUnmarshal(t *testing.T) {
+	_, meta, posts := testChannel(t, 32)
+	raws := append([][]byte{meta}, posts...)
+	d := NewDecoder(ReadKeyResolver(crypto.NewKeyring()))
+
+	results := make([]*DecodedMessage, len(raws))
+	errs := make([]error, len(raws))
+	var wg sync.WaitGroup
+	for i := range raws {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = d.Decode(bytes.NewReader(raws[i]))
+		}(i)
+	}
+	wg.Wait()
+
+	for i, raw := range raws {
+		h := New()
+		m, err := h.Unmarshal(bytes.NewReader(raw))
+		if (err == nil) != (errs[i] == nil) {
+			t.Fatalf("message %d: Unmarshal returned %v but Decode returned %v", i, err, errs[i])
+		}
+		if err != nil {
+			continue
+		}
+		got := results[i]
+		if got.Header().String() != h.String() {
+			t.Errorf("message %d: headers differ:\n%s\nwant\n%s", i, got.Header().String(), h.String())
+		}
+		if len(got.Message().Page) != len(m.Page) || (len(m.Page) > 0 && got.Message().Page[0].Data != m.Page[0].Data) {
+			t.Errorf("message %d: pages differ", i)
+		}
+		if h.IsMeta() && !got.Verification().SelfSigned {
+			t.Errorf("metadata is not reported as signed by its identity")
+		}
+	}
+}
+
+func TestDecoderVerifyPolicy(t *testing.T) {
+	m, meta, posts := testChannel(t, 8)
+	metaHeader := New()
+	if _, err := metaHeader.Unmarshal(bytes.NewReader(meta)); err != nil {
+		t.Fatalf("decoding metadata: %s", err)
+	}
+	channel := m.Identity.ChannelID().String()
+	d := NewDecoder(
+		Verify(RequireAuthorized),
+		MetadataResolver(func(c string) *Header {
+			if c == channel {
+				return metaHeader
+			}
+			return nil
+		}),
+	)
+	for i, raw := range posts {
+		decoded, err := d.Decode(bytes.NewReader(raw))
+		signed := i < len(posts)/2
+		switch {
+		case signed && err != nil:
+			t.Errorf("post %d signed by the owner was refused: %s", i, err)
+		case signed && decoded.Verification().Authorization != Authorized:
+			t.Errorf("post %d signed by the owner is %s", i, decoded.Verification().Authorization)
+		case !signed && !errors.Is(err, ErrUnauthorized):
+			t.Errorf("unsigned post %d: got %v, want ErrUnauthorized", i, err)
+		}
+	}
+
+	if _, err := NewDecoder(Verify(RequireAuthorized)).Decode(bytes.NewReader(posts[0])); err == nil {
+		t.Error("post to a channel with unknown metadata was accepted by RequireAuthorized")
+	}
+}
+
+func TestDecodedMessageIsCopied(t *testing.T) {
+	_, _, posts := testChannel(t, 1)
+	decoded, err := NewDecoder().Decode(bytes.NewReader(posts[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded.Header().Subject = "changed"
+	decoded.Message().Page[0].Data = "changed"
+	if decoded.Header().Subject == "changed" || decoded.Message().Page[0].Data == "changed" {
+		t.Error("changing a copy changed the decoded message")
+	}
+}
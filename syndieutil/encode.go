@@ -0,0 +1,94 @@
+package syndieutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"strconv"
+
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+// Marshal writes a complete message with h as its public headers.  The zipped body, as built
+// by PostBuilder, is encrypted with key and the message is authorized by signer, which may be nil
+// to leave the signatures empty.  The AuthenticationSig is left empty, as Java Syndie does when
+// the author is the key authorizing the post.
+func (h *Header) Marshal(w io.Writer, body []byte, key crypto.SessionKey, signer *crypto.SigningKeypair) error {
+	return h.MarshalAuthenticated(w, body, key, signer, nil)
+}
+
+// MarshalAuthenticated writes a complete message like Marshal, additionally signing the
+// AuthenticationSig with author's key.  Either key may be nil, and the AuthenticationSig is left
+// empty when author is the authorizing key.
+func (h *Header) MarshalAuthenticated(w io.Writer, body []byte, key crypto.SessionKey, authorizer *crypto.SigningKeypair, author *crypto.SigningKeypair) error {
+	k, err := base64.I2PEncoding.DecodeString(key)
+	if err != nil {
+		return errors.New("error decoding: " + err.Error())
+	}
+	payload, err := encryptBody(k, body)
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	msg.WriteString(syndieMessage + "0" + newLine)
+	msg.WriteString(h.String())
+	msg.WriteString(newLine)
+	msg.WriteString("Size=" + strconv.Itoa(len(payload)) + newLine)
+	msg.Write(payload)
+
+	hash := sha256.Sum256(msg.Bytes())
+	if author != nil && authorizer != nil && author.Pub == authorizer.Pub {
+		author = nil
+	}
+	authorizationSig, err := sign(authorizer, hash[:])
+	if err != nil {
+		return err
+	}
+	authenticationSig, err := sign(author, hash[:])
+	if err != nil {
+		return err
+	}
+	msg.WriteString("AuthorizationSig=" + authorizationSig + newLine)
+	msg.WriteString("AuthenticationSig=" + authenticationSig + newLine)
+	_, err = w.Write(msg.Bytes())
+	return err
+}
+
+// sign returns the base64 encoded signature of hash by signer, or nothing when signer is nil
+func sign(signer *crypto.SigningKeypair, hash []byte) (string, error) {
+	if signer == nil {
+		return "", nil
+	}
+	s, err := signer.Sign(hash)
+	if err != nil {
+		return "", err
+	}
+	return base64.I2PEncoding.EncodeToString(s), nil
+}
+
+// encryptBody lays out the body between random padding, encrypts it behind a random IV and
+// appends the HMAC, as described in payload.go
+func encryptBody(key []byte, body []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("error initializing NewCipher: " + err.Error())
+	}
+	plain, err := layoutBody(body)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, ivSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	encrypted := make([]byte, len(plain))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, plain)
+
+	payload := append(iv, encrypted...)
+	return append(payload, bodyHMAC(key, iv, encrypted)...), nil
+}
@@ -0,0 +1,75 @@
+package syndieutil
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+func TestMarshalRoundTrip(t *testing.T) {
+	owner, author := newSigner(t), newSigner(t)
+	channel := owner.ChannelID().String()
+	uri := URI{RefType: "channel", Channel: channel, MessageID: 7}
+	parent := URI{RefType: "channel", Channel: channel, MessageID: 3}
+	expiration := time.Date(2030, time.January, 2, 0, 0, 0, 0, time.UTC)
+	b := NewPostBuilder(Subject("round trip"), PostURI(uri), References([]URI{parent}), Expiration(expiration))
+	b.AddTag("go")
+	b.AddPage("text/plain", "first", "hello")
+	b.AddPage("text/html", "second", "<p>world</p>")
+	b.AddAttachment("a.txt", "text/plain", "an attachment", strings.NewReader("attached"))
+	body, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		authorizer *crypto.SigningKeypair
+		author     *crypto.SigningKeypair
+	}{
+		{"unsigned", nil, nil},
+		{"signed by the owner", owner, nil},
+		{"authored by the owner", owner, owner},
+		{"authored by another key", owner, author},
+		{"authenticated only", nil, author},
+	} {
+		key := crypto.NewSessionKey()
+		var buf bytes.Buffer
+		if err := New(MessageType("post"), BodyKey(key)).MarshalAuthenticated(&buf, body, key, tt.authorizer, tt.author); err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		decoded, err := NewDecoder().Decode(&buf)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		h, m, sigs := decoded.Header(), decoded.Message(), decoded.Signatures()
+		if h.Subject != "round trip" || h.PostURI.MessageID != 7 || len(h.References) != 1 || h.References[0].MessageID != 3 {
+			t.Errorf("%s: encrypted headers did not round trip: %+v", tt.name, h)
+		}
+		if len(h.Tags) != 1 || h.Tags[0] != "go" || !h.Expiration.Equal(expiration) {
+			t.Errorf("%s: got tags %v and expiration %s", tt.name, h.Tags, h.Expiration)
+		}
+		if len(m.Page) != 2 || m.Page[0].Data != "hello" || m.Page[1].ContentType != "text/html" || m.Page[1].Title != "second" {
+			t.Errorf("%s: pages did not round trip: %+v", tt.name, m.Page)
+		}
+		if len(m.Attachment) != 1 || string(m.Attachment[0].Data) != "attached" || m.Attachment[0].Description != "an attachment" {
+			t.Errorf("%s: attachment did not round trip: %+v", tt.name, m.Attachment)
+		}
+
+		if got := sigs.VerifyAuthorization(owner.String()); got != (tt.authorizer != nil) {
+			t.Errorf("%s: authorization by the owner verifies: %t", tt.name, got)
+		}
+		if sigs.VerifyAuthorization(author.String()) {
+			t.Errorf("%s: authorization verifies with the author's key", tt.name)
+		}
+		if got := sigs.VerifyAuthentication(author.String()); got != (tt.author == author) {
+			t.Errorf("%s: authentication by the author verifies: %t", tt.name, got)
+		}
+		if sigs.VerifyAuthentication(owner.String()) {
+			t.Errorf("%s: authentication verifies with the owner's key", tt.name)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package syndieutil
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+func FuzzHeaderUnmarshal(f *testing.F) {
+	f.Add([]byte("Syndie.Message.1.0\nSubject=hi\n\nSize=0\n"))
+	f.Add([]byte("Syndie.Message.1.0\nBodyKey=AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=\n\nSize=48\n" +
+		"0123456789abcdef0123456789abcdef0123456789abcdef\nAuthorizationSig=\nAuthenticationSig=\n"))
+	keyring := crypto.NewKeyring()
+	keyring.AddReadKey("", crypto.NewSessionKey())
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := New()
+		h.Unmarshal(bytes.NewReader(data))
+		// Without a BodyKey the read keys are tried against the payload instead
+		NewDecoder(ReadKeyResolver(keyring)).Decode(bytes.NewReader(data))
+	})
+}
+
+func FuzzHeaderReadLine(f *testing.F) {
+	f.Add("Subject=hello")
+	f.Add("Edition=12")
+	f.Add("Expiration=20200101")
+	f.Add("References=urn:syndie:channel:d7:channel3:abc9:messageIdi5ee")
+	f.Add("PostURI=urn:syndie:channel:d7:channel3:abc9:messageIdi5ee")
+	f.Fuzz(func(t *testing.T, line string) {
+		h := New()
+		h.ReadLine(line)
+		_ = h.String()
+	})
+}
+
+func FuzzURIMarshall(f *testing.F) {
+	f.Add("urn:syndie:url:d3:url19:http://www.i2p.net/e")
+	f.Add("urn:syndie:channel:d7:channel3:abc9:messageIdi5e4:pagei0ee")
+	f.Add("syndie:search:d3:tagl3:i2pee")
+	f.Add("urn:syndie:archive:d3:url22:http://syndie.i2p/arch/e")
+	f.Fuzz(func(t *testing.T, s string) {
+		u := URI{}
+		if u.Marshall(s) == nil {
+			_ = u.String()
+		}
+	})
+}
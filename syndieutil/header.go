@@ -1,12 +1,11 @@
 package syndieutil
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // Header holds a Syndie message header that contains version and pairs fields
@@ -36,37 +35,10 @@ type Header struct {
 	AuthorizedKeys     []string
 	ManagerKeys        []string
 	Archives           string
-	ChannelReadKeys    string
-	Expiration         string
+	ChannelReadKeys    []string
+	Expiration         time.Time
 	MessageType        string
-
-	reader              *bufio.Reader
-	state               state
-	err                 error
-	iv                  []byte
-	enclosedReader      *bytes.Reader
-	encryptedPayload    []byte
-	totalPayloadSize    int
-	internalPayloadSize int
-	msg                 *Message
-	signature           []byte
-}
-
-type state int
-
-const (
-	readMagicVersionLine state = iota
-	readHeaderKeyPairs
-	readSizeLine
-	readIV
-	decrypt
-	readInternalPayloadSize
-	readInternalTotalSize
-	readZippedPayload
-	readSignature
-	verifyHMAC
-	invalid
-)
+}
 
 // New creates a new Header and accepts a list of option functions
 func New(opts ...func(*Header)) *Header {
@@ -150,9 +122,13 @@ func (h *Header) ReadLine(s string) error {
 		case "Archives":
 			h.Set(Archives(value))
 		case "ChannelReadKeys":
-			h.Set(ChannelReadKeys(value))
+			h.Set(ChannelReadKeys(parseSliceString(value)))
 		case "Expiration":
-			h.Set(Expiration(value))
+			t, err := parseDate(value)
+			if err != nil {
+				return fmt.Errorf("conversion error: %s", err)
+			}
+			h.Set(Expiration(t))
 		case "Syndie.MessageType":
 			h.Set(MessageType(value))
 		default:
@@ -163,6 +139,80 @@ func (h *Header) ReadLine(s string) error {
 	return errors.New("malformed header")
 }
 
+// String returns every header that is set as key=value lines in the form read by ReadLine
+func (h *Header) String() string {
+	var sb strings.Builder
+	line := func(key, value string) {
+		if value == "" {
+			return
+		}
+		sb.WriteString(key)
+		sb.WriteString("=")
+		sb.WriteString(value)
+		sb.WriteString(newLine)
+	}
+	uri := func(u URI) string {
+		if u.RefType == "" {
+			return ""
+		}
+		return u.String()
+	}
+	uris := func(us []URI) string {
+		var out []string
+		for _, u := range us {
+			out = append(out, uri(u))
+		}
+		return strings.Join(out, " ")
+	}
+	flag := func(b bool) string {
+		if !b {
+			return ""
+		}
+		return "true"
+	}
+	line("Author", h.Author)
+	line("AuthenticationMask", h.AuthenticationMask)
+	line("TargetChannel", h.TargetChannel)
+	line("PostURI", uri(h.PostURI))
+	line("References", uris(h.References))
+	line("Tags", strings.Join(h.Tags, " "))
+	line("OverwriteURI", uri(h.OverwriteURI))
+	line("ForceNewThread", flag(h.ForceNewThread))
+	line("RefuseReplies", flag(h.RefuseReplies))
+	line("Cancel", uris(h.Cancel))
+	line("Subject", h.Subject)
+	line("BodyKey", h.BodyKey)
+	line("BodyKeyPromptSalt", h.BodyKeyPromptSalt)
+	line("BodyKeyPrompt", h.BodyKeyPrompt)
+	line("Identity", h.Identity)
+	line("EncryptKey", h.EncryptKey)
+	line("Name", h.Name)
+	line("Description", h.Description)
+	if h.Edition != 0 {
+		line("Edition", strconv.Itoa(h.Edition))
+	}
+	line("PublicPosting", flag(h.PublicPosting))
+	line("PublicReplies", flag(h.PublicReplies))
+	line("AuthorizedKeys", strings.Join(h.AuthorizedKeys, " "))
+	line("ManagerKeys", strings.Join(h.ManagerKeys, " "))
+	line("Archives", h.Archives)
+	line("ChannelReadKeys", strings.Join(h.ChannelReadKeys, " "))
+	if !h.Expiration.IsZero() {
+		line("Expiration", formatDate(h.Expiration))
+	}
+	line("Syndie.MessageType", h.MessageType)
+	return sb.String()
+}
+
+// IsExpired reports whether the message has passed its Expiration date as of now.
+// The expiration date itself is the last day on which the message is still valid.
+func (h *Header) IsExpired(now time.Time) bool {
+	if h.Expiration.IsZero() {
+		return false
+	}
+	return !now.Before(h.Expiration.AddDate(0, 0, 1))
+}
+
 // Author is an optional function of Header
 func Author(author string) func(*Header) {
 	return func(h *Header) {
@@ -332,14 +382,14 @@ func Archives(archives string) func(*Header) {
 }
 
 // ChannelReadKeys is an optional function of Header
-func ChannelReadKeys(channelreadkeys string) func(*Header) {
+func ChannelReadKeys(channelreadkeys []string) func(*Header) {
 	return func(h *Header) {
 		h.ChannelReadKeys = channelreadkeys
 	}
 }
 
 // Expiration is an optional function of Header
-func Expiration(expiration string) func(*Header) {
+func Expiration(expiration time.Time) func(*Header) {
 	return func(h *Header) {
 		h.Expiration = expiration
 	}
@@ -369,6 +419,23 @@ func parseSingleURI(value string) URI {
 	return out
 }
 
+// dateFormats lists the layouts accepted for date headers, starting with Syndie's own YYYYMMDD
+var dateFormats = []string{"20060102", "2006/01/02", "2006-01-02"}
+
+func parseDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateFormats {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %s", value)
+}
+
+func formatDate(t time.Time) string {
+	return t.UTC().Format(dateFormats[0])
+}
+
 func parseBool(value string) bool {
 	return value == "true"
 }
@@ -0,0 +1,49 @@
+package syndieutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	want := time.Date(2024, time.March, 7, 0, 0, 0, 0, time.UTC)
+	for _, value := range []string{"20240307", "2024/03/07", "2024-03-07", " 20240307 "} {
+		got, err := parseDate(value)
+		if err != nil {
+			t.Errorf("%q: %s", value, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q parsed as %s", value, got)
+		}
+	}
+	for _, value := range []string{"", "2024037", "07/03/2024", "20241307", "tomorrow"} {
+		if _, err := parseDate(value); err == nil {
+			t.Errorf("%q parsed without an error", value)
+		}
+	}
+	if got := formatDate(want); got != "20240307" {
+		t.Errorf("formatDate wrote %q", got)
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	h := New()
+	if h.IsExpired(time.Now()) {
+		t.Error("message without an Expiration is expired")
+	}
+	h.ReadLine("Expiration=20240307")
+	for _, tt := range []struct {
+		now     time.Time
+		expired bool
+	}{
+		{time.Date(2024, time.March, 6, 12, 0, 0, 0, time.UTC), false},
+		{time.Date(2024, time.March, 7, 23, 59, 59, 0, time.UTC), false},
+		{time.Date(2024, time.March, 8, 0, 0, 0, 0, time.UTC), true},
+		{time.Date(2025, time.January, 1, 0, 0, 0, 0, time.UTC), true},
+	} {
+		if got := h.IsExpired(tt.now); got != tt.expired {
+			t.Errorf("IsExpired(%s) = %v, want %v", tt.now, got, tt.expired)
+		}
+	}
+}
@@ -6,15 +6,40 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
 )
 
+const headersFile = "headers.dat"
+const avatarFile = "avatar32.png"
+const pagePrefix = "page"
+const attachPrefix = "attach"
+
+// Default limits applied to the zip payload of a message before anything in it is parsed.  A
+// Decoder can change them with MaxZipEntries, MaxZipEntrySize and MaxZipTotalSize.
+const (
+	DefaultMaxZipEntries   = 256
+	DefaultMaxZipEntrySize = DefaultMaxAttachmentSize
+	DefaultMaxZipTotalSize = DefaultMaxPostSize + 64*1024
+)
+
+// ZipPolicyError reports the zip entry that broke the limits placed on a message payload
+type ZipPolicyError struct {
+	Entry  string
+	Reason string
+}
+
+func (e *ZipPolicyError) Error() string {
+	return fmt.Sprintf("enclosed zip entry %q rejected: %s", e.Entry, e.Reason)
+}
+
 type Message struct {
 	Page       []Page
 	Attachment []Attachment
 	Avatar     []byte
-	References string
+	References []*ReferenceNode
 }
 
 type Attachment struct {
@@ -27,10 +52,15 @@ type Attachment struct {
 type Page struct {
 	ContentType string
 	Title       string
-	References  string
-	Data        string
+	// References is the reference tree of the page.  Each line of the tree is stored in the
+	// page's cfg file as a References header of its own.
+	References []*ReferenceNode
+	Data       string
 }
 
+// ReadLine takes a key=value pair from a page's cfg file and reads it into the page.  A
+// References line adds its node at the top of the page's reference tree, so use readConfig to
+// read a whole cfg file with nested references.
 func (p *Page) ReadLine(s string) error {
 	if strings.Contains(s, "=") {
 		split := strings.SplitN(s, "=", 2)
@@ -42,7 +72,11 @@ func (p *Page) ReadLine(s string) error {
 		case "title":
 			p.Title = value
 		case "references":
-			p.References = value
+			nodes, err := ParseReferences(strings.NewReader(strings.TrimLeft(value, "\t")))
+			if err != nil {
+				return err
+			}
+			p.References = append(p.References, nodes...)
 		default:
 			return errors.New("malformed page")
 		}
@@ -50,86 +84,226 @@ func (p *Page) ReadLine(s string) error {
 	return nil
 }
 
-// ParseMessage is probably broken with multiple attachments/pages
+// messageLimits bounds what is accepted from the zip payload of a message
+type messageLimits struct {
+	maxZipEntries   int
+	maxZipEntrySize int64
+	maxZipTotalSize int64
+	maxAvatarSize   int
+}
+
+func defaultMessageLimits() messageLimits {
+	return messageLimits{
+		maxZipEntries:   DefaultMaxZipEntries,
+		maxZipEntrySize: DefaultMaxZipEntrySize,
+		maxZipTotalSize: DefaultMaxZipTotalSize,
+		maxAvatarSize:   DefaultMaxAvatarSize,
+	}
+}
+
+// ParseMessage reads the pages, attachments, avatar and references of a decrypted message,
+// along with the encrypted headers in headers.dat
 func (h *Header) ParseMessage(zr *zip.Reader) (Message, error) {
-	var foundPageCfg, foundPageDat bool
-	var foundAttachCfg, foundAttachDat bool
-	var pagenum, attachnum int
-	attachnum++
+	return h.parseMessage(zr, defaultMessageLimits())
+}
+
+func (h *Header) parseMessage(zr *zip.Reader, limits messageLimits) (Message, error) {
 	m := Message{}
-	a := Attachment{}
+	pages := make(map[int]*Page)
+	attachments := make(map[int]*Attachment)
+	if len(zr.File) > limits.maxZipEntries {
+		return Message{}, &ZipPolicyError{
+			Entry:  zr.File[limits.maxZipEntries].Name,
+			Reason: fmt.Sprintf("more than %d entries", limits.maxZipEntries),
+		}
+	}
+	seen := make(map[string]bool)
+	var total int64
 	for _, file := range zr.File {
-		fileReader, err := file.Open()
-		if err != nil {
-			return Message{}, fmt.Errorf("error opening enclosed zip file %s", err)
+		if err := checkEntryName(file.Name); err != nil {
+			return Message{}, err
+		}
+		if seen[file.Name] {
+			return Message{}, &ZipPolicyError{Entry: file.Name, Reason: "duplicate entry"}
 		}
-		contents, err := ioutil.ReadAll(fileReader)
+		seen[file.Name] = true
+		contents, err := readZipEntry(file, limits, limits.maxZipTotalSize-total)
 		if err != nil {
-			return Message{}, fmt.Errorf("error reading from enclosed zip file %s", err)
+			return Message{}, err
 		}
-		defer fileReader.Close()
+		total += int64(len(contents))
 		switch file.Name {
-		case "headers.dat":
+		case headersFile:
 			scanner := bufio.NewScanner(bytes.NewReader(contents))
 			for scanner.Scan() {
 				h.ReadLine(scanner.Text())
 			}
-		case "references.cfg":
-			m.References = string(contents)
-		case "avatar32.png":
-			m.Avatar = contents
-		}
-		if strings.HasPrefix(file.Name, "page") {
-			if foundPageCfg && foundPageDat {
-				pagenum++
+			continue
+		case referencesFile:
+			m.References, err = ParseReferences(bytes.NewReader(contents))
+			if err != nil {
+				return Message{}, fmt.Errorf("error parsing %s: %s", referencesFile, err)
 			}
-			p := Page{}
-			m.Page = append(m.Page, p)
-			if strings.HasSuffix(file.Name, ".dat") {
-				foundPageDat = true
-				m.Page[pagenum].Data = string(contents)
+			continue
+		case avatarFile:
+			// A bad avatar is dropped rather than handed to image libraries downstream
+			if ValidateAvatar(contents, limits.maxAvatarSize) == nil {
+				m.Avatar = contents
 			}
-			if strings.HasSuffix(file.Name, ".cfg") {
-				foundPageCfg = true
-				scanner := bufio.NewScanner(bytes.NewReader(contents))
-				for scanner.Scan() {
-					m.Page[pagenum].ReadLine(scanner.Text())
+			continue
+		}
+		if n, ext, ok := entryIndex(file.Name, pagePrefix); ok {
+			p, found := pages[n]
+			if !found {
+				p = &Page{}
+				pages[n] = p
+			}
+			switch ext {
+			case ".dat":
+				p.Data = string(contents)
+			case ".cfg":
+				if err := p.readConfig(contents); err != nil {
+					return Message{}, fmt.Errorf("error parsing %s: %s", file.Name, err)
 				}
 			}
+			continue
 		}
-		// The spec is unclear if this should be "attach" or "attachment"
-		if strings.HasPrefix(file.Name, "attachment") {
-			if strings.HasSuffix(file.Name, ".dat") {
-				a.Data = contents
-				foundAttachDat = true
-				continue
+		// The spec is unclear if this should be "attach" or "attachment" so accept both
+		n, ext, ok := entryIndex(file.Name, "attachment")
+		if !ok {
+			n, ext, ok = entryIndex(file.Name, attachPrefix)
+		}
+		if ok {
+			a, found := attachments[n]
+			if !found {
+				a = &Attachment{}
+				attachments[n] = a
 			}
-			if strings.HasSuffix(file.Name, ".cfg") {
+			switch ext {
+			case ".dat":
+				a.Data = contents
+			case ".cfg":
 				scanner := bufio.NewScanner(bytes.NewReader(contents))
 				for scanner.Scan() {
-					if strings.Contains(scanner.Text(), "=") {
-						split := strings.SplitN(scanner.Text(), "=", 2)
-						key := strings.ToLower(string(split[0]))
-						value := string(split[1])
-						switch key {
-						case "name":
-							a.Name = value
-						case "content-type":
-							a.ContentType = value
-						case "description":
-							a.Description = value
-						}
-					}
-				}
-				foundAttachCfg = true
-				if foundAttachCfg && foundAttachDat {
-					m.Attachment = append(m.Attachment, a)
-					foundAttachCfg = false
-					foundAttachDat = false
+					a.ReadLine(scanner.Text())
 				}
-				continue
 			}
 		}
 	}
+	var pageNums, attachNums []int
+	for n := range pages {
+		pageNums = append(pageNums, n)
+	}
+	for n := range attachments {
+		attachNums = append(attachNums, n)
+	}
+	sort.Ints(pageNums)
+	sort.Ints(attachNums)
+	for _, n := range pageNums {
+		m.Page = append(m.Page, *pages[n])
+	}
+	for _, n := range attachNums {
+		m.Attachment = append(m.Attachment, *attachments[n])
+	}
 	return m, nil
 }
+
+// readConfig reads a page's cfg file, gathering its References lines into one reference tree
+func (p *Page) readConfig(contents []byte) error {
+	var refs strings.Builder
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if split := strings.SplitN(line, "=", 2); len(split) == 2 && strings.ToLower(split[0]) == "references" {
+			refs.WriteString(split[1] + newLine)
+			continue
+		}
+		p.ReadLine(line)
+	}
+	if refs.Len() == 0 {
+		return nil
+	}
+	nodes, err := ParseReferences(strings.NewReader(refs.String()))
+	if err != nil {
+		return err
+	}
+	p.References = append(p.References, nodes...)
+	return nil
+}
+
+// ReadLine takes a key=value pair from an attachment's cfg file and reads it into the attachment
+func (a *Attachment) ReadLine(s string) error {
+	if strings.Contains(s, "=") {
+		split := strings.SplitN(s, "=", 2)
+		key := strings.ToLower(string(split[0]))
+		value := string(split[1])
+		switch key {
+		case "name":
+			a.Name = value
+		case "content-type":
+			a.ContentType = value
+		case "description":
+			a.Description = value
+		default:
+			return errors.New("malformed attachment")
+		}
+	}
+	return nil
+}
+
+// readZipEntry reads a zip entry, refusing to decompress more than the per-entry limit or the
+// remaining total budget no matter what sizes the entry claims
+func readZipEntry(file *zip.File, limits messageLimits, remaining int64) ([]byte, error) {
+	limit := limits.maxZipEntrySize
+	reason := fmt.Sprintf("larger than %d bytes", limits.maxZipEntrySize)
+	if remaining < limit {
+		limit = remaining
+		reason = fmt.Sprintf("payload larger than %d bytes in total", limits.maxZipTotalSize)
+	}
+	if file.UncompressedSize64 > uint64(limit) {
+		return nil, &ZipPolicyError{Entry: file.Name, Reason: reason}
+	}
+	fileReader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening enclosed zip file %s: %s", file.Name, err)
+	}
+	defer fileReader.Close()
+	contents, err := io.ReadAll(io.LimitReader(fileReader, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading from enclosed zip file %s: %s", file.Name, err)
+	}
+	if int64(len(contents)) > limit {
+		return nil, &ZipPolicyError{Entry: file.Name, Reason: reason}
+	}
+	return contents, nil
+}
+
+// checkEntryName rejects entry names that could escape a directory if the payload were extracted
+func checkEntryName(name string) error {
+	switch {
+	case name == "":
+		return &ZipPolicyError{Entry: name, Reason: "empty name"}
+	case strings.ContainsAny(name, "/\\:\x00"):
+		return &ZipPolicyError{Entry: name, Reason: "name contains a path"}
+	case name == "." || name == "..":
+		return &ZipPolicyError{Entry: name, Reason: "name contains a path"}
+	}
+	return nil
+}
+
+// entryIndex splits a zip entry name such as "page3.cfg" into its number and extension
+func entryIndex(name, prefix string) (int, string, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return 0, "", false
+	}
+	rest := name[len(prefix):]
+	dot := strings.Index(rest, ".")
+	if dot <= 0 {
+		return 0, "", false
+	}
+	n, err := strconv.Atoi(rest[:dot])
+	if err != nil || n < 0 {
+		return 0, "", false
+	}
+	return n, rest[dot:], true
+}
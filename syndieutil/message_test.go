@@ -0,0 +1,72 @@
+package syndieutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type zipEntry struct {
+	name string
+	data []byte
+}
+
+func buildZip(t *testing.T, entries ...zipEntry) *zip.Reader {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+func parseWith(zr *zip.Reader, opts ...func(*Decoder)) error {
+	_, err := New().parseMessage(zr, NewDecoder(opts...).limits)
+	return err
+}
+
+func TestParseMessageZipPolicy(t *testing.T) {
+	page := zipEntry{"page0.dat", []byte("hello")}
+	bomb := zipEntry{"attach0.dat", make([]byte, DefaultMaxZipEntrySize+1)}
+	tests := []struct {
+		name string
+		zr   *zip.Reader
+		opts []func(*Decoder)
+	}{
+		{"zip bomb", buildZip(t, page, bomb), nil},
+		{"duplicate entry", buildZip(t, page, page), nil},
+		{"parent directory", buildZip(t, zipEntry{"../page0.dat", nil}), nil},
+		{"nested path", buildZip(t, zipEntry{"pages/page0.dat", nil}), nil},
+		{"windows path", buildZip(t, zipEntry{`..\page0.dat`, nil}), nil},
+		{"dot dot", buildZip(t, zipEntry{"..", nil}), nil},
+		{"drive letter", buildZip(t, zipEntry{"c:page0.dat", nil}), nil},
+		{"too many entries", buildZip(t, page, zipEntry{"page1.dat", nil}, zipEntry{"page2.dat", nil}), []func(*Decoder){MaxZipEntries(2)}},
+		{"entry over the decoder's limit", buildZip(t, page), []func(*Decoder){MaxZipEntrySize(4)}},
+		{"total over the decoder's limit", buildZip(t, page, zipEntry{"page1.dat", []byte("hello")}), []func(*Decoder){MaxZipTotalSize(8)}},
+	}
+	for _, tt := range tests {
+		var policy *ZipPolicyError
+		if err := parseWith(tt.zr, tt.opts...); !errors.As(err, &policy) {
+			t.Errorf("%s: got %v, want a ZipPolicyError", tt.name, err)
+		}
+	}
+	if err := parseWith(buildZip(t, page, zipEntry{"page1.dat", []byte("hello")}), MaxZipTotalSize(10)); err != nil {
+		t.Errorf("payload exactly at the decoder's limit: %s", err)
+	}
+	if err := parseWith(buildZip(t, page, bomb), MaxZipEntrySize(2*DefaultMaxZipEntrySize)); err != nil {
+		t.Errorf("entry within a raised limit: %s", err)
+	}
+}
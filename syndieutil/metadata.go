@@ -1,6 +1,9 @@
 package syndieutil
 
 import (
+	"archive/zip"
+	"bytes"
+	"io"
 	"strconv"
 	"strings"
 
@@ -13,6 +16,7 @@ type Metadata struct {
 	Identity   *crypto.SigningKeypair
 	EncryptKey *crypto.PrivateReplyKeypair
 	BodyKey    crypto.SessionKey
+	ReadKeys   []crypto.SessionKey
 	Edition    int
 	Name       string
 }
@@ -39,6 +43,8 @@ func (m *Metadata) New(name string) error {
 		return err
 	}
 	m.EncryptKey = e
+	// Create the first "ChannelReadKeys" entry for readers of private posts
+	m.RotateReadKey()
 	// Create the first edition
 	m.Edition = buildEdition()
 	return nil
@@ -88,6 +94,81 @@ func (m Metadata) String() string {
 	return sb.String()
 }
 
+// RotateReadKey creates a new read key that becomes the current key for private posts.
+// Older keys are kept so earlier posts stay readable.
+func (m *Metadata) RotateReadKey() crypto.SessionKey {
+	key := buildSessionKey()
+	m.ReadKeys = append(m.ReadKeys, key)
+	return key
+}
+
+// CurrentReadKey returns the newest read key, or an empty key if the channel has none
+func (m Metadata) CurrentReadKey() crypto.SessionKey {
+	if len(m.ReadKeys) == 0 {
+		return ""
+	}
+	return m.ReadKeys[len(m.ReadKeys)-1]
+}
+
+// EncryptedHeaders returns the headers only authorized readers may see, which belong in
+// the encrypted headers.dat of the metadata message rather than its public headers
+func (m Metadata) EncryptedHeaders() string {
+	var sb strings.Builder
+	if len(m.ReadKeys) > 0 {
+		sb.WriteString("ChannelReadKeys=")
+		sb.WriteString(strings.Join(m.ReadKeys, " "))
+		sb.WriteString(newLine)
+	}
+	return sb.String()
+}
+
+// AddReadKeys adds the channel's read keys to a keyring so its private posts can be decrypted
+func (m Metadata) AddReadKeys(k *crypto.Keyring) {
+	channel := m.Identity.ChannelID().String()
+	for _, key := range m.ReadKeys {
+		k.AddReadKey(channel, key)
+	}
+}
+
+// Header returns the public headers of the channel's metadata message
+func (m Metadata) Header() *Header {
+	return New(
+		Name(m.Name),
+		BodyKey(m.BodyKey),
+		Identity(m.Identity.String()),
+		EncryptKey(m.EncryptKey.String()),
+		Edition(m.Edition),
+		MessageType("meta"),
+	)
+}
+
+// Marshal writes the channel's metadata message signed by its identity.  With an empty readerKey
+// the metadata is readable by anyone and the read keys are left out, otherwise the body is
+// encrypted with readerKey instead of a public BodyKey and carries the read keys for authorized readers.
+func (m Metadata) Marshal(w io.Writer, readerKey crypto.SessionKey) error {
+	h := m.Header()
+	key := m.BodyKey
+	var encrypted string
+	if readerKey != "" {
+		h.BodyKey = ""
+		key = readerKey
+		encrypted = m.EncryptedHeaders()
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create(headersFile)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(encrypted)); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return h.Marshal(w, buf.Bytes(), key, m.Identity)
+}
+
 func buildSessionKey() string {
 	return crypto.NewSessionKey()
 }
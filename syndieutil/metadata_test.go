@@ -0,0 +1,114 @@
+package syndieutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+// privatePost encodes a post to the channel that only holders of readKey can decrypt
+func privatePost(t *testing.T, m *Metadata, readKey crypto.SessionKey, id int) []byte {
+	t.Helper()
+	body, err := NewPostBuilder().AddPage("text/plain", "", "private").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := New(MessageType("post"), PostURI(URI{RefType: "channel", Channel: m.Identity.ChannelID().String(), MessageID: id}))
+	var buf bytes.Buffer
+	if err := h.Marshal(&buf, body, readKey, m.Identity); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadKeyRotation(t *testing.T) {
+	m := NewMetadata()
+	if err := m.New("private"); err != nil {
+		t.Fatal(err)
+	}
+	first := m.CurrentReadKey()
+	second := m.RotateReadKey()
+	if m.CurrentReadKey() != second || second == first || len(m.ReadKeys) != 2 {
+		t.Fatalf("rotating did not make a new current read key")
+	}
+	before := privatePost(t, m, first, 1)
+	after := privatePost(t, m, second, 2)
+
+	if _, err := New().Unmarshal(bytes.NewReader(before)); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("private post decoded without a keyring: %v", err)
+	}
+	keyring := crypto.NewKeyring()
+	m.AddReadKeys(keyring)
+	for i, raw := range [][]byte{before, after} {
+		if _, err := NewDecoder(ReadKeyResolver(keyring)).Decode(bytes.NewReader(raw)); err != nil {
+			t.Errorf("post %d: %s", i, err)
+		}
+	}
+}
+
+// privateMetadata encodes metadata claiming to describe m's channel, carrying read keys for the
+// holders of readerKey and signed by signer
+func privateMetadata(t *testing.T, m *Metadata, readerKey crypto.SessionKey, signer *crypto.SigningKeypair, readKeys ...string) []byte {
+	t.Helper()
+	var body bytes.Buffer
+	zw := zip.NewWriter(&body)
+	f, err := zw.Create(headersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(New(ChannelReadKeys(readKeys)).String()))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	h := m.Header()
+	h.BodyKey = ""
+	var buf bytes.Buffer
+	if err := h.Marshal(&buf, body.Bytes(), readerKey, signer); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLearnReadKeysFromMetadata(t *testing.T) {
+	m := NewMetadata()
+	if err := m.New("private"); err != nil {
+		t.Fatal(err)
+	}
+	channel := m.Identity.ChannelID().String()
+	readerKey := crypto.NewSessionKey()
+	var genuine bytes.Buffer
+	if err := m.Marshal(&genuine, readerKey); err != nil {
+		t.Fatal(err)
+	}
+	attacker := newSigner(t)
+	planted := crypto.NewSessionKey()
+	forged := privateMetadata(t, m, readerKey, attacker, planted)
+
+	keyring := crypto.NewKeyring()
+	keyring.AddReadKey(channel, readerKey)
+	decode := func(raw []byte) error {
+		_, err := NewDecoder(ReadKeyResolver(keyring)).Decode(bytes.NewReader(raw))
+		return err
+	}
+	if err := decode(forged); err != nil {
+		t.Fatalf("forged metadata: %s", err)
+	}
+	for _, key := range keyring.ReadKeys(channel) {
+		if key == planted {
+			t.Errorf("learned a read key from metadata not signed by the channel")
+		}
+	}
+	if err := decode(genuine.Bytes()); err != nil {
+		t.Fatalf("genuine metadata: %s", err)
+	}
+	if got := keyring.ReadKeys(channel); len(got) != 2 || got[1] != m.CurrentReadKey() {
+		t.Errorf("keyring holds %v after decoding the channel metadata", got)
+	}
+	post := privatePost(t, m, m.CurrentReadKey(), 1)
+	if err := decode(post); err != nil {
+		t.Errorf("private post: %s", err)
+	}
+}
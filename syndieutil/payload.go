@@ -0,0 +1,98 @@
+package syndieutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// The encrypted payload of a message is laid out as
+//
+//	IV | AES-256-CBC(prefix, 0x00, internal size, total size, zip, suffix) | HMAC
+//
+// The prefix is random bytes that are never zero, so the first zero byte ends it, and the suffix
+// is random bytes filling the last AES block.  The internal size is the length of the zip and the
+// total size that of the ciphertext and HMAC together, both as big endian uint32s.  The HMAC is a
+// SHA256 HMAC of the ciphertext keyed with the SHA256 hash of the body key followed by the IV.
+const (
+	ivSize   = aes.BlockSize
+	hmacSize = sha256.Size
+	// sizesLength is the zero byte ending the prefix and the two sizes following it
+	sizesLength = 1 + 4 + 4
+	// maxPrefixSize is the longest prefix written, though any prefix that fits is read
+	maxPrefixSize = aes.BlockSize - 1
+)
+
+// layoutBody places a zipped body between random padding, ready to be encrypted
+func layoutBody(body []byte) ([]byte, error) {
+	random := make([]byte, 1+maxPrefixSize)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	prefix := random[1:][:int(random[0])%(maxPrefixSize+1)]
+	for i := range prefix {
+		if prefix[i] == 0 {
+			prefix[i] = 1
+		}
+	}
+	unpadded := len(prefix) + sizesLength + len(body)
+	size := (unpadded + aes.BlockSize - 1) / aes.BlockSize * aes.BlockSize
+
+	plain := make([]byte, 0, size)
+	plain = append(plain, prefix...)
+	plain = append(plain, 0)
+	var sizes [8]byte
+	binary.BigEndian.PutUint32(sizes[:4], uint32(len(body)))
+	binary.BigEndian.PutUint32(sizes[4:], uint32(size+hmacSize))
+	plain = append(plain, sizes[:]...)
+	plain = append(plain, body...)
+	suffix := make([]byte, size-unpadded)
+	if _, err := rand.Read(suffix); err != nil {
+		return nil, err
+	}
+	return append(plain, suffix...), nil
+}
+
+// openBody returns the zipped body from a decrypted payload, checking that its sizes describe
+// the payload exactly
+func openBody(plain []byte) ([]byte, error) {
+	end := bytes.IndexByte(plain, 0)
+	if end < 0 || len(plain)-end < sizesLength {
+		return nil, errors.New(invalidMessage + ": no body sizes found")
+	}
+	sizes := plain[end+1 : end+sizesLength]
+	internalSize := binary.BigEndian.Uint32(sizes[:4])
+	totalSize := binary.BigEndian.Uint32(sizes[4:])
+	if uint64(totalSize) != uint64(len(plain)+hmacSize) {
+		return nil, errors.New(invalidMessage + ": body total size does not match the payload")
+	}
+	rest := plain[end+sizesLength:]
+	if uint64(internalSize) > uint64(len(rest)) {
+		return nil, errors.New(invalidMessage + ": zip payload larger than the message")
+	}
+	return rest[:internalSize], nil
+}
+
+// splitPayload separates the IV, ciphertext and HMAC of a payload
+func splitPayload(payload []byte) (iv []byte, ciphertext []byte, mac []byte, err error) {
+	if len(payload) < minPayloadSize {
+		return nil, nil, nil, errors.New(invalidMessage + ": payload too short")
+	}
+	ciphertext = payload[ivSize : len(payload)-hmacSize]
+	if len(ciphertext)%aes.BlockSize != 0 {
+		return nil, nil, nil, errors.New("ciphertext is not a multiple of the block size")
+	}
+	return payload[:ivSize], ciphertext, payload[len(payload)-hmacSize:], nil
+}
+
+// bodyHMAC returns the HMAC of a ciphertext encrypted with key and iv
+func bodyHMAC(key []byte, iv []byte, ciphertext []byte) []byte {
+	hmacKey := sha256.Sum256(append(append([]byte{}, key...), iv...))
+	hm := hmac.New(sha256.New, hmacKey[:])
+	hm.Write(ciphertext)
+	return hm.Sum(nil)
+}
@@ -0,0 +1,75 @@
+package syndieutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestLayoutBodyRoundTrip(t *testing.T) {
+	for size := 0; size < 200; size++ {
+		body := bytes.Repeat([]byte{0}, size)
+		plain, err := layoutBody(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(plain)%16 != 0 {
+			t.Fatalf("body of %d bytes laid out in %d bytes", size, len(plain))
+		}
+		got, err := openBody(plain)
+		if err != nil {
+			t.Fatalf("body of %d bytes: %s", size, err)
+		}
+		if !bytes.Equal(got, body) {
+			t.Fatalf("body of %d bytes came back as %d bytes", size, len(got))
+		}
+	}
+}
+
+func TestOpenBodyValidatesSizes(t *testing.T) {
+	plain, err := layoutBody([]byte("zip"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	end := bytes.IndexByte(plain, 0)
+	corrupt := func(f func(p []byte)) []byte {
+		p := append([]byte(nil), plain...)
+		f(p)
+		return p
+	}
+	tests := map[string][]byte{
+		"no terminator":   bytes.Repeat([]byte{1}, 32),
+		"truncated sizes": append(bytes.Repeat([]byte{1}, 12), 0, 0, 0, 0),
+		"wrong total size": corrupt(func(p []byte) {
+			binary.BigEndian.PutUint32(p[end+5:], uint32(len(p)))
+		}),
+		"internal size too large": corrupt(func(p []byte) {
+			binary.BigEndian.PutUint32(p[end+1:], uint32(len(p)))
+		}),
+	}
+	for name, p := range tests {
+		if _, err := openBody(p); err == nil {
+			t.Errorf("%s: openBody accepted the payload", name)
+		}
+	}
+}
+
+func TestEveryEncodedMessageDecodes(t *testing.T) {
+	_, meta, posts := testChannel(t, 200)
+	for i, raw := range append([][]byte{meta}, posts...) {
+		if _, err := New().Unmarshal(bytes.NewReader(raw)); err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+	}
+}
+
+func TestTamperedPayloadFailsHMAC(t *testing.T) {
+	_, _, posts := testChannel(t, 1)
+	raw := append([]byte(nil), posts[0]...)
+	// The last block of ciphertext sits just before the HMAC and the signature lines
+	i := bytes.LastIndex(raw, []byte("AuthorizationSig="))
+	raw[i-hmacSize-1] ^= 0xff
+	if _, err := New().Unmarshal(bytes.NewReader(raw)); err != ErrBadHMAC {
+		t.Fatalf("got %v, want ErrBadHMAC", err)
+	}
+}
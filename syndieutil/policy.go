@@ -0,0 +1,135 @@
+package syndieutil
+
+import (
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+// Authorization is the outcome of checking a post against its channel's posting policy
+type Authorization int
+
+const (
+	// Unchecked posts have not been evaluated, usually because the channel metadata is unknown
+	Unchecked Authorization = iota
+	// Authorized posts were signed by a key allowed to post or the channel accepts public posts
+	Authorized
+	// UnauthorizedReply posts come from anyone but are replies in a channel accepting public replies
+	UnauthorizedReply
+	// Rejected posts are not permitted in the channel
+	Rejected
+)
+
+func (a Authorization) String() string {
+	switch a {
+	case Authorized:
+		return "authorized"
+	case UnauthorizedReply:
+		return "unauthorized reply"
+	case Rejected:
+		return "rejected"
+	}
+	return "unchecked"
+}
+
+// Signatures holds the AuthorizationSig and AuthenticationSig of a decoded message along with the
+// hash they sign.  The zero value verifies against no key.
+type Signatures struct {
+	hash           []byte
+	authorization  []byte
+	authentication []byte
+	mask           string
+}
+
+// VerifyAuthorization reports whether the AuthorizationSig of a decoded message was made by the base64 encoded public key
+func (s Signatures) VerifyAuthorization(key string) bool {
+	if len(s.hash) == 0 || len(s.authorization) == 0 {
+		return false
+	}
+	return crypto.Verify(key, s.hash, s.authorization)
+}
+
+// VerifyAuthentication reports whether the AuthenticationSig of a decoded message was made by the base64
+// encoded public key, once the AuthenticationMask has been removed
+func (s Signatures) VerifyAuthentication(key string) bool {
+	if len(s.hash) == 0 || len(s.authentication) == 0 {
+		return false
+	}
+	sig := s.authentication
+	if s.mask != "" {
+		mask, err := base64.I2PEncoding.DecodeString(s.mask)
+		if err != nil || len(mask) != len(sig) {
+			return false
+		}
+		sig = make([]byte, len(mask))
+		for i := range mask {
+			sig[i] = s.authentication[i] ^ mask[i]
+		}
+	}
+	return crypto.Verify(key, s.hash, sig)
+}
+
+// Authorize evaluates the posting policy of the channel described by the metadata header meta against post,
+// whose signatures are sigs.
+// Posts signed by the channel owner, a manager or an authorized poster are authorized, as is anything
+// when PublicPosting is set.  Otherwise replies are let through as unauthorized replies when PublicReplies
+// is set, and everything else is rejected.  Metadata updates must be signed by the owner or a manager.
+func Authorize(meta *Header, post *Header, sigs Signatures) Authorization {
+	if meta == nil || post == nil {
+		return Unchecked
+	}
+	channel, ok := meta.ChannelID()
+	if target, valid := post.TargetChannelID(); !ok || !valid || target != channel {
+		return Rejected
+	}
+	managers := append([]string{meta.Identity}, meta.ManagerKeys...)
+	if post.IsMeta() {
+		for _, key := range managers {
+			if sigs.VerifyAuthorization(key) {
+				return Authorized
+			}
+		}
+		return Rejected
+	}
+	posters := append(managers, meta.AuthorizedKeys...)
+	author, _ := post.AuthorID()
+	for _, key := range posters {
+		if sigs.VerifyAuthorization(key) {
+			return Authorized
+		}
+		if id, err := crypto.ChannelIDFromIdentity(key); err == nil && id == author && sigs.VerifyAuthentication(key) {
+			return Authorized
+		}
+	}
+	if meta.PublicPosting {
+		return Authorized
+	}
+	if meta.PublicReplies && len(post.References) > 0 {
+		return UnauthorizedReply
+	}
+	return Rejected
+}
+
+// AuthorizedThreads builds threads for display from the posts in the channel described by meta,
+// leaving out rejected posts and recording the outcome of the policy on every node
+func AuthorizedThreads(meta *Header, messages []*DecodedMessage) []*Thread {
+	var allowed []*Header
+	outcome := make(map[*Header]Authorization)
+	for _, m := range messages {
+		h := m.Header()
+		a := Authorize(meta, h, m.signatures)
+		if a == Rejected {
+			continue
+		}
+		outcome[h] = a
+		allowed = append(allowed, h)
+	}
+	roots := BuildThreads(allowed)
+	for _, root := range roots {
+		root.Walk(func(t *Thread, depth int) {
+			if t.Header != nil {
+				t.Authorization = outcome[t.Header]
+			}
+		})
+	}
+	return roots
+}
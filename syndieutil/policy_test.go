@@ -0,0 +1,135 @@
+package syndieutil
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/go-i2p/go-i2p/lib/common/base64"
+	"github.com/kpetku/libsyndie/crypto"
+)
+
+func newSigner(t *testing.T) *crypto.SigningKeypair {
+	t.Helper()
+	skp := crypto.NewSigningKeypair()
+	if err := skp.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	return skp
+}
+
+// signedMessage encodes a message with the given headers signed by signer and returns it decoded
+func signedMessage(t *testing.T, signer *crypto.SigningKeypair, opts ...func(*Header)) *DecodedMessage {
+	t.Helper()
+	return authenticatedMessage(t, signer, nil, opts...)
+}
+
+// authenticatedMessage encodes a message with the given headers authorized by signer and
+// authenticated by author, either of which may be nil, and returns it decoded
+func authenticatedMessage(t *testing.T, signer, author *crypto.SigningKeypair, opts ...func(*Header)) *DecodedMessage {
+	t.Helper()
+	body, err := NewPostBuilder().AddPage("text/plain", "", "hello").Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := crypto.NewSessionKey()
+	var buf bytes.Buffer
+	if err := New(append([]func(*Header){BodyKey(key)}, opts...)...).MarshalAuthenticated(&buf, body, key, signer, author); err != nil {
+		t.Fatal(err)
+	}
+	m, err := NewDecoder().Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestVerifyAuthorization(t *testing.T) {
+	signer, other := newSigner(t), newSigner(t)
+	sigs := signedMessage(t, signer, MessageType("post")).Signatures()
+	if !sigs.VerifyAuthorization(signer.String()) {
+		t.Error("signature by the signer does not verify")
+	}
+	if sigs.VerifyAuthorization(other.String()) {
+		t.Error("signature verifies with another key")
+	}
+	if signedMessage(t, nil, MessageType("post")).Signatures().VerifyAuthorization(signer.String()) {
+		t.Error("unsigned message verifies")
+	}
+	if (Signatures{}).VerifyAuthorization(signer.String()) {
+		t.Error("signatures of no message verify")
+	}
+}
+
+func TestVerifyAuthentication(t *testing.T) {
+	signer, other := newSigner(t), newSigner(t)
+	sigs := authenticatedMessage(t, nil, signer, MessageType("post")).Signatures()
+	if !sigs.VerifyAuthentication(signer.String()) || sigs.VerifyAuthentication(other.String()) {
+		t.Fatal("unmasked authentication signature verifies with the wrong key")
+	}
+
+	mask := make([]byte, len(sigs.authentication))
+	rand.Read(mask)
+	masked := sigs
+	masked.mask = base64.I2PEncoding.EncodeToString(mask)
+	masked.authentication = make([]byte, len(mask))
+	for i := range mask {
+		masked.authentication[i] = sigs.authentication[i] ^ mask[i]
+	}
+	if !masked.VerifyAuthentication(signer.String()) {
+		t.Error("masked authentication signature does not verify")
+	}
+	masked.mask = base64.I2PEncoding.EncodeToString(mask[1:])
+	if masked.VerifyAuthentication(signer.String()) {
+		t.Error("authentication signature verifies with a mask of the wrong length")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	owner, manager, poster, stranger := newSigner(t), newSigner(t), newSigner(t), newSigner(t)
+	channel := owner.ChannelID().String()
+	meta := New(
+		MessageType("meta"),
+		Identity(owner.String()),
+		ManagerKeys([]string{manager.String()}),
+		AuthorizedKeys([]string{poster.String()}),
+	)
+	post := func(signer *crypto.SigningKeypair, opts ...func(*Header)) *DecodedMessage {
+		opts = append([]func(*Header){MessageType("post"), PostURI(URI{RefType: "channel", Channel: channel, MessageID: 1})}, opts...)
+		return signedMessage(t, signer, opts...)
+	}
+	reply := References([]URI{{RefType: "channel", Channel: channel, MessageID: 2}})
+	elsewhere := TargetChannel(stranger.ChannelID().String())
+	public := New(MessageType("meta"), Identity(owner.String()), PublicPosting(true))
+	replies := New(MessageType("meta"), Identity(owner.String()), PublicReplies(true))
+
+	tests := []struct {
+		name string
+		meta *Header
+		post *DecodedMessage
+		want Authorization
+	}{
+		{"owner", meta, post(owner), Authorized},
+		{"manager", meta, post(manager), Authorized},
+		{"authorized poster", meta, post(poster), Authorized},
+		{"stranger", meta, post(stranger), Rejected},
+		{"unsigned", meta, post(nil), Rejected},
+		{"authenticated poster", meta, authenticatedMessage(t, nil, poster, MessageType("post"),
+			PostURI(URI{RefType: "channel", Channel: channel, MessageID: 1}), Author(poster.ChannelID().String())), Authorized},
+		{"authenticated stranger", meta, authenticatedMessage(t, nil, stranger, MessageType("post"),
+			PostURI(URI{RefType: "channel", Channel: channel, MessageID: 1}), Author(stranger.ChannelID().String())), Rejected},
+		{"stranger reply", meta, post(stranger, reply), Rejected},
+		{"another channel", meta, post(owner, elsewhere), Rejected},
+		{"unknown metadata", nil, post(owner), Unchecked},
+		{"metadata by a manager", meta, signedMessage(t, manager, MessageType("meta"), Identity(owner.String())), Authorized},
+		{"metadata by a poster", meta, signedMessage(t, poster, MessageType("meta"), Identity(owner.String())), Rejected},
+		{"public posting", public, post(stranger), Authorized},
+		{"public reply", replies, post(stranger, reply), UnauthorizedReply},
+		{"public replies but not a reply", replies, post(stranger), Rejected},
+	}
+	for _, tt := range tests {
+		if got := Authorize(tt.meta, tt.post.Header(), tt.post.Signatures()); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
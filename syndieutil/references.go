@@ -0,0 +1,100 @@
+package syndieutil
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+)
+
+const referencesFile = "references.cfg"
+
+// ReferenceNode is an entry in a references.cfg tree, such as a bookmark or a link embedded in a post
+type ReferenceNode struct {
+	Name        string
+	Description string
+	RefType     string
+	URI         URI
+	Children    []*ReferenceNode
+}
+
+// ParseReferences reads a references.cfg tree.  Each line holds a node as tab separated
+// name, URI, reference type and description fields, and the number of leading tabs
+// gives the depth of the node below the previous one.
+func ParseReferences(r io.Reader) ([]*ReferenceNode, error) {
+	var roots []*ReferenceNode
+	var stack []*ReferenceNode
+	var counter int
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if counter > limit {
+			return nil, errors.New("too many references")
+		}
+		counter++
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		fields := strings.SplitN(line[depth:], "\t", 4)
+		for len(fields) < 4 {
+			fields = append(fields, "")
+		}
+		n := &ReferenceNode{
+			Name:        fields[0],
+			RefType:     fields[2],
+			Description: fields[3],
+		}
+		if fields[1] != "" {
+			// An unparseable URI leaves the rest of the node usable
+			n.URI.Marshall(fields[1])
+		}
+		if depth > len(stack) {
+			depth = len(stack)
+		}
+		stack = stack[:depth]
+		if depth == 0 {
+			roots = append(roots, n)
+		} else {
+			parent := stack[depth-1]
+			parent.Children = append(parent.Children, n)
+		}
+		stack = append(stack, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return roots, nil
+}
+
+// WriteReferences writes a references.cfg tree in the format read by ParseReferences
+func WriteReferences(w io.Writer, nodes []*ReferenceNode) error {
+	var sb strings.Builder
+	for _, n := range nodes {
+		n.write(&sb, 0)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (n *ReferenceNode) write(sb *strings.Builder, depth int) {
+	sb.WriteString(strings.Repeat("\t", depth))
+	sb.WriteString(stripReferenceField(n.Name))
+	sb.WriteString("\t")
+	if n.URI.RefType != "" {
+		sb.WriteString(stripReferenceField(n.URI.String()))
+	}
+	sb.WriteString("\t")
+	sb.WriteString(stripReferenceField(n.RefType))
+	sb.WriteString("\t")
+	sb.WriteString(stripReferenceField(n.Description))
+	sb.WriteString(newLine)
+	for _, c := range n.Children {
+		c.write(sb, depth+1)
+	}
+}
+
+// stripReferenceField removes the separators that would otherwise corrupt the tree layout
+func stripReferenceField(s string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
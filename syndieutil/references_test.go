@@ -0,0 +1,81 @@
+package syndieutil
+
+import (
+	"archive/zip"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+const testReferences = "Links\t\tfolder\tsites worth reading\n" +
+	"\tForum\turn:syndie:channel:d7:channel44:DlhnF5HaL7xMAmYyiOHemhEj1koKuY2AjJsFQ4xdZno=9:messageIdi12ee\tpost\t\n" +
+	"\t\tNested\t\t\ta node two levels down\n" +
+	"\tEmpty\t\t\t\n" +
+	"Top\t\t\t\n"
+
+func TestReferencesRoundTrip(t *testing.T) {
+	nodes, err := ParseReferences(bytes.NewBufferString(testReferences))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 || len(nodes[0].Children) != 2 || len(nodes[0].Children[0].Children) != 1 {
+		t.Fatalf("parsed the wrong tree shape")
+	}
+	forum := nodes[0].Children[0]
+	if forum.Name != "Forum" || forum.RefType != "post" || forum.URI.MessageID != 12 {
+		t.Errorf("parsed %+v", forum)
+	}
+	if nodes[0].Description != "sites worth reading" {
+		t.Errorf("got description %q", nodes[0].Description)
+	}
+
+	var out bytes.Buffer
+	if err := WriteReferences(&out, nodes); err != nil {
+		t.Fatal(err)
+	}
+	again, err := ParseReferences(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(nodes, again) {
+		t.Errorf("tree changed after writing and parsing it again")
+	}
+}
+
+func TestWriteReferencesStripsSeparators(t *testing.T) {
+	var out bytes.Buffer
+	WriteReferences(&out, []*ReferenceNode{{Name: "two\nlines", Description: "a\ttab"}})
+	nodes, err := ParseReferences(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].Name != "two lines" || nodes[0].Description != "a tab" {
+		t.Errorf("got %+v", nodes)
+	}
+}
+
+func TestPageReferencesRoundTrip(t *testing.T) {
+	nodes, err := ParseReferences(bytes.NewBufferString(testReferences))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := NewPostBuilder().AddPage("text/plain", "", "see the links")
+	for _, n := range nodes {
+		b.AddPageReference(n)
+	}
+	body, err := b.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := New().ParseMessage(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Page) != 1 || !reflect.DeepEqual(m.Page[0].References, nodes) {
+		t.Errorf("page references changed in the post")
+	}
+}
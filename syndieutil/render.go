@@ -0,0 +1,351 @@
+package syndieutil
+
+import (
+	"html"
+	"strconv"
+	"strings"
+)
+
+// allowedTags maps the HTML elements Syndie pages may use to the attributes they may carry
+var allowedTags = map[string][]string{
+	"a":          {"href", "title", "name"},
+	"img":        {"src", "alt", "title", "width", "height"},
+	"p":          nil,
+	"br":         nil,
+	"hr":         nil,
+	"b":          nil,
+	"i":          nil,
+	"u":          nil,
+	"s":          nil,
+	"em":         nil,
+	"strong":     nil,
+	"tt":         nil,
+	"code":       nil,
+	"pre":        nil,
+	"sub":        nil,
+	"sup":        nil,
+	"cite":       nil,
+	"quote":      nil,
+	"blockquote": nil,
+	"div":        nil,
+	"span":       nil,
+	"h1":         nil,
+	"h2":         nil,
+	"h3":         nil,
+	"h4":         nil,
+	"h5":         nil,
+	"h6":         nil,
+	"ul":         nil,
+	"ol":         nil,
+	"li":         nil,
+	"dl":         nil,
+	"dt":         nil,
+	"dd":         nil,
+	"table":      nil,
+	"thead":      nil,
+	"tbody":      nil,
+	"tr":         {"colspan", "rowspan"},
+	"td":         {"colspan", "rowspan"},
+	"th":         {"colspan", "rowspan"},
+}
+
+// voidTags are allowed elements that never have content or an end tag
+var voidTags = map[string]bool{"br": true, "hr": true, "img": true}
+
+// rawTextTags are elements whose content is not HTML and is dropped along with the element
+var rawTextTags = map[string]bool{
+	"script": true, "style": true, "textarea": true, "title": true, "iframe": true, "object": true,
+	"noscript": true, "noembed": true, "noframes": true, "xmp": true, "plaintext": true, "template": true,
+}
+
+// Renderer turns page content into HTML that is safe to display.  Only Syndie's allowed subset of
+// HTML survives, and every link or image source is passed to one of the handlers below, so nothing
+// is ever fetched from the network unless the application chooses to.  A nil handler, or a handler
+// returning "", removes the attribute.
+type Renderer struct {
+	// SyndieURI rewrites syndie: and urn:syndie: URIs
+	SyndieURI func(u URI) string
+	// Attachment rewrites references to an attachment of the post, such as "attachment0"
+	Attachment func(n int) string
+	// Page rewrites references to another page of the post, such as "page1"
+	Page func(n int) string
+	// External rewrites http, https and ftp links.  Images never use it, so remote images are always blocked.
+	External func(url string) string
+}
+
+// Render returns the page content as safe HTML, escaping text/plain pages and sanitizing text/html ones
+func (r *Renderer) Render(p Page) string {
+	if strings.HasPrefix(strings.ToLower(p.ContentType), "text/html") {
+		return r.Sanitize(p.Data)
+	}
+	return "<pre>" + html.EscapeString(p.Data) + "</pre>"
+}
+
+// Sanitize reduces untrusted HTML to Syndie's allowed subset.  Unknown elements are dropped while
+// their text is kept, scripts and styles are dropped entirely, and markup that cannot be parsed is
+// escaped as text.
+func (r *Renderer) Sanitize(in string) string {
+	var sb strings.Builder
+	var open []string
+	for len(in) > 0 {
+		lt := strings.IndexByte(in, '<')
+		if lt < 0 {
+			sb.WriteString(escapeText(in))
+			break
+		}
+		sb.WriteString(escapeText(in[:lt]))
+		in = in[lt:]
+
+		switch {
+		case strings.HasPrefix(in, "<!--"):
+			end := strings.Index(in[4:], "-->")
+			if end < 0 {
+				return closeTags(&sb, open)
+			}
+			in = in[4+end+3:]
+			continue
+		case strings.HasPrefix(in, "<!") || strings.HasPrefix(in, "<?"):
+			end := strings.IndexByte(in, '>')
+			if end < 0 {
+				return closeTags(&sb, open)
+			}
+			in = in[end+1:]
+			continue
+		}
+
+		name, attrs, closing, rest, ok := parseTag(in)
+		if !ok {
+			sb.WriteString("&lt;")
+			in = in[1:]
+			continue
+		}
+		in = rest
+
+		if closing {
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i] == name {
+					for j := len(open) - 1; j >= i; j-- {
+						sb.WriteString("</" + open[j] + ">")
+					}
+					open = open[:i]
+					break
+				}
+			}
+			continue
+		}
+		if rawTextTags[name] {
+			in = skipRawText(in, name)
+			continue
+		}
+		allowed, ok := allowedTags[name]
+		if !ok {
+			continue
+		}
+		sb.WriteString("<" + name)
+		for _, a := range attrs {
+			if !contains(allowed, a.name) {
+				continue
+			}
+			value, ok := r.attribute(name, a.name, a.value)
+			if !ok {
+				continue
+			}
+			sb.WriteString(" " + a.name + "=\"" + html.EscapeString(value) + "\"")
+		}
+		if voidTags[name] {
+			sb.WriteString(" />")
+			continue
+		}
+		sb.WriteString(">")
+		open = append(open, name)
+	}
+	return closeTags(&sb, open)
+}
+
+// attribute validates an allowed attribute value and rewrites the URLs it contains
+func (r *Renderer) attribute(tag, name, value string) (string, bool) {
+	switch name {
+	case "href", "src":
+		return r.rewriteURL(value, tag == "img")
+	case "width", "height", "colspan", "rowspan":
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return "", false
+		}
+	}
+	return value, true
+}
+
+// rewriteURL hands a link or image source to the matching handler
+func (r *Renderer) rewriteURL(value string, image bool) (string, bool) {
+	// Browsers ignore whitespace and control characters inside URLs, so must we
+	value = strings.Map(func(c rune) rune {
+		if c <= ' ' || c == 0x7f {
+			return -1
+		}
+		return c
+	}, value)
+	lower := strings.ToLower(value)
+	var out string
+	switch {
+	case strings.HasPrefix(lower, "#") && !image:
+		return value, true
+	case strings.HasPrefix(lower, "syndie:") || strings.HasPrefix(lower, "urn:syndie:"):
+		var u URI
+		if r.SyndieURI == nil || u.Marshall(value) != nil {
+			return "", false
+		}
+		out = r.SyndieURI(u)
+	case localIndex(lower, "attachment") >= 0 || localIndex(lower, attachPrefix) >= 0:
+		if r.Attachment == nil {
+			return "", false
+		}
+		n := localIndex(lower, "attachment")
+		if n < 0 {
+			n = localIndex(lower, attachPrefix)
+		}
+		out = r.Attachment(n)
+	case localIndex(lower, pagePrefix) >= 0 && !image:
+		if r.Page == nil {
+			return "", false
+		}
+		out = r.Page(localIndex(lower, pagePrefix))
+	case !image && (strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "ftp://")):
+		if r.External == nil {
+			return "", false
+		}
+		out = r.External(value)
+	default:
+		return "", false
+	}
+	return out, out != ""
+}
+
+// localIndex parses references such as "attachment2" or "page1.html" and returns the number, or -1
+func localIndex(s, prefix string) int {
+	if !strings.HasPrefix(s, prefix) {
+		return -1
+	}
+	s = s[len(prefix):]
+	if dot := strings.IndexByte(s, '.'); dot >= 0 {
+		s = s[:dot]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 || strings.HasPrefix(s, "+") {
+		return -1
+	}
+	return n
+}
+
+type attribute struct {
+	name  string
+	value string
+}
+
+// parseTag reads a start or end tag at the beginning of s, returning what is left after it
+func parseTag(s string) (name string, attrs []attribute, closing bool, rest string, ok bool) {
+	i := 1
+	if i < len(s) && s[i] == '/' {
+		closing = true
+		i++
+	}
+	start := i
+	for i < len(s) && isNameChar(s[i]) {
+		i++
+	}
+	if i == start || !isLetter(s[start]) {
+		return "", nil, false, s, false
+	}
+	name = strings.ToLower(s[start:i])
+	for {
+		for i < len(s) && (isSpace(s[i]) || s[i] == '/') {
+			i++
+		}
+		if i >= len(s) {
+			return "", nil, false, s, false
+		}
+		if s[i] == '>' {
+			return name, attrs, closing, s[i+1:], true
+		}
+		start = i
+		for i < len(s) && !isSpace(s[i]) && s[i] != '=' && s[i] != '>' && s[i] != '/' {
+			i++
+		}
+		a := attribute{name: strings.ToLower(s[start:i])}
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+		if i < len(s) && s[i] == '=' {
+			i++
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+			if i < len(s) && (s[i] == '"' || s[i] == '\'') {
+				end := strings.IndexByte(s[i+1:], s[i])
+				if end < 0 {
+					return "", nil, false, s, false
+				}
+				a.value = s[i+1 : i+1+end]
+				i += end + 2
+			} else {
+				start = i
+				for i < len(s) && !isSpace(s[i]) && s[i] != '>' {
+					i++
+				}
+				a.value = s[start:i]
+			}
+		}
+		a.value = html.UnescapeString(a.value)
+		attrs = append(attrs, a)
+	}
+}
+
+// skipRawText drops everything up to and including the end tag of a raw text element
+func skipRawText(s, name string) string {
+	lower := strings.ToLower(s)
+	for i := 0; ; {
+		end := strings.Index(lower[i:], "</"+name)
+		if end < 0 {
+			return ""
+		}
+		i += end + 2 + len(name)
+		if i >= len(s) || s[i] == '>' || isSpace(s[i]) || s[i] == '/' {
+			gt := strings.IndexByte(s[i:], '>')
+			if gt < 0 {
+				return ""
+			}
+			return s[i+gt+1:]
+		}
+	}
+}
+
+func closeTags(sb *strings.Builder, open []string) string {
+	for i := len(open) - 1; i >= 0; i-- {
+		sb.WriteString("</" + open[i] + ">")
+	}
+	return sb.String()
+}
+
+func escapeText(s string) string {
+	return html.EscapeString(html.UnescapeString(s))
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isNameChar(c byte) bool {
+	return isLetter(c) || (c >= '0' && c <= '9') || c == '-'
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f'
+}
@@ -0,0 +1,93 @@
+package syndieutil
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testRenderer() *Renderer {
+	return &Renderer{
+		SyndieURI:  func(u URI) string { return "/syndie/" + strconv.Itoa(u.MessageID) },
+		Attachment: func(n int) string { return "/attachment/" + strconv.Itoa(n) },
+		Page:       func(n int) string { return "/page/" + strconv.Itoa(n) },
+		External:   func(url string) string { return "/external?" + url },
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"text", "a < b & c", "a &lt; b &amp; c"},
+		{"allowed markup", "<p>x<br>y</p>", "<p>x<br />y</p>"},
+		{"unknown element keeps its text", "<font color=red>x</font>", "x"},
+		{"script", "<script>alert(1)</script>ok", "ok"},
+		{"mixed case script", "<ScRiPt type=text/javascript>alert(1)</SCRIPT >ok", "ok"},
+		{"unterminated script", "ok<script>alert(1)", "ok"},
+		{"script split by a tag", "<scr<script>ipt>alert(1)</script>", "ipt&gt;alert(1)"},
+		{"style", "<style>body{background:url(http://evil/)}</style>text", "text"},
+		{"textarea", "<textarea><img src=x onerror=alert(1)></textarea>after", "after"},
+		{"raw text end tag prefix", "<style>a</styles>b</style>c", "c"},
+		{"iframe", "<iframe src=http://evil/></iframe>x", "x"},
+		{"comment", "<!-- <script>x</script> -->ok", "ok"},
+		{"doctype", "<!DOCTYPE html>ok", "ok"},
+		{"remote image", "<img src=http://evil/x.png>", "<img />"},
+		{"remote image in quotes", `<img src="https://evil/x.png" alt="x">`, `<img alt="x" />`},
+		{"attachment image", `<img src="attachment0" width=32>`, `<img src="/attachment/0" width="32" />`},
+		{"bad width", `<img width="-1" height="1e3">`, `<img />`},
+		{"javascript link", `<a href="javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"mixed case javascript", `<a href="JaVaScRiPt:alert(1)">x</a>`, "<a>x</a>"},
+		{"entity encoded javascript", `<a href="&#106;avascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"hex entity encoded javascript", `<a href="&#x6A;&#x61;vascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"javascript with whitespace", "<a href=\"java\tscript:alert(1)\">x</a>", "<a>x</a>"},
+		{"javascript with leading space", `<a href=" javascript:alert(1)">x</a>`, "<a>x</a>"},
+		{"data link", `<a href="data:text/html;base64,PHNjcmlwdD4=">x</a>`, "<a>x</a>"},
+		{"data image", `<img src="data:image/png;base64,AAAA">`, "<img />"},
+		{"vbscript link", `<a href="vbscript:msgbox(1)">x</a>`, "<a>x</a>"},
+		{"external link", `<a href="HTTP://example.i2p/">x</a>`, `<a href="/external?HTTP://example.i2p/">x</a>`},
+		{"fragment", `<a href="#top">x</a>`, `<a href="#top">x</a>`},
+		{"page link", `<a href=page1.html title=next>x</a>`, `<a href="/page/1" title="next">x</a>`},
+		{"syndie link", `<a href="urn:syndie:channel:d7:channel44:DlhnF5HaL7xMAmYyiOHemhEj1koKuY2AjJsFQ4xdZno=9:messageIdi7ee">x</a>`, `<a href="/syndie/7">x</a>`},
+		{"unquoted attribute", "<a href=#a title=hi>x</a>", `<a href="#a" title="hi">x</a>`},
+		{"quotes inside a value", `<a title='say "hi"'>x</a>`, `<a title="say &#34;hi&#34;">x</a>`},
+		{"unterminated attribute", `<a href="page1>x</a>`, "&lt;a href=&#34;page1&gt;x"},
+		{"unterminated tag", "<b", "&lt;b"},
+		{"not a tag", "1 <2", "1 &lt;2"},
+		{"unclosed tags", "<b><i>text", "<b><i>text</i></b>"},
+		{"misnested tags", "<b><i>x</b>y</i>", "<b><i>x</i></b>y"},
+		{"stray end tag", "x</div>", "x"},
+		{"event handler", `<p onclick="alert(1)">x</p>`, "<p>x</p>"},
+		{"event handler on an image", `<img src="attachment1" onerror="alert(1)">`, `<img src="/attachment/1" />`},
+		{"mixed case event handler", `<p ONMOUSEOVER=alert(1)>x</p>`, "<p>x</p>"},
+		{"style attribute", `<p style="background:url(http://evil/)">x</p>`, "<p>x</p>"},
+		{"self closing", "<br/><hr />", "<br /><hr />"},
+	}
+	r := testRenderer()
+	for _, tt := range tests {
+		if got := r.Sanitize(tt.in); got != tt.want {
+			t.Errorf("%s: Sanitize(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestSanitizeWithoutHandlers(t *testing.T) {
+	r := &Renderer{}
+	in := `<a href="http://example.i2p/">x</a><a href="page1">y</a><img src="attachment0">`
+	if got, want := r.Sanitize(in), "<a>x</a><a>y</a><img />"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRender(t *testing.T) {
+	r := testRenderer()
+	if got := r.Render(Page{ContentType: "text/plain", Data: "<b>hi</b>"}); got != "<pre>&lt;b&gt;hi&lt;/b&gt;</pre>" {
+		t.Errorf("text/plain page rendered as %q", got)
+	}
+	got := r.Render(Page{ContentType: "TEXT/HTML; charset=utf-8", Data: "<b onclick=x>hi</b><script>x</script>"})
+	if got != "<b>hi</b>" || strings.Contains(got, "script") {
+		t.Errorf("text/html page rendered as %q", got)
+	}
+}
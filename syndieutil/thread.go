@@ -0,0 +1,132 @@
+package syndieutil
+
+import (
+	"sort"
+)
+
+// Thread is a node in a conversation tree built from message headers
+type Thread struct {
+	URI           URI
+	Header        *Header
+	Authorization Authorization
+	Parent        *Thread
+	Children      []*Thread
+}
+
+// Placeholder reports whether the node stands in for a referenced message that was not supplied
+func (t *Thread) Placeholder() bool {
+	return t.Header == nil
+}
+
+// Walk calls fn for the node and each of its descendants in depth first order
+func (t *Thread) Walk(fn func(t *Thread, depth int)) {
+	t.walk(fn, 0)
+}
+
+func (t *Thread) walk(fn func(t *Thread, depth int), depth int) {
+	fn(t, depth)
+	for _, c := range t.Children {
+		c.walk(fn, depth+1)
+	}
+}
+
+// BuildThreads arranges decoded message headers into thread trees using PostURI and References.
+// References are read as ancestors ordered from the direct parent outwards, referenced messages
+// that are missing from headers become placeholder nodes, and messages with ForceNewThread set
+// always start a new thread.  The returned roots are ordered by message ID.
+func BuildThreads(headers []*Header) []*Thread {
+	nodes := make(map[string]*Thread)
+	var order []*Thread
+	get := func(u URI) *Thread {
+		key := u.MessageKey()
+		if t, ok := nodes[key]; ok {
+			return t
+		}
+		t := &Thread{URI: u}
+		nodes[key] = t
+		order = append(order, t)
+		return t
+	}
+
+	var posts []*Thread
+	for _, h := range headers {
+		if h == nil {
+			continue
+		}
+		var t *Thread
+		if h.PostURI.MessageKey() == "" {
+			// Without a PostURI nothing can refer to this message
+			t = &Thread{URI: h.PostURI}
+			order = append(order, t)
+		} else {
+			t = get(h.PostURI)
+			if t.Header != nil {
+				// Duplicate copy of a message we already have
+				continue
+			}
+		}
+		t.Header = h
+		posts = append(posts, t)
+	}
+
+	for _, t := range posts {
+		if t.Header.ForceNewThread {
+			continue
+		}
+		child := t
+		for _, ref := range t.Header.References {
+			if ref.MessageKey() == "" {
+				continue
+			}
+			parent := get(ref)
+			if child.Parent != nil || parent == child || parent.descendsFrom(child) {
+				break
+			}
+			parent.Children = append(parent.Children, child)
+			child.Parent = parent
+			if !parent.Placeholder() {
+				// A real parent links itself to its own ancestors
+				break
+			}
+			child = parent
+		}
+	}
+
+	var roots []*Thread
+	for _, t := range order {
+		sortThreads(t.Children)
+		if t.Parent == nil {
+			roots = append(roots, t)
+		}
+	}
+	sortThreads(roots)
+	return roots
+}
+
+// MissingMessages returns the URIs of every placeholder in the given threads so they can be fetched
+func MissingMessages(roots []*Thread) []URI {
+	var out []URI
+	for _, root := range roots {
+		root.Walk(func(t *Thread, depth int) {
+			if t.Placeholder() {
+				out = append(out, t.URI)
+			}
+		})
+	}
+	return out
+}
+
+func (t *Thread) descendsFrom(ancestor *Thread) bool {
+	for p := t.Parent; p != nil; p = p.Parent {
+		if p == ancestor {
+			return true
+		}
+	}
+	return false
+}
+
+func sortThreads(t []*Thread) {
+	sort.SliceStable(t, func(i, j int) bool {
+		return t[i].URI.MessageID < t[j].URI.MessageID
+	})
+}
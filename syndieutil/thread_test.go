@@ -0,0 +1,87 @@
+package syndieutil
+
+import "testing"
+
+func threadPost(id int, refs ...int) *Header {
+	h := &Header{PostURI: URI{RefType: "channel", Channel: "chan", MessageID: id}}
+	for _, r := range refs {
+		h.References = append(h.References, URI{RefType: "channel", Channel: "chan", MessageID: r})
+	}
+	return h
+}
+
+func TestBuildThreads(t *testing.T) {
+	roots := BuildThreads([]*Header{
+		threadPost(3, 2, 1),
+		threadPost(1),
+		threadPost(2, 1),
+		threadPost(4, 1),
+	})
+	if len(roots) != 1 || roots[0].URI.MessageID != 1 {
+		t.Fatalf("got %d roots, want message 1 alone", len(roots))
+	}
+	root := roots[0]
+	if len(root.Children) != 2 || root.Children[0].URI.MessageID != 2 || root.Children[1].URI.MessageID != 4 {
+		t.Fatalf("message 1 has the wrong children")
+	}
+	if c := root.Children[0].Children; len(c) != 1 || c[0].URI.MessageID != 3 {
+		t.Fatalf("message 3 is not a reply to message 2")
+	}
+	if missing := MissingMessages(roots); len(missing) != 0 {
+		t.Errorf("nothing is missing, got %v", missing)
+	}
+}
+
+func TestBuildThreadsMissingParents(t *testing.T) {
+	roots := BuildThreads([]*Header{threadPost(3, 2, 1)})
+	if len(roots) != 1 || roots[0].URI.MessageID != 1 || !roots[0].Placeholder() {
+		t.Fatalf("missing message 1 is not a placeholder root")
+	}
+	parent := roots[0].Children[0]
+	if parent.URI.MessageID != 2 || !parent.Placeholder() || parent.Children[0].Header == nil {
+		t.Fatalf("missing message 2 is not a placeholder between 1 and 3")
+	}
+	missing := MissingMessages(roots)
+	if len(missing) != 2 || missing[0].MessageID != 1 || missing[1].MessageID != 2 {
+		t.Errorf("got missing messages %v, want 1 and 2", missing)
+	}
+}
+
+func TestBuildThreadsCycle(t *testing.T) {
+	roots := BuildThreads([]*Header{
+		threadPost(1, 2),
+		threadPost(2, 1),
+		threadPost(3, 3),
+	})
+	var count int
+	for _, root := range roots {
+		root.Walk(func(*Thread, int) { count++ })
+	}
+	if count != 3 {
+		t.Fatalf("walking the threads visited %d messages, want 3", count)
+	}
+	for _, root := range roots {
+		if root.URI.MessageID == 3 && len(root.Children) != 0 {
+			t.Error("message 3 replies to itself")
+		}
+	}
+}
+
+func TestBuildThreadsDuplicates(t *testing.T) {
+	first := threadPost(2, 1)
+	roots := BuildThreads([]*Header{threadPost(1), first, threadPost(2, 1)})
+	if len(roots) != 1 || len(roots[0].Children) != 1 {
+		t.Fatalf("duplicate post was added twice")
+	}
+	if roots[0].Children[0].Header != first {
+		t.Error("the first copy of a duplicate post was not kept")
+	}
+}
+
+func TestBuildThreadsForceNewThread(t *testing.T) {
+	reply := threadPost(2, 1)
+	reply.ForceNewThread = true
+	if roots := BuildThreads([]*Header{threadPost(1), reply}); len(roots) != 2 {
+		t.Fatalf("got %d roots, want a new thread for message 2", len(roots))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/jackpal/bencode-go"
@@ -86,23 +87,80 @@ func prepareURI(in string) (out string, err error) {
 }
 
 // Marshall takes a URI as string and returns a populated URI
-func (u *URI) Marshall(s string) error {
+func (u *URI) Marshall(s string) (err error) {
 	if len(s) < 3 {
 		return errors.New("URI was too short to process")
 	}
-	u.RefType = strings.Split(s, ":")[0]
+	u.RefType = strings.Split(trimSyndieURI(s), ":")[0]
 	prepared, err := prepareURI(s)
 	if err != nil {
 		return err
 	}
+	if !strings.HasPrefix(prepared, "d") {
+		return errors.New("invalid URI: attributes are not a bencoded dictionary")
+	}
+	if end, err := checkBencode(prepared, 0, 0); err != nil || end != len(prepared) {
+		return errors.New("invalid URI: malformed bencoding")
+	}
 	r := bytes.NewReader([]byte(prepared))
 
-	berr := bencode.Unmarshal(r, &u)
+	// bencode panics when a value does not match the type of its field
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error while parsing bencode: %v", r)
+		}
+	}()
+	berr := bencode.Unmarshal(r, u)
 	if berr != nil {
 		return fmt.Errorf("error while parsing bencode: %s", berr)
 	}
 	return nil
 }
+
+// checkBencode walks the bencoded value starting at i and returns where it ends, so that
+// string lengths are known to fit in the input before the decoder allocates them
+func checkBencode(s string, i int, depth int) (int, error) {
+	if depth > 32 {
+		return 0, errors.New("nested too deeply")
+	}
+	if i >= len(s) {
+		return 0, errors.New("unexpected end")
+	}
+	switch c := s[i]; {
+	case c == 'i':
+		end := strings.IndexByte(s[i:], 'e')
+		if end < 0 {
+			return 0, errors.New("unterminated integer")
+		}
+		return i + end + 1, nil
+	case c == 'l' || c == 'd':
+		i++
+		for {
+			if i >= len(s) {
+				return 0, errors.New("unterminated list")
+			}
+			if s[i] == 'e' {
+				return i + 1, nil
+			}
+			var err error
+			if i, err = checkBencode(s, i, depth+1); err != nil {
+				return 0, err
+			}
+		}
+	case c >= '0' && c <= '9':
+		colon := strings.IndexByte(s[i:], ':')
+		if colon < 0 {
+			return 0, errors.New("unterminated string length")
+		}
+		n, err := strconv.Atoi(s[i : i+colon])
+		if err != nil || n < 0 || n > len(s)-(i+colon+1) {
+			return 0, errors.New("string length out of range")
+		}
+		return i + colon + 1 + n, nil
+	}
+	return 0, errors.New("unexpected character")
+}
+
 func (u *URI) String() string {
 	var buf []byte
 	w := bytes.NewBuffer(buf)
@@ -110,3 +168,12 @@ func (u *URI) String() string {
 	out, _ := prepareURI(w.String())
 	return "urn:syndie:" + u.RefType + ":" + out
 }
+
+// MessageKey identifies the message a URI points to, or returns "" if it does not point to one.
+// The channel hash is written the canonical way, so URIs spelling it differently share a key.
+func (u URI) MessageKey() string {
+	if u.Channel == "" || u.MessageID == 0 {
+		return ""
+	}
+	return canonicalHash(u.Channel) + ":" + strconv.Itoa(u.MessageID)
+}
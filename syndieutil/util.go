@@ -1,17 +1,15 @@
 package syndieutil
 
 import (
-	"crypto/sha256"
-	"encoding/binary"
 	"fmt"
-	"io"
 	"strings"
 
-	"github.com/go-i2p/go-i2p/lib/common/base64"
+	"github.com/kpetku/libsyndie/crypto"
 )
 
 const newLine string = "\n"
 
+// ShortIdent abbreviates a base64 encoded channel hash for display, see crypto.ChannelID.ShortIdent
 func ShortIdent(i string) string {
 	if len(i) > 6 {
 		return "[" + i[0:6] + "]"
@@ -19,24 +17,14 @@ func ShortIdent(i string) string {
 	return "[" + i + "]"
 }
 
+// ChanHash returns the base64 encoded ChannelID of the channel whose identity is a base64 encoded
+// DSA public key
 func ChanHash(s string) (string, error) {
-	foo := sha256.New()
-	bar, err := base64.I2PEncoding.DecodeString(s)
+	id, err := crypto.ChannelIDFromIdentity(s)
 	if err != nil {
 		return "", err
 	}
-	foo.Write([]byte(bar))
-	if err != nil {
-		return "", err
-	}
-	return base64.I2PEncoding.EncodeToString(foo.Sum(nil)), nil
-}
-
-func readInt(r io.Reader) int {
-	buf := make([]byte, 4)
-	io.ReadFull(r, buf)
-	internalSize := binary.BigEndian.Uint32(buf)
-	return int(internalSize)
+	return id.String(), nil
 }
 
 func value(s string) (string, error) {